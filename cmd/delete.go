@@ -0,0 +1,48 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/soubise/internal/client"
+	"github.com/wilsonehusin/soubise/internal/printer"
+)
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:   "delete <owner reference path>",
+	Short: "Deletes a shared file",
+	Long: `Deleting a shared file before it expires
+
+The reference path has to include the owner key, as printed by
+"soubise share" below the one to share. Once deleted, the file
+can no longer be downloaded by anyone.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := client.Delete(args[0]); err != nil {
+			printer.Stderr("unable to delete: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(deleteCmd)
+}
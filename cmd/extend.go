@@ -0,0 +1,75 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/soubise/internal/client"
+	"github.com/wilsonehusin/soubise/internal/printer"
+)
+
+const extendCmdName = "extend"
+
+type extendOptions struct {
+	Lifetime string `default:"24h"`
+}
+
+var extendOpts = &extendOptions{}
+
+// extendCmd represents the extend command
+var extendCmd = &cobra.Command{
+	Use:   extendCmdName + " <owner reference path>",
+	Short: "Changes when a shared file expires",
+	Long: `Changing when a shared file expires
+
+The file expires once the given lifetime has passed, counting
+from now. The reference path has to include the owner key, as
+printed by "soubise share" below the one to share.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		duration, err := time.ParseDuration(extendOpts.Lifetime)
+		if err != nil {
+			printer.Stderr("unable to understand provided lifetime: %v\n", err)
+			os.Exit(1)
+		}
+		if err := client.Extend(args[0], duration); err != nil {
+			printer.Stderr("unable to extend: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	if err := envconfig.Process(progName+"_"+extendCmdName, extendOpts); err != nil {
+		panic(err)
+	}
+	var optionsUsage bytes.Buffer
+	if err := envconfig.Usagef(progName+"_"+extendCmdName, extendOpts, &optionsUsage, optionsUsageTemplate); err != nil {
+		panic(err)
+	}
+	extendCmd.SetUsageTemplate(extendCmd.UsageTemplate() + optionsUsageHeader + optionsUsage.String() + rootCmdOptionsUsage())
+
+	extendCmd.Flags().StringVarP(&extendOpts.Lifetime, "lifetime", "l", extendOpts.Lifetime, "the lifetime for file to be downloadable, from now")
+
+	rootCmd.AddCommand(extendCmd)
+}
@@ -31,7 +31,14 @@ import (
 const getCmdName = "get"
 
 type getOptions struct {
-	RefPath string
+	RefPath          string
+	Password         string
+	Identity         string
+	TrustedKeys      string
+	RequireSignature bool
+	Output           string
+
+	promptPassword bool
 }
 
 var getOpts = &getOptions{}
@@ -50,10 +57,25 @@ var getCmd = &cobra.Command{
 			return fmt.Errorf("no reference path specified -- what are you trying to get?")
 		}
 
+		if getOpts.promptPassword && getOpts.Password == "" {
+			password, err := readPassword(false)
+			if err != nil {
+				return err
+			}
+			getOpts.Password = password
+		}
+
 		return nil
 	},
 	Run: func(*cobra.Command, []string) {
-		if err := client.Get(getOpts.RefPath); err != nil {
+		opts := &client.GetOptions{
+			Passphrase:       getOpts.Password,
+			Identity:         getOpts.Identity,
+			TrustedKeys:      getOpts.TrustedKeys,
+			RequireSignature: getOpts.RequireSignature,
+			Output:           getOpts.Output,
+		}
+		if err := client.Get(getOpts.RefPath, opts); err != nil {
 			printer.Stderr("unable to get content: %v\n", err)
 			os.Exit(1)
 		}
@@ -68,6 +90,11 @@ func init() {
 	getCmd.SetUsageTemplate(getCmd.UsageTemplate() + optionsUsageHeader + optionsUsage.String() + rootCmdOptionsUsage())
 
 	getCmd.Flags().StringVarP(&getOpts.RefPath, "path", "p", getOpts.RefPath, "reference path to retrieve from, prefixed with soubise://")
+	getCmd.Flags().StringVarP(&getOpts.Output, "output", "o", ".", "directory to write the file to, or to unpack shared directories into")
+	getCmd.Flags().StringVarP(&getOpts.Identity, "identity", "i", getOpts.Identity, "identity file, for files shared to recipients")
+	getCmd.Flags().StringVar(&getOpts.TrustedKeys, "trusted-keys", getOpts.TrustedKeys, "file of verifying keys, each optionally followed by a name, to check signatures against")
+	getCmd.Flags().BoolVar(&getOpts.RequireSignature, "require-signature", getOpts.RequireSignature, "refuse files which are not signed by a trusted key")
+	getCmd.Flags().BoolVar(&getOpts.promptPassword, "password", getOpts.promptPassword, "prompt for the password protecting the file")
 
 	rootCmd.AddCommand(getCmd)
 }
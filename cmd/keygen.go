@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/soubise/internal/client"
+	"github.com/wilsonehusin/soubise/internal/printer"
+)
+
+var (
+	keygenOutput  string
+	keygenSigning bool
+)
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Creates an identity to receive files, or a key to sign them",
+	Long: `Creating an identity to receive files, or a key to sign them
+
+The identity is a private key, keep it secret and pass it to
+"soubise get --identity". Its public key, printed along with it,
+is given to senders for "soubise share --recipient".
+
+With --signing, a signing key is created instead, to be passed to
+"soubise share --sign-with". Its verifying key is given to
+recipients, who list it in the file of "soubise get --trusted-keys".`,
+	Run: func(*cobra.Command, []string) {
+		if err := client.Keygen(keygenOutput, keygenSigning); err != nil {
+			printer.Stderr("unable to create key: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	keygenCmd.Flags().StringVarP(&keygenOutput, "output", "o", keygenOutput, "file to write the key to, printed if unspecified")
+	keygenCmd.Flags().BoolVar(&keygenSigning, "signing", keygenSigning, "create a signing key instead of an identity")
+
+	rootCmd.AddCommand(keygenCmd)
+}
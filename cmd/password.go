@@ -0,0 +1,57 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+
+	"github.com/wilsonehusin/soubise/internal/printer"
+)
+
+func readPassword(confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("unable to prompt for password without a terminal, set it through environment variable instead")
+	}
+
+	printer.Stderr("Password: ")
+	password, err := term.ReadPassword(fd)
+	printer.Stderr("\n")
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", fmt.Errorf("password cannot be empty")
+	}
+
+	if confirm {
+		printer.Stderr("Confirm password: ")
+		again, err := term.ReadPassword(fd)
+		printer.Stderr("\n")
+		if err != nil {
+			return "", err
+		}
+		if string(again) != string(password) {
+			return "", fmt.Errorf("passwords do not match")
+		}
+	}
+
+	return string(password), nil
+}
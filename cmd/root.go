@@ -18,11 +18,9 @@ package cmd
 
 import (
 	"bytes"
-	"math/rand"
 	"os"
 	"path"
 	"strconv"
-	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
@@ -70,8 +68,6 @@ func Execute() {
 }
 
 func init() {
-	rand.Seed(time.Now().UnixNano())
-
 	rootCmd.SetUsageTemplate(rootCmd.UsageTemplate() + optionsUsageHeader + rootCmdOptionsUsage())
 }
 
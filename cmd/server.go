@@ -18,8 +18,10 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog/log"
@@ -34,10 +36,11 @@ import (
 const serverCmdName = "server"
 
 type serverOptions struct {
-	Host        string `default:"pub.soubise.org"`
-	Port        int    `default:"8080"`
-	StoragePath string `default:"inmemory"`
-	BrokerPath  string
+	Host          string `default:"pub.soubise.org"`
+	Port          int    `default:"8080"`
+	StoragePath   string `default:"inmemory"`
+	BrokerPath    string
+	UploadTimeout time.Duration `default:"1h"`
 }
 
 var serverOpts = &serverOptions{}
@@ -46,7 +49,13 @@ var serverOpts = &serverOptions{}
 var serverCmd = &cobra.Command{
 	Use:   serverCmdName,
 	Short: "Starts target server",
-	Long:  `Starts target server`, // TODO: explain parameters
+	Long: `Starts target server
+
+Several servers can share one storage backend through a broker such
+as redis://host:6379/0, which coordinates updates of metadata and
+uploads between them. Each server only deletes the expired archives
+it stored or found when booting, the others are refused once expired
+but stay in storage until a server boots again.`, // TODO: explain remaining parameters
 	PreRunE: func(*cobra.Command, []string) error {
 		return serverPreCheck()
 	},
@@ -78,16 +87,22 @@ func init() {
 }
 
 func serverRun() {
-	userStop := make(chan os.Signal)
+	userStop := make(chan os.Signal, 1)
 	signal.Notify(userStop, os.Interrupt)
 
 	serverWaiter := make(chan bool)
 
 	brokerProvider := resolve.NewBrokerFromPath(serverOpts.BrokerPath)
 	storageProvider := resolve.NewStorageFromPath(serverOpts.StoragePath, brokerProvider)
+	storage.SetBroker(brokerProvider)
 	if err := storage.SetStorage(storageProvider); err != nil {
 		log.Fatal().Err(err).Msg("storage initialization")
 	}
+	// only the server repairs storages spanning several backends, other
+	// commands merely read from them
+	repairCtx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	storage.StartRepairs(repairCtx)
 
 	mux := router.NewMux()
 	webserver := server.HttpServer{
@@ -97,6 +112,7 @@ func serverRun() {
 			Port:           serverOpts.Port,
 			PreCheckExpiry: true,
 			ActiveExpiry:   true,
+			UploadTimeout:  serverOpts.UploadTimeout,
 		},
 	}
 
@@ -114,6 +130,7 @@ func serverRun() {
 		if err := webserver.Stop(); err != nil {
 			log.Error().Err(err).Msg("shutdown attempt")
 		}
+		stopRepairs()
 		log.Info().Msg("server has stopped")
 		serverWaiter <- true
 	}()
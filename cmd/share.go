@@ -27,16 +27,25 @@ import (
 
 	"github.com/wilsonehusin/soubise/internal/buildinfo"
 	"github.com/wilsonehusin/soubise/internal/client"
+	"github.com/wilsonehusin/soubise/internal/compression"
 	"github.com/wilsonehusin/soubise/internal/printer"
 )
 
 const shareCmdName = "share"
 
 type shareOptions struct {
-	FilePath string
-	Lifetime string `default:"24h"`
-	Server   string
+	FilePath     []string
+	Lifetime     string `default:"24h"`
+	Server       string
+	Password     string
+	Recipient    []string
+	SignWith     string
+	Message      string
+	Compression  string `default:"zstd"`
+	MaxDownloads uint32
 	//Auth     string
+
+	promptPassword bool
 }
 
 var shareOpts = &shareOptions{}
@@ -54,6 +63,31 @@ the encryption keys.
 This means that your sharing link contains the encryption key,
 be careful with whom and how you share the key!
 
+Alternatively, protect the file with a password through --password.
+The sharing link will then no longer contain the encryption key, it
+is safe to be posted publicly as long as the password is sent
+through another channel.
+
+Or encrypt the file to recipients through --recipient, using
+public keys created by "soubise keygen". The sharing link is then
+only useful to holders of the matching identities.
+
+Limit how often the file can be downloaded through --max-downloads,
+the server deletes it once the limit is reached. With a limit of 1,
+the file is gone after being read.
+
+Files signed through --sign-with can be verified by recipients to
+come from you.
+
+Directories and multiple files (repeating --file) are bundled
+together, keeping their relative paths, modes and symlinks.
+
+Large files are uploaded in chunks, a failed chunk is retried from
+the last one the server acknowledged. Until the upload completes,
+its progress is kept next to the (first) shared file, encryption
+key included, and running soubise again with the same files
+resumes it with the options it was started with.
+
 The same flags available in command line interface are also
 configurable through environment variable, providing flexibility
 in using Soubise programmatically.`,
@@ -66,7 +100,17 @@ in using Soubise programmatically.`,
 			printer.Stderr("unable to understand provided lifetime: %v\n", err)
 			os.Exit(1)
 		}
-		if err := client.Share(shareOpts.FilePath, duration, shareOpts.Server); err != nil {
+		opts := &client.ShareOptions{
+			Lifetime:     duration,
+			Server:       shareOpts.Server,
+			Passphrase:   shareOpts.Password,
+			Recipients:   shareOpts.Recipient,
+			SigningKey:   shareOpts.SignWith,
+			Message:      shareOpts.Message,
+			Compression:  shareOpts.Compression,
+			MaxDownloads: shareOpts.MaxDownloads,
+		}
+		if err := client.Share(shareOpts.FilePath, opts); err != nil {
 			printer.Stderr("unable to share: %v\n", err)
 			os.Exit(1)
 		}
@@ -78,7 +122,7 @@ func sharePreCheck() error {
 		return err
 	}
 
-	if shareOpts.FilePath == "" {
+	if len(shareOpts.FilePath) == 0 {
 		return fmt.Errorf("no filepath specified -- what are you trying to share?")
 	}
 
@@ -86,6 +130,18 @@ func sharePreCheck() error {
 		shareOpts.Server = buildinfo.Server
 	}
 
+	if err := compression.Validate(shareOpts.Compression); err != nil {
+		return err
+	}
+
+	if shareOpts.promptPassword && shareOpts.Password == "" {
+		password, err := readPassword(true)
+		if err != nil {
+			return err
+		}
+		shareOpts.Password = password
+	}
+
 	return nil
 }
 
@@ -99,9 +155,15 @@ func init() {
 	}
 	shareCmd.SetUsageTemplate(shareCmd.UsageTemplate() + optionsUsageHeader + optionsUsage.String() + rootCmdOptionsUsage())
 
-	shareCmd.Flags().StringVarP(&shareOpts.FilePath, "file", "f", shareOpts.FilePath, "path to file to be shared")
+	shareCmd.Flags().StringArrayVarP(&shareOpts.FilePath, "file", "f", shareOpts.FilePath, "path to file or directory to be shared, repeat to share several at once")
 	shareCmd.Flags().StringVarP(&shareOpts.Server, "server", "s", shareOpts.Server, "target server address")
 	shareCmd.Flags().StringVarP(&shareOpts.Lifetime, "lifetime", "l", shareOpts.Lifetime, "the lifetime for file to be downloadable")
+	shareCmd.Flags().StringVarP(&shareOpts.Message, "message", "m", shareOpts.Message, "message for the recipient, encrypted along with the file")
+	shareCmd.Flags().StringVarP(&shareOpts.Compression, "compression", "c", shareOpts.Compression, "compression applied before encryption: zstd, gzip or none")
+	shareCmd.Flags().StringArrayVarP(&shareOpts.Recipient, "recipient", "r", shareOpts.Recipient, "public key, or file of public keys, to encrypt the file to instead of including the key in the link")
+	shareCmd.Flags().StringVar(&shareOpts.SignWith, "sign-with", shareOpts.SignWith, "signing key file, created by \"soubise keygen --signing\", to sign the file with")
+	shareCmd.Flags().Uint32Var(&shareOpts.MaxDownloads, "max-downloads", shareOpts.MaxDownloads, "delete the file after it has been downloaded this many times, 0 for no limit")
+	shareCmd.Flags().BoolVar(&shareOpts.promptPassword, "password", shareOpts.promptPassword, "prompt for a password protecting the file, instead of including the key in the link")
 
 	rootCmd.AddCommand(shareCmd)
 }
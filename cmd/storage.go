@@ -0,0 +1,133 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/dustin/go-humanize"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/spf13/cobra"
+
+	"github.com/wilsonehusin/soubise/internal/broker"
+	"github.com/wilsonehusin/soubise/internal/migrate"
+	"github.com/wilsonehusin/soubise/internal/printer"
+	"github.com/wilsonehusin/soubise/internal/resolve"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+const migrateCmdName = "migrate"
+
+type migrateOptions struct {
+	From   string
+	To     string
+	DryRun bool
+}
+
+var migrateOpts = &migrateOptions{}
+
+// storageCmd groups commands operating on server storage
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Manages server storage",
+	Long:  `Managing server storage`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cmd.Help()
+	},
+}
+
+// migrateCmd represents the storage migrate command
+var migrateCmd = &cobra.Command{
+	Use:   migrateCmdName,
+	Short: "Copies shared files to another storage",
+	Long: `Copying shared files to another storage
+
+Every file which has not expired is copied along with its metadata,
+keeping its reference path working once the server uses the new
+storage. Both storage paths are written as for "soubise server".
+
+Copies are verified by their checksum. Files which were already
+copied are skipped, running the migration again resumes it. Run it
+one last time after stopping the server, to carry over downloads
+counted in the meantime.`,
+	Args: cobra.NoArgs,
+	PreRunE: func(*cobra.Command, []string) error {
+		if migrateOpts.From == "" || migrateOpts.To == "" {
+			return fmt.Errorf("both --from and --to storage paths are required")
+		}
+		if migrateOpts.From == migrateOpts.To {
+			return fmt.Errorf("--from and --to refer to the same storage")
+		}
+		return nil
+	},
+	Run: func(*cobra.Command, []string) {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		// migrating runs on its own, without other replicas to coordinate with.
+		// Repairs are never started, so a dry run does not write to either.
+		b := &broker.InMemoryBroker{}
+		from := resolve.NewStorageFromPath(migrateOpts.From, b)
+		var to storage.Storage
+		if migrateOpts.DryRun && !resolve.StorageExists(migrateOpts.To) {
+			// opening would create it, everything is to be migrated anyway
+			to = storage.NewInMemoryStorage(b)
+		} else {
+			to = resolve.NewStorageFromPath(migrateOpts.To, b)
+		}
+
+		report, err := migrate.Migrate(ctx, from, to, migrate.Options{DryRun: migrateOpts.DryRun})
+		if report != nil {
+			verb := "migrated"
+			if migrateOpts.DryRun {
+				verb = "to migrate"
+			}
+			printer.Stdout("%d files %s (%s), %d already migrated, %d expired, %d failed\n",
+				report.Migrated, verb, humanize.IBytes(uint64(report.Bytes)), report.Present, report.Expired, report.Failed)
+		}
+		if err != nil {
+			printer.Stderr("unable to migrate: %v\n", err)
+			os.Exit(1)
+		}
+		if report.Failed > 0 {
+			printer.Stderr("some files failed to migrate, run again to retry them\n")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	if err := envconfig.Process(progName+"_storage_"+migrateCmdName, migrateOpts); err != nil {
+		panic(err)
+	}
+	var optionsUsage bytes.Buffer
+	if err := envconfig.Usagef(progName+"_storage_"+migrateCmdName, migrateOpts, &optionsUsage, optionsUsageTemplate); err != nil {
+		panic(err)
+	}
+	migrateCmd.SetUsageTemplate(migrateCmd.UsageTemplate() + optionsUsageHeader + optionsUsage.String() + rootCmdOptionsUsage())
+
+	migrateCmd.Flags().StringVar(&migrateOpts.From, "from", migrateOpts.From, "storage path to copy files from")
+	migrateCmd.Flags().StringVar(&migrateOpts.To, "to", migrateOpts.To, "storage path to copy files to")
+	migrateCmd.Flags().BoolVar(&migrateOpts.DryRun, "dry-run", migrateOpts.DryRun, "report what would be copied without copying")
+
+	storageCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(storageCmd)
+}
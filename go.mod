@@ -3,13 +3,26 @@ module github.com/wilsonehusin/soubise
 go 1.16
 
 require (
+	cloud.google.com/go/storage v1.18.0
+	github.com/alicebob/miniredis/v2 v2.15.1
+	github.com/aws/aws-sdk-go v1.40.0
 	github.com/dustin/go-humanize v1.0.0
-	github.com/google/uuid v1.2.0
+	github.com/fsouza/fake-gcs-server v1.30.2
+	github.com/go-redis/redis/v8 v8.11.3
+	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
+	github.com/johannesboyne/gofakes3 v0.0.0-20210608054100-92d5d4af5fde
 	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/klauspost/compress v1.11.13
+	github.com/klauspost/reedsolomon v1.9.13
 	github.com/mattn/go-runewidth v0.0.10 // indirect
 	github.com/peterbourgon/diskv/v3 v3.0.0
 	github.com/rs/zerolog v1.20.0
 	github.com/spf13/cobra v1.1.3
 	github.com/theckman/yacspin v0.8.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+	google.golang.org/api v0.58.0
+	modernc.org/sqlite v1.14.1
 )
@@ -17,40 +17,137 @@ limitations under the License.
 package archive
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"time"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+// CipherSuite identifies how the content of an archive is encrypted.
+type CipherSuite uint8
+
+const (
+	// SuiteLegacyBlob seals the whole content in a single AES-256-GCM
+	// operation, see crypto.EncryptBlob. It is only found in gob archives.
+	SuiteLegacyBlob CipherSuite = 0x00
+	// SuiteStreamAESGCM seals the content in AES-256-GCM segments following
+	// the STREAM construction, see crypto.NewEncryptWriter.
+	SuiteStreamAESGCM CipherSuite = 0x01
 )
 
 type Archive struct {
-	Name    string
-	Content []byte
-	Expiry  time.Time
+	Suite  CipherSuite
+	Expiry time.Time
+	// KeyWraps hold the encryption key for ClaimTags which do not carry it
+	KeyWraps []crypto.KeyWrap
+	// Envelope holds the encrypted Metadata
+	Envelope []byte
+	// MaxDownloads asks the server to delete the archive after it has been
+	// downloaded this many times, unless 0
+	MaxDownloads uint32
+	// Signer is only set once the content has been read completely, if the
+	// archive carries a valid signature
+	Signer *crypto.VerifyingKey
+
+	// Name is only set by gob archives created before metadata was encrypted
+	// into Envelope, see Metadata
+	Name string
 }
 
-func LoadArchive(bin []byte) (*Archive, error) {
-	var data *Archive
-	decoder := gob.NewDecoder(bytes.NewBuffer(bin))
+// ReadArchive decodes the archive header from r and returns a Reader for the
+// encrypted content. Archives in the legacy gob encoding are still understood.
+func ReadArchive(r io.Reader) (*Archive, io.Reader, error) {
+	source := bufio.NewReader(r)
 
-	if err := decoder.Decode(&data); err != nil {
-		return nil, fmt.Errorf("decoding archive to data: %w", err)
+	if !hasMagic(source) {
+		return readGobArchive(source)
 	}
 
-	return data, nil
+	recorder := &recordingReader{source: source}
+	a, err := decodeHeader(recorder)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerDigest := sha256.Sum256(recorder.record.Bytes())
+	return a, &payloadReader{
+		source:        source,
+		archive:       a,
+		headerDigest:  headerDigest[:],
+		payloadDigest: sha256.New(),
+	}, nil
 }
 
-func (a *Archive) ToBytes() ([]byte, error) {
-	var bin bytes.Buffer
-	encoder := gob.NewEncoder(&bin)
+// PeekArchive decodes the archive header from r and returns a Reader which
+// replays the complete archive, header included, as it was read from r.
+func PeekArchive(r io.Reader) (*Archive, io.Reader, error) {
+	source := bufio.NewReader(r)
+	recorder := &recordingReader{source: source}
 
-	if err := encoder.Encode(a); err != nil {
-		return []byte{}, fmt.Errorf("encoding data to archive: %w", err)
+	var a *Archive
+	var err error
+	if hasMagic(source) {
+		a, err = decodeHeader(recorder)
+	} else {
+		a, _, err = readGobArchive(recorder)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return bin.Bytes(), nil
+	return a, io.MultiReader(&recorder.record, source), nil
+}
+
+// PeekUpload is PeekArchive for archives received from untrusted senders. It
+// refuses the legacy format, which is decoded by buffering it as a whole.
+func PeekUpload(r io.Reader) (*Archive, io.Reader, error) {
+	source := bufio.NewReader(r)
+	if !hasMagic(source) {
+		return nil, nil, &UnsupportedArchiveError{reason: "legacy format is no longer accepted"}
+	}
+	return PeekArchive(source)
+}
+
+type peekReader interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+}
+
+type recordingReader struct {
+	source *bufio.Reader
+	record bytes.Buffer
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+	r.record.Write(p[:n])
+	return n, err
+}
+
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.source.ReadByte()
+	if err == nil {
+		r.record.WriteByte(b)
+	}
+	return b, err
+}
+
+func (r *recordingReader) Peek(n int) ([]byte, error) {
+	return r.source.Peek(n)
 }
 
 func (a *Archive) HasExpired() bool {
 	return a.Expiry.Before(time.Now())
 }
+
+type UnsupportedArchiveError struct {
+	reason string
+}
+
+func (u *UnsupportedArchiveError) Error() string {
+	return fmt.Sprintf("unsupported archive: %s", u.reason)
+}
@@ -18,50 +18,239 @@ package archive
 
 import (
 	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
 )
 
 var tomorrow time.Time
 
 func init() {
-	tomorrow = time.Now().Add(24 * time.Hour)
+	tomorrow = time.Now().Add(24 * time.Hour).Truncate(time.Second)
 }
 
 func (a *Archive) Equals(other Archive) bool {
-	if a.Name != other.Name {
+	if a.Suite != other.Suite {
+		return false
+	}
+
+	if !a.Expiry.Equal(other.Expiry) {
 		return false
 	}
 
-	if !bytes.Equal(a.Content, other.Content) {
+	if !reflect.DeepEqual(a.KeyWraps, other.KeyWraps) {
 		return false
 	}
 
-	if a.Expiry != other.Expiry {
+	if !bytes.Equal(a.Envelope, other.Envelope) {
 		return false
 	}
 
-	return true
+	return a.Name == other.Name && a.MaxDownloads == other.MaxDownloads
+}
+
+func encodeArchive(t *testing.T, a *Archive, content []byte) []byte {
+	t.Helper()
+	var bin bytes.Buffer
+	w, err := NewWriter(&bin, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// multiple writes produce multiple payload sections
+	for _, chunk := range [][]byte{content[:len(content)/2], content[len(content)/2:]} {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bin.Bytes()
 }
 
 func TestEncodeDecode(t *testing.T) {
+	content := []byte("not much how about you")
 	obj := Archive{
-		Name:    "fakeFile_here.txt",
-		Content: []byte("not much how about you"),
-		Expiry:  tomorrow,
+		Suite:  SuiteStreamAESGCM,
+		Expiry: tomorrow,
+		KeyWraps: []crypto.KeyWrap{{
+			Kind:    crypto.PassphraseKeyWrap,
+			Salt:    []byte("salt"),
+			Time:    3,
+			Memory:  64 * 1024,
+			Threads: 4,
+			Nonce:   []byte("nonce"),
+			Sealed:  []byte("sealed"),
+		}, {
+			Kind:         crypto.RecipientKeyWrap,
+			EphemeralKey: []byte("ephemeral"),
+			Nonce:        []byte("nonce"),
+			Sealed:       []byte("sealed"),
+		}},
+		Envelope:     []byte("fakeFile_here.txt"),
+		MaxDownloads: 3,
 	}
 
-	receivedBin, err := obj.ToBytes()
+	receivedData, reader, err := ReadArchive(bytes.NewReader(encodeArchive(t, &obj, content)))
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 
-	receivedData, err := LoadArchive(receivedBin)
+	if !obj.Equals(*receivedData) {
+		t.Fatalf("decoded object (%v) does not match encoded object (%v)", receivedData, obj)
+	}
+
+	receivedContent, err := io.ReadAll(reader)
 	if err != nil {
-		t.Fatalf("%v", err)
+		t.Fatal(err)
 	}
+	if !bytes.Equal(receivedContent, content) {
+		t.Fatalf("expected content %q, received %q", content, receivedContent)
+	}
+}
 
-	if obj.Equals(*receivedData) {
-		t.Fatalf("decoded object (%v) does not match encoded object (%v)", receivedData, obj)
+func TestDecodeTruncated(t *testing.T) {
+	obj := Archive{Suite: SuiteStreamAESGCM, Expiry: tomorrow}
+	bin := encodeArchive(t, &obj, []byte("not much how about you"))
+
+	// dropping the end section has to be noticed even though all content is there
+	_, reader, err := ReadArchive(bytes.NewReader(bin[:len(bin)-5]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected %v, received %v", io.ErrUnexpectedEOF, err)
+	}
+
+	if _, _, err := ReadArchive(bytes.NewReader(bin[:len(Magic)+4])); err == nil {
+		t.Fatal("expected truncated header to fail")
+	}
+
+	unknownVersion := append([]byte{}, bin...)
+	unknownVersion[len(Magic)] = FormatVersion + 1
+	if _, _, err := ReadArchive(bytes.NewReader(unknownVersion)); err == nil {
+		t.Fatal("expected unknown format version to fail")
+	}
+}
+
+func TestReadLegacyArchive(t *testing.T) {
+	content := []byte("streamed after the header")
+
+	var streamed bytes.Buffer
+	if err := gob.NewEncoder(&streamed).Encode(&gobArchive{Name: "fakeFile_here.txt", Expiry: tomorrow, Stream: true}); err != nil {
+		t.Fatal(err)
+	}
+	streamed.Write(content)
+
+	var embedded bytes.Buffer
+	if err := gob.NewEncoder(&embedded).Encode(&gobArchive{Name: "fakeFile_here.txt", Expiry: tomorrow, Content: content}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		bin   []byte
+		suite CipherSuite
+	}{
+		"streamed": {streamed.Bytes(), SuiteStreamAESGCM},
+		"embedded": {embedded.Bytes(), SuiteLegacyBlob},
+	}
+	for name, c := range cases {
+		received, reader, err := ReadArchive(bytes.NewReader(c.bin))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if received.Name != "fakeFile_here.txt" || !received.Expiry.Equal(tomorrow) || received.Suite != c.suite {
+			t.Fatalf("%s: unexpected decoded header %+v", name, received)
+		}
+		receivedContent, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(receivedContent, content) {
+			t.Fatalf("%s: expected content %q, received %q", name, content, receivedContent)
+		}
+	}
+}
+
+func TestPeekArchive(t *testing.T) {
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(&gobArchive{Expiry: tomorrow, Stream: true}); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Write([]byte("streamed after the header"))
+
+	obj := Archive{Suite: SuiteStreamAESGCM, Expiry: tomorrow}
+	for name, original := range map[string][]byte{
+		"binary": encodeArchive(t, &obj, []byte("streamed after the header")),
+		"legacy": legacy.Bytes(),
+	} {
+		received, replay, err := PeekArchive(bytes.NewReader(original))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !received.Expiry.Equal(tomorrow) {
+			t.Fatalf("%s: expected expiry %v, received %v", name, tomorrow, received.Expiry)
+		}
+		replayed, err := io.ReadAll(replay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(replayed, original) {
+			t.Fatalf("%s: replayed archive does not match original", name)
+		}
+	}
+
+	if _, _, err := PeekUpload(bytes.NewReader(legacy.Bytes())); !errors.As(err, new(*UnsupportedArchiveError)) {
+		t.Fatalf("expected legacy uploads to be refused, received %v", err)
+	}
+	received, replay, err := PeekUpload(bytes.NewReader(encodeArchive(t, &obj, []byte("streamed after the header"))))
+	if err != nil || !received.Expiry.Equal(tomorrow) {
+		t.Fatalf("expected upload to be accepted, received %v (%v)", received, err)
+	}
+	if replayed, err := io.ReadAll(replay); err != nil || !bytes.HasPrefix(replayed, Magic) {
+		t.Fatalf("expected upload to be replayed from its start (%v)", err)
+	}
+}
+
+func TestDecodeOversizedHeader(t *testing.T) {
+	obj := Archive{Suite: SuiteStreamAESGCM, Expiry: tomorrow}
+	bin := encodeArchive(t, &obj, []byte("not much how about you"))
+	header := len(Magic) + 2 + 5 + 8
+
+	// sections of unknown type are skipped, but still count towards the header
+	var oversized bytes.Buffer
+	oversized.Write(bin[:header])
+	for i := 0; i < 3; i++ {
+		writeSection(&oversized, 0x7f, make([]byte, maxSectionLength))
+	}
+	oversized.Write(bin[header:])
+
+	if _, _, err := ReadArchive(bytes.NewReader(oversized.Bytes())); err == nil {
+		t.Fatal("expected oversized header to fail")
+	}
+	if _, _, err := PeekArchive(bytes.NewReader(oversized.Bytes())); err == nil {
+		t.Fatal("expected oversized header to fail")
+	}
+
+	// just below the limit is fine
+	var large bytes.Buffer
+	large.Write(bin[:header])
+	writeSection(&large, 0x7f, make([]byte, maxSectionLength))
+	large.Write(bin[header:])
+	if _, _, err := ReadArchive(bytes.NewReader(large.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	wraps := make([]crypto.KeyWrap, 3)
+	for i := range wraps {
+		wraps[i] = crypto.KeyWrap{Kind: crypto.RecipientKeyWrap, Sealed: make([]byte, maxSectionLength-1024)}
+	}
+	if _, err := NewWriter(io.Discard, &Archive{Suite: SuiteStreamAESGCM, Expiry: tomorrow, KeyWraps: wraps}); err == nil {
+		t.Fatal("expected writing an oversized header to fail")
 	}
 }
@@ -0,0 +1,426 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+// The binary archive format is documented in docs/archive-format.md, any
+// change here has to be reflected there.
+const (
+	FormatVersion = 0x01
+
+	sectionEnd          = 0x00
+	sectionExpiry       = 0x01
+	sectionKeyWrap      = 0x02
+	sectionEnvelope     = 0x03
+	sectionMaxDownloads = 0x04
+	sectionPayload      = 0x10
+
+	sectionSignature = 0x20
+
+	keyWrapKind      = 0x01
+	keyWrapSalt      = 0x02
+	keyWrapTime      = 0x03
+	keyWrapMemory    = 0x04
+	keyWrapThreads   = 0x05
+	keyWrapNonce     = 0x06
+	keyWrapSealed    = 0x07
+	keyWrapEphemeral = 0x08
+
+	// sections other than payload are held in memory while decoding
+	maxSectionLength = 1024 * 1024
+	// the header, from the magic up to the first payload section, is held in
+	// memory as well to verify signatures
+	maxHeaderLength = 2 * 1024 * 1024
+)
+
+var Magic = []byte("SOUBISE\x00")
+
+func hasMagic(source peekReader) bool {
+	prefix, err := source.Peek(len(Magic))
+	return err == nil && bytes.Equal(prefix, Magic)
+}
+
+// Writer encodes an archive, everything written to it is stored as its
+// (already encrypted) content. Close must be called to terminate the archive.
+type Writer struct {
+	dest   io.Writer
+	closed bool
+
+	signer        *crypto.SigningKey
+	headerDigest  []byte
+	payloadDigest hash.Hash
+}
+
+func NewWriter(dest io.Writer, a *Archive) (*Writer, error) {
+	if a.Suite == SuiteLegacyBlob {
+		return nil, &UnsupportedArchiveError{reason: "legacy cipher suite can not be encoded"}
+	}
+
+	var header bytes.Buffer
+	header.Write(Magic)
+	header.WriteByte(FormatVersion)
+	header.WriteByte(byte(a.Suite))
+
+	expiry := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiry, uint64(a.Expiry.Unix()))
+	writeSection(&header, sectionExpiry, expiry)
+
+	for _, wrap := range a.KeyWraps {
+		writeSection(&header, sectionKeyWrap, encodeKeyWrap(&wrap))
+	}
+	if a.Envelope != nil {
+		writeSection(&header, sectionEnvelope, a.Envelope)
+	}
+	if a.MaxDownloads != 0 {
+		maxDownloads := make([]byte, 4)
+		binary.BigEndian.PutUint32(maxDownloads, a.MaxDownloads)
+		writeSection(&header, sectionMaxDownloads, maxDownloads)
+	}
+
+	if header.Len() > maxHeaderLength {
+		return nil, fmt.Errorf("archive header exceeds maximum length (%d bytes)", maxHeaderLength)
+	}
+	if _, err := dest.Write(header.Bytes()); err != nil {
+		return nil, fmt.Errorf("writing archive header: %w", err)
+	}
+	headerDigest := sha256.Sum256(header.Bytes())
+	return &Writer{dest: dest, headerDigest: headerDigest[:], payloadDigest: sha256.New()}, nil
+}
+
+// SignWith makes Close append a signature of the archive made with signer.
+func (w *Writer) SignWith(signer *crypto.SigningKey) {
+	w.signer = signer
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("archive is already closed")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	var sectionHeader [5]byte
+	sectionHeader[0] = sectionPayload
+	binary.BigEndian.PutUint32(sectionHeader[1:], uint32(len(p)))
+	if _, err := w.dest.Write(sectionHeader[:]); err != nil {
+		return 0, err
+	}
+	w.payloadDigest.Write(p)
+	return w.dest.Write(p)
+}
+
+func (w *Writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("archive is already closed")
+	}
+	w.closed = true
+
+	var trailer bytes.Buffer
+	if w.signer != nil {
+		signature := w.signer.Sign(signedMessage(w.headerDigest, w.payloadDigest.Sum(nil)))
+		writeSection(&trailer, sectionSignature, encodeSignature(w.signer.VerifyingKey(), signature))
+	}
+	writeSection(&trailer, sectionEnd, nil)
+	_, err := w.dest.Write(trailer.Bytes())
+	return err
+}
+
+func writeSection(buf *bytes.Buffer, kind byte, body []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)))
+	buf.WriteByte(kind)
+	buf.Write(length[:])
+	buf.Write(body)
+}
+
+// decodeHeader consumes everything up to the first payload section.
+func decodeHeader(source peekReader) (*Archive, error) {
+	preamble := make([]byte, len(Magic)+2)
+	if _, err := io.ReadFull(source, preamble); err != nil {
+		return nil, fmt.Errorf("reading archive header: %w", err)
+	}
+	if version := preamble[len(Magic)]; version != FormatVersion {
+		return nil, &UnsupportedArchiveError{reason: fmt.Sprintf("format version %d", version)}
+	}
+	a := &Archive{Suite: CipherSuite(preamble[len(Magic)+1])}
+	if a.Suite != SuiteStreamAESGCM {
+		return nil, &UnsupportedArchiveError{reason: fmt.Sprintf("cipher suite %d", a.Suite)}
+	}
+
+	hasExpiry := false
+	headerLength := int64(len(preamble))
+	for {
+		next, err := source.Peek(1)
+		if err != nil {
+			return nil, fmt.Errorf("reading archive header: %w", unexpectedEOF(err))
+		}
+		if next[0] == sectionPayload || next[0] == sectionEnd {
+			break
+		}
+		// checked before reading the section, so that a stream of sections
+		// can not exhaust memory
+		sectionHeader, err := source.Peek(5)
+		if err != nil {
+			return nil, fmt.Errorf("reading section: %w", unexpectedEOF(err))
+		}
+		headerLength += 5 + int64(binary.BigEndian.Uint32(sectionHeader[1:]))
+		if headerLength > maxHeaderLength {
+			return nil, fmt.Errorf("archive header exceeds maximum length (%d bytes)", maxHeaderLength)
+		}
+
+		kind, body, err := readSection(source)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case sectionExpiry:
+			if len(body) != 8 {
+				return nil, fmt.Errorf("malformed expiry section")
+			}
+			a.Expiry = time.Unix(int64(binary.BigEndian.Uint64(body)), 0)
+			hasExpiry = true
+		case sectionKeyWrap:
+			wrap, err := decodeKeyWrap(body)
+			if err != nil {
+				return nil, err
+			}
+			a.KeyWraps = append(a.KeyWraps, *wrap)
+		case sectionEnvelope:
+			a.Envelope = body
+		case sectionMaxDownloads:
+			if len(body) != 4 {
+				return nil, fmt.Errorf("malformed download limit section")
+			}
+			a.MaxDownloads = binary.BigEndian.Uint32(body)
+		default:
+			// unknown sections are skipped for forward compatibility
+		}
+	}
+
+	if !hasExpiry {
+		return nil, fmt.Errorf("archive header does not contain expiry")
+	}
+	return a, nil
+}
+
+func readSection(source io.Reader) (byte, []byte, error) {
+	kind, length, err := readSectionHeader(source)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxSectionLength {
+		return 0, nil, fmt.Errorf("section 0x%02x exceeds maximum length (%d bytes)", kind, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(source, body); err != nil {
+		return 0, nil, fmt.Errorf("reading section 0x%02x: %w", kind, unexpectedEOF(err))
+	}
+	return kind, body, nil
+}
+
+func readSectionHeader(source io.Reader) (byte, uint32, error) {
+	var sectionHeader [5]byte
+	if _, err := io.ReadFull(source, sectionHeader[:]); err != nil {
+		return 0, 0, fmt.Errorf("reading section: %w", unexpectedEOF(err))
+	}
+	return sectionHeader[0], binary.BigEndian.Uint32(sectionHeader[1:]), nil
+}
+
+// an archive always ends with sectionEnd, running out of data before that
+// means it was truncated
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// payloadReader concatenates the content of payload sections, then consumes
+// the remaining sections of the archive. A signature found among them is
+// verified once the end of the archive is reached.
+type payloadReader struct {
+	source    peekReader
+	archive   *Archive
+	remaining uint32
+	done      bool
+	err       error
+
+	headerDigest  []byte
+	payloadDigest hash.Hash
+	signer        *crypto.VerifyingKey
+	signature     []byte
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	for p.remaining == 0 && p.err == nil {
+		if p.done {
+			return 0, io.EOF
+		}
+		p.err = p.nextSection()
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	if uint32(len(b)) > p.remaining {
+		b = b[:p.remaining]
+	}
+	n, err := p.source.Read(b)
+	p.payloadDigest.Write(b[:n])
+	p.remaining -= uint32(n)
+	if err != nil {
+		p.err = unexpectedEOF(err)
+	}
+	return n, nil
+}
+
+func (p *payloadReader) nextSection() error {
+	kind, length, err := readSectionHeader(p.source)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case sectionPayload:
+		p.remaining = length
+		return nil
+	case sectionEnd:
+		p.done = true
+		return p.verify()
+	}
+
+	if length > maxSectionLength {
+		return fmt.Errorf("section 0x%02x exceeds maximum length (%d bytes)", kind, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(p.source, body); err != nil {
+		return fmt.Errorf("reading section 0x%02x: %w", kind, unexpectedEOF(err))
+	}
+	switch kind {
+	case sectionSignature:
+		if p.signer != nil {
+			return fmt.Errorf("archive carries more than one signature")
+		}
+		p.signer, p.signature, err = decodeSignature(body)
+		if err != nil {
+			return err
+		}
+	default:
+		// unknown sections are skipped for forward compatibility
+	}
+	return nil
+}
+
+func (p *payloadReader) verify() error {
+	if p.signer == nil {
+		return nil
+	}
+	if !p.signer.Verify(signedMessage(p.headerDigest, p.payloadDigest.Sum(nil)), p.signature) {
+		return ErrInvalidSignature
+	}
+	p.archive.Signer = p.signer
+	return nil
+}
+
+func encodeKeyWrap(wrap *crypto.KeyWrap) []byte {
+	var buf bytes.Buffer
+	writeField := func(tag byte, value []byte) {
+		if value == nil {
+			return
+		}
+		var length [2]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(value)))
+		buf.WriteByte(tag)
+		buf.Write(length[:])
+		buf.Write(value)
+	}
+	writeUint32 := func(tag byte, value uint32) {
+		if value == 0 {
+			return
+		}
+		encoded := make([]byte, 4)
+		binary.BigEndian.PutUint32(encoded, value)
+		writeField(tag, encoded)
+	}
+
+	writeField(keyWrapKind, []byte(wrap.Kind))
+	writeField(keyWrapSalt, wrap.Salt)
+	writeUint32(keyWrapTime, wrap.Time)
+	writeUint32(keyWrapMemory, wrap.Memory)
+	if wrap.Threads != 0 {
+		writeField(keyWrapThreads, []byte{wrap.Threads})
+	}
+	writeField(keyWrapNonce, wrap.Nonce)
+	writeField(keyWrapSealed, wrap.Sealed)
+	writeField(keyWrapEphemeral, wrap.EphemeralKey)
+	return buf.Bytes()
+}
+
+func decodeKeyWrap(body []byte) (*crypto.KeyWrap, error) {
+	wrap := &crypto.KeyWrap{}
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, fmt.Errorf("malformed key wrap section")
+		}
+		tag := body[0]
+		length := int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+length {
+			return nil, fmt.Errorf("malformed key wrap section")
+		}
+		value := body[3 : 3+length]
+		body = body[3+length:]
+
+		switch tag {
+		case keyWrapKind:
+			wrap.Kind = string(value)
+		case keyWrapSalt:
+			wrap.Salt = value
+		case keyWrapTime, keyWrapMemory:
+			if length != 4 {
+				return nil, fmt.Errorf("malformed key wrap field 0x%02x", tag)
+			}
+			if tag == keyWrapTime {
+				wrap.Time = binary.BigEndian.Uint32(value)
+			} else {
+				wrap.Memory = binary.BigEndian.Uint32(value)
+			}
+		case keyWrapThreads:
+			if length != 1 {
+				return nil, fmt.Errorf("malformed key wrap field 0x%02x", tag)
+			}
+			wrap.Threads = value[0]
+		case keyWrapNonce:
+			wrap.Nonce = value
+		case keyWrapSealed:
+			wrap.Sealed = value
+		case keyWrapEphemeral:
+			wrap.EphemeralKey = value
+		}
+	}
+	return wrap, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+// gobArchive is the gob encoded archive which preceded the binary format, gob
+// matches fields by name so it decodes every revision of it.
+type gobArchive struct {
+	Name    string
+	Content []byte
+	Expiry  time.Time
+	// Stream indicates that the encrypted content is not embedded in Content,
+	// but follows the encoded archive as a segmented ciphertext stream
+	Stream   bool
+	KeyWraps []crypto.KeyWrap
+	Envelope []byte
+}
+
+// readGobArchive decodes a legacy archive, source must be an io.ByteReader so
+// gob does not read beyond the encoded value.
+func readGobArchive(source peekReader) (*Archive, io.Reader, error) {
+	var data gobArchive
+	if err := gob.NewDecoder(source).Decode(&data); err != nil {
+		return nil, nil, fmt.Errorf("decoding archive to data: %w", err)
+	}
+
+	a := &Archive{
+		Suite:    SuiteLegacyBlob,
+		Expiry:   data.Expiry,
+		KeyWraps: data.KeyWraps,
+		Envelope: data.Envelope,
+		Name:     data.Name,
+	}
+	if !data.Stream {
+		return a, bytes.NewReader(data.Content), nil
+	}
+	a.Suite = SuiteStreamAESGCM
+	return a, source, nil
+}
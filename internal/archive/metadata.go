@@ -0,0 +1,71 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+// Metadata describes the shared file, it is only ever stored encrypted inside
+// the archive Envelope so the server never learns anything but the expiry.
+type Metadata struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	SHA256      []byte `json:"sha256,omitempty"`
+	Message     string `json:"message,omitempty"`
+	// Compression is applied to the content before encryption, Size and
+	// SHA256 describe the content before compression
+	Compression string `json:"compression,omitempty"`
+	// Bundle indicates the content is a tar stream of several files, which
+	// is to be unpacked rather than written as is
+	Bundle bool `json:"bundle,omitempty"`
+}
+
+func (a *Archive) SealMetadata(m *Metadata, key *crypto.Base64Data) error {
+	plain, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding metadata: %w", err)
+	}
+	sealed, err := crypto.SealEnvelope(plain, key)
+	if err != nil {
+		return fmt.Errorf("encrypting metadata: %w", err)
+	}
+	a.Envelope = sealed
+	return nil
+}
+
+// OpenMetadata decrypts the archive Envelope. Archives created before the
+// Envelope existed only know their plaintext Name.
+func (a *Archive) OpenMetadata(key *crypto.Base64Data) (*Metadata, error) {
+	if a.Envelope == nil {
+		return &Metadata{Name: a.Name}, nil
+	}
+
+	plain, err := crypto.OpenEnvelope(a.Envelope, key)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting metadata: %w", err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	return &m, nil
+}
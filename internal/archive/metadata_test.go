@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+func TestMetadataEnvelope(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &Metadata{
+		Name:        "fakeFile_here.txt",
+		Size:        22,
+		ContentType: "text/plain; charset=utf-8",
+		SHA256:      bytes.Repeat([]byte{0x01}, 32),
+		Message:     "not much how about you",
+	}
+
+	obj := Archive{Expiry: tomorrow}
+	if err := obj.SealMetadata(metadata, key); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(obj.Envelope, []byte(metadata.Name)) {
+		t.Fatal("envelope contains plaintext file name")
+	}
+
+	opened, err := obj.OpenMetadata(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.Name != metadata.Name || opened.Size != metadata.Size || opened.ContentType != metadata.ContentType ||
+		!bytes.Equal(opened.SHA256, metadata.SHA256) || opened.Message != metadata.Message {
+		t.Fatalf("expected %+v, received %+v", metadata, opened)
+	}
+
+	otherKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := obj.OpenMetadata(otherKey); err == nil {
+		t.Fatal("expected envelope to be unreadable with another key")
+	}
+}
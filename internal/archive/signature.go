@@ -0,0 +1,56 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+const signatureContext = "soubise signature v1\x00"
+
+var ErrInvalidSignature = errors.New("archive signature is invalid")
+
+// signedMessage binds a signature to the exact header bytes and the encrypted
+// content, the latter through its digest so that it can be streamed.
+func signedMessage(headerDigest []byte, payloadDigest []byte) []byte {
+	message := make([]byte, 0, len(signatureContext)+2*sha256.Size)
+	message = append(message, signatureContext...)
+	message = append(message, headerDigest...)
+	return append(message, payloadDigest...)
+}
+
+func encodeSignature(signer *crypto.VerifyingKey, signature []byte) []byte {
+	body := make([]byte, 0, len(signer.Bytes())+len(signature))
+	body = append(body, signer.Bytes()...)
+	return append(body, signature...)
+}
+
+func decodeSignature(body []byte) (*crypto.VerifyingKey, []byte, error) {
+	if len(body) <= crypto.SignatureSize {
+		return nil, nil, fmt.Errorf("malformed signature section")
+	}
+	split := len(body) - crypto.SignatureSize
+	signer, err := crypto.VerifyingKeyFromBytes(body[:split])
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, body[split:], nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+func encodeSignedArchive(t *testing.T, a *Archive, content []byte, signer *crypto.SigningKey) []byte {
+	t.Helper()
+	var bin bytes.Buffer
+	w, err := NewWriter(&bin, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SignWith(signer)
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bin.Bytes()
+}
+
+func TestSignedArchive(t *testing.T) {
+	signer, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("signed, sealed, delivered")
+	encoded := encodeSignedArchive(t, &Archive{
+		Suite:    SuiteStreamAESGCM,
+		Expiry:   tomorrow,
+		Envelope: []byte("envelope"),
+	}, content, signer)
+
+	a, reader, err := ReadArchive(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Signer != nil {
+		t.Fatal("expected signer to be unknown before content is read")
+	}
+	received, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("expected content %q, received %q", content, received)
+	}
+	if !signer.VerifyingKey().Equal(a.Signer) {
+		t.Fatalf("expected signer %v, received %v", signer.VerifyingKey(), a.Signer)
+	}
+
+	unsigned := encodeArchive(t, &Archive{Suite: SuiteStreamAESGCM, Expiry: tomorrow}, content)
+	a, reader, err = ReadArchive(bytes.NewReader(unsigned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+	if a.Signer != nil {
+		t.Fatalf("expected unsigned archive to have no signer, received %v", a.Signer)
+	}
+}
+
+func TestSignedArchiveTampered(t *testing.T) {
+	signer, err := crypto.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("signed, sealed, delivered")
+	encoded := encodeSignedArchive(t, &Archive{
+		Suite:    SuiteStreamAESGCM,
+		Expiry:   tomorrow,
+		Envelope: []byte("envelope"),
+	}, content, signer)
+
+	for name, offset := range map[string]int{
+		"header":  bytes.Index(encoded, []byte("envelope")),
+		"payload": bytes.Index(encoded, content),
+	} {
+		tampered := append([]byte{}, encoded...)
+		tampered[offset] ^= 0x01
+
+		a, reader, err := ReadArchive(bytes.NewReader(tampered))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := io.ReadAll(reader); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("%s: expected ErrInvalidSignature, received %v", name, err)
+		}
+		if a.Signer != nil {
+			t.Fatalf("%s: expected no signer for tampered archive", name)
+		}
+	}
+}
@@ -16,10 +16,48 @@ limitations under the License.
 
 package broker
 
+import (
+	"context"
+	"sync"
+)
+
 type Broker interface {
 	Lock()
 	Unlock()
 	RLock()
 	RUnlock()
+	// Mutex returns the lock called name, which is independent of the broker
+	// lock itself and of locks with other names
+	Mutex(name string) sync.Locker
 	Kind() string
 }
+
+// ContextLocker is a lock which can fail to be acquired, or be lost while held,
+// such as one coordinating replicas through a network service.
+type ContextLocker interface {
+	sync.Locker
+	// LockContext acquires the lock unless ctx is done first. The returned
+	// context is cancelled once the lock is lost or released.
+	LockContext(ctx context.Context) (context.Context, error)
+}
+
+// LockContext acquires l unless ctx is done first, returning a context which
+// is cancelled once l is lost. Locks which cannot fail are simply locked.
+func LockContext(ctx context.Context, l sync.Locker) (context.Context, error) {
+	if cl, ok := l.(ContextLocker); ok {
+		return cl.LockContext(ctx)
+	}
+	l.Lock()
+	return context.Background(), nil
+}
+
+// RLockContext acquires the read lock of b like LockContext does.
+func RLockContext(ctx context.Context, b Broker) (context.Context, error) {
+	if cl, ok := b.(interface {
+		RLockContext(ctx context.Context) (context.Context, error)
+	}); ok {
+		return cl.RLockContext(ctx)
+	}
+	b.RLock()
+	return context.Background(), nil
+}
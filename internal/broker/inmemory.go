@@ -22,6 +22,21 @@ import (
 
 type InMemoryBroker struct {
 	sync.RWMutex
+
+	mutexesLock sync.Mutex
+	mutexes     map[string]*sync.Mutex
+}
+
+func (i *InMemoryBroker) Mutex(name string) sync.Locker {
+	i.mutexesLock.Lock()
+	defer i.mutexesLock.Unlock()
+	if i.mutexes == nil {
+		i.mutexes = map[string]*sync.Mutex{}
+	}
+	if _, ok := i.mutexes[name]; !ok {
+		i.mutexes[name] = &sync.Mutex{}
+	}
+	return i.mutexes[name]
 }
 
 func (i *InMemoryBroker) Kind() string {
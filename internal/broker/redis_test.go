@@ -0,0 +1,176 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newReplicas returns brokers which share one Redis, as replicas would.
+func newReplicas(t *testing.T, n int, lease time.Duration) (*miniredis.Miniredis, []*RedisBroker) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	var brokers []*RedisBroker
+	for i := 0; i < n; i++ {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		brokers = append(brokers, newRedisBroker(client, lease))
+	}
+	return server, brokers
+}
+
+func TestRedisBrokerExcludesReplicas(t *testing.T) {
+	_, replicas := newReplicas(t, 2, time.Second)
+
+	counter := 0
+	var wg sync.WaitGroup
+	for _, b := range replicas {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(b *RedisBroker) {
+				defer wg.Done()
+				b.Lock()
+				current := counter
+				time.Sleep(time.Millisecond)
+				counter = current + 1
+				b.Unlock()
+			}(b)
+		}
+	}
+	wg.Wait()
+	if counter != 20 {
+		t.Fatalf("expected 20 exclusive increments, received %d", counter)
+	}
+}
+
+func TestRedisBrokerReaders(t *testing.T) {
+	_, replicas := newReplicas(t, 2, time.Second)
+
+	replicas[0].RLock()
+	replicas[1].RLock()
+	replicas[1].RLock()
+
+	locked := make(chan struct{})
+	go func() {
+		replicas[0].Lock()
+		close(locked)
+		replicas[0].Unlock()
+	}()
+	replicas[0].RUnlock()
+	replicas[1].RUnlock()
+	select {
+	case <-locked:
+		t.Fatal("expected writer to wait for remaining reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+	replicas[1].RUnlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected writer to acquire lock once readers are gone")
+	}
+}
+
+func TestRedisBrokerLeaseExpires(t *testing.T) {
+	server, replicas := newReplicas(t, 1, time.Second)
+	// a replica which crashed while holding the lock
+	if err := server.Set(redisKeyPrefix+"metadata", "crashed"); err != nil {
+		t.Fatal(err)
+	}
+	server.SetTTL(redisKeyPrefix+"metadata", time.Second)
+
+	locked := make(chan struct{})
+	go func() {
+		mutex := replicas[0].Mutex("metadata")
+		mutex.Lock()
+		close(locked)
+		mutex.Unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected lock to be held until the lease ends")
+	case <-time.After(100 * time.Millisecond):
+	}
+	server.FastForward(time.Second)
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("expected lock to be acquired once the lease ended")
+	}
+}
+
+func TestRedisBrokerRenewsLease(t *testing.T) {
+	server, replicas := newReplicas(t, 2, 300*time.Millisecond)
+	replicas[0].Lock()
+	defer replicas[0].Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	server.FastForward(200 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	server.FastForward(200 * time.Millisecond)
+	if !server.Exists(redisKeyPrefix + "storage") {
+		t.Fatal("expected lease to be renewed while the lock is held")
+	}
+}
+
+func TestRedisBrokerGivesUpAcquiring(t *testing.T) {
+	server, replicas := newReplicas(t, 2, time.Second)
+	replicas[0].Lock()
+	defer replicas[0].Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := replicas[1].LockContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected held lock to time out, received %v", err)
+	}
+
+	// Redis going away must not block callers forever either
+	server.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := replicas[1].Mutex("metadata").(ContextLocker).LockContext(ctx); err == nil {
+		t.Fatal("expected acquiring a lock without Redis to fail")
+	}
+}
+
+func TestRedisBrokerCancelsLostLease(t *testing.T) {
+	server, replicas := newReplicas(t, 1, 300*time.Millisecond)
+	held, err := replicas[0].LockContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicas[0].Unlock()
+
+	// another replica took over after the lease ended, e.g. while this one
+	// was paused
+	server.Set(redisKeyPrefix+"storage", "taken")
+	select {
+	case <-held.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected context to be cancelled once the lease was lost")
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const ContentType = "application/x-tar"
+
+// Pack writes paths into a tar stream, every path becomes a top level entry
+// named after its base name. Directories are included recursively, symlinks
+// are stored as such and never followed.
+func Pack(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	seen := map[string]bool{}
+
+	for _, p := range paths {
+		root := filepath.Dir(filepath.Clean(p))
+		base := filepath.Base(filepath.Clean(p))
+		if seen[base] {
+			return fmt.Errorf("%v would be bundled more than once as %v", p, base)
+		}
+		seen[base] = true
+
+		err := filepath.Walk(p, func(current string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, current)
+			if err != nil {
+				return err
+			}
+			return addEntry(tw, current, filepath.ToSlash(rel), info)
+		})
+		if err != nil {
+			return fmt.Errorf("bundling %v: %w", p, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func addEntry(tw *tar.Writer, current string, name string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(current)
+		if err != nil {
+			return err
+		}
+		link = target
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		return fmt.Errorf("%v is neither a file, directory nor symlink", current)
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	// ownership is meaningless to the recipient and only leaks information
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	// bundles are produced twice while sharing, reading a file must not
+	// change its entry
+	header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+	header.Format = tar.FormatPAX
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(current)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(tw, f, header.Size); err != nil {
+		return fmt.Errorf("%v changed while bundling: %w", current, err)
+	}
+	return nil
+}
+
+// Unpack extracts the tar stream into dest. Entries which would end up outside
+// of dest, either through their name or through a symlink, are refused.
+func Unpack(r io.Reader, dest string) error {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	type dirAttributes struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+	dirs := []dirAttributes{}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		target, err := entryPath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := ensureNoSymlink(dest, filepath.Dir(target)); err != nil {
+			return err
+		}
+		if finfo, err := os.Lstat(target); err == nil && finfo.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to overwrite symlink %v", header.Name)
+		}
+
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttributes{path: target, mode: mode, modTime: header.ModTime})
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeFile(target, tr, mode); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := checkLink(dest, target, header.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry %v of type %q", header.Name, header.Typeflag)
+		}
+	}
+
+	// directories are finalized last, as writing their content changes them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func entryPath(dest string, name string) (string, error) {
+	cleaned := path.Clean(name)
+	if name == "" || path.IsAbs(name) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("refusing entry outside of destination: %q", name)
+	}
+	return filepath.Join(dest, filepath.FromSlash(cleaned)), nil
+}
+
+// ensureNoSymlink refuses to write beneath a symlink, which an earlier entry
+// could have pointed anywhere.
+func ensureNoSymlink(dest string, dir string) error {
+	rel, err := filepath.Rel(dest, dir)
+	if err != nil {
+		return err
+	}
+	current := dest
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		finfo, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if finfo.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %v", current)
+		}
+	}
+	return nil
+}
+
+// checkLink refuses symlinks which could resolve outside of dest. Parent
+// directories of target never are symlinks, so leading ".." components are
+// resolved as written. Any ".." after another component could instead climb
+// out of a symlink created by an earlier entry, e.g. "link/.." where link
+// points to ".", and is refused.
+func checkLink(dest string, target string, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("refusing absolute symlink %v -> %v", target, link)
+	}
+	resolved := filepath.Dir(target)
+	descending := false
+	for _, part := range strings.Split(filepath.ToSlash(link), "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if descending {
+				return fmt.Errorf("refusing symlink climbing out of another path %v -> %v", target, link)
+			}
+			resolved = filepath.Dir(resolved)
+		default:
+			descending = true
+			resolved = filepath.Join(resolved, part)
+		}
+	}
+	rel, err := filepath.Rel(dest, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refusing symlink outside of destination %v -> %v", target, link)
+	}
+	return nil
+}
+
+func writeFile(target string, content io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// existing files keep their mode through OpenFile
+	return os.Chmod(target, mode)
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2021, 3, 24, 12, 0, 0, 0, time.UTC)
+
+	mustWrite(t, filepath.Join(src, "logs", "app.log"), "quick brown fox", 0600)
+	mustWrite(t, filepath.Join(src, "logs", "nested", "run.sh"), "#!/bin/sh", 0755)
+	mustWrite(t, filepath.Join(src, "other.txt"), "lazy dog", 0644)
+	if err := os.Symlink("app.log", filepath.Join(src, "logs", "latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "logs", "app.log"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var packed bytes.Buffer
+	if err := Pack(&packed, []string{filepath.Join(src, "logs") + "/", filepath.Join(src, "other.txt")}); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	if err := Unpack(&packed, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{
+		"logs/app.log":       "quick brown fox",
+		"logs/nested/run.sh": "#!/bin/sh",
+		"logs/latest":        "quick brown fox",
+		"other.txt":          "lazy dog",
+	} {
+		content, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Fatalf("%s: expected %q, received %q", name, expected, content)
+		}
+	}
+
+	finfo, err := os.Stat(filepath.Join(dest, "logs", "nested", "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finfo.Mode().Perm() != 0755 {
+		t.Fatalf("expected mode 0755, received %v", finfo.Mode().Perm())
+	}
+	finfo, err = os.Stat(filepath.Join(dest, "logs", "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !finfo.ModTime().Equal(mtime) || finfo.Mode().Perm() != 0600 {
+		t.Fatalf("expected mode 0600 and mtime %v, received %v and %v", mtime, finfo.Mode().Perm(), finfo.ModTime())
+	}
+	link, err := os.Readlink(filepath.Join(dest, "logs", "latest"))
+	if err != nil || link != "app.log" {
+		t.Fatalf("expected symlink to app.log, received %q (%v)", link, err)
+	}
+}
+
+func TestPackIsRepeatable(t *testing.T) {
+	src := t.TempDir()
+	mustWrite(t, filepath.Join(src, "data", "export.csv"), "a,b,c", 0644)
+
+	var first, second bytes.Buffer
+	if err := Pack(&first, []string{filepath.Join(src, "data")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.ReadFile(filepath.Join(src, "data", "export.csv")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pack(&second, []string{filepath.Join(src, "data")}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("expected packing the same files twice to produce identical bundles")
+	}
+}
+
+func TestUnpackRefusesTraversal(t *testing.T) {
+	cases := map[string][]tar.Header{
+		"parent":        {{Name: "../evil.txt", Typeflag: tar.TypeReg}},
+		"nested parent": {{Name: "ok/../../evil.txt", Typeflag: tar.TypeReg}},
+		"absolute":      {{Name: "/tmp/evil.txt", Typeflag: tar.TypeReg}},
+		"absolute link": {{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		"escaping link": {{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+		"through link": {
+			{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+			{Name: "link/evil.txt", Typeflag: tar.TypeReg},
+		},
+		"chained link": {
+			{Name: "s1", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "s2", Typeflag: tar.TypeSymlink, Linkname: "s1/.."},
+		},
+		"link resolved later": {
+			{Name: "s2", Typeflag: tar.TypeSymlink, Linkname: "s1/.."},
+			{Name: "s1", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+		"device": {{Name: "null", Typeflag: tar.TypeChar}},
+	}
+
+	for name, headers := range cases {
+		var packed bytes.Buffer
+		tw := tar.NewWriter(&packed)
+		for _, header := range headers {
+			header := header
+			if err := tw.WriteHeader(&header); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		parent := t.TempDir()
+		if err := Unpack(&packed, filepath.Join(parent, "dest")); err == nil {
+			t.Fatalf("%s: expected unpacking to be refused", name)
+		}
+		if _, err := os.Lstat(filepath.Join(parent, "evil.txt")); err == nil {
+			t.Fatalf("%s: file was written outside of destination", name)
+		}
+	}
+}
+
+func mustWrite(t *testing.T, name string, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
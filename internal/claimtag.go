@@ -23,6 +23,9 @@ import (
 	"strings"
 )
 
+// ClaimTag is everything needed to retrieve a shared file. EncryptionKey is left
+// empty when the key is wrapped inside the archive instead, e.g. with a
+// passphrase, so the ClaimTag alone is not enough to decrypt the content.
 type ClaimTag struct {
 	Server        string
 	Id            string
@@ -32,19 +35,16 @@ type ClaimTag struct {
 
 const Prefix = "soubise://"
 
-var matcher = regexp.MustCompile(`soubise://(?P<host>[\w-_=]+)/(?P<id>[\w-_=]+)/(?P<encryptionKey>[\w-_=]+)/?(?P<ownerKey>[\w-_=]+)?`)
+var matcher = regexp.MustCompile(`soubise://(?P<host>[\w-_=]+)/(?P<id>[\w-_=]+)(?:/(?P<encryptionKey>[\w-_=]*)(?:/(?P<ownerKey>[\w-_=]+))?)?`)
 
 func Parse(str string) (*ClaimTag, error) {
 	if !strings.HasPrefix(str, Prefix) {
 		return nil, &ClaimTagParseError{invalidClaimTag: str}
 	}
 
-	ownerKey := ""
 	match := matcher.FindStringSubmatch(str)
-	if len(match) < 4 {
+	if len(match) < 5 {
 		return nil, &ClaimTagParseError{invalidClaimTag: str}
-	} else if len(match) < 5 {
-		ownerKey = match[4]
 	}
 
 	decodedServer, err := base64.URLEncoding.DecodeString(match[1])
@@ -55,19 +55,21 @@ func Parse(str string) (*ClaimTag, error) {
 		Server:        string(decodedServer),
 		Id:            match[2],
 		EncryptionKey: match[3],
-		OwnerKey:      ownerKey,
+		OwnerKey:      match[4],
 	}, nil
 }
 
 func (r *ClaimTag) String() string {
 	suffix := ""
 	if r.OwnerKey != "" {
-		suffix = fmt.Sprintf("/%s", r.OwnerKey)
+		suffix = fmt.Sprintf("/%s/%s", r.EncryptionKey, r.OwnerKey)
+	} else if r.EncryptionKey != "" {
+		suffix = fmt.Sprintf("/%s", r.EncryptionKey)
 	}
 
 	encodedServer := base64.URLEncoding.EncodeToString([]byte(r.Server))
 
-	return fmt.Sprintf("%s%s/%s/%s%s", Prefix, encodedServer, r.Id, r.EncryptionKey, suffix)
+	return fmt.Sprintf("%s%s/%s%s", Prefix, encodedServer, r.Id, suffix)
 }
 
 type ClaimTagParseError struct {
@@ -0,0 +1,48 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestClaimTagRoundTrip(t *testing.T) {
+	tags := []ClaimTag{
+		{Server: "https://pub.soubise.org", Id: "GJMApCE3kR8vaGJ60cKcBx8J", EncryptionKey: "9mgfo_7bGGFUERhSI8psi0JQ"},
+		{Server: "https://pub.soubise.org", Id: "GJMApCE3kR8vaGJ60cKcBx8J"},
+		{Server: "http://localhost:8080", Id: "GJMApCE3kR8vaGJ60cKcBx8J", EncryptionKey: "9mgfo_7bGGFUERhSI8psi0JQ", OwnerKey: "b3duZXI="},
+		{Server: "http://localhost:8080", Id: "GJMApCE3kR8vaGJ60cKcBx8J", OwnerKey: "b3duZXI="},
+	}
+
+	for _, tag := range tags {
+		parsed, err := Parse(tag.String())
+		if err != nil {
+			t.Fatalf("%s: %v", tag.String(), err)
+		}
+		if *parsed != tag {
+			t.Fatalf("expected %+v, received %+v", tag, *parsed)
+		}
+	}
+}
+
+func TestClaimTagInvalid(t *testing.T) {
+	for _, str := range []string{"", "https://pub.soubise.org", "soubise://", "soubise://aGVsbG8="} {
+		if _, err := Parse(str); err == nil {
+			t.Fatalf("expected %q to be rejected", str)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/wilsonehusin/soubise/internal"
+	"github.com/wilsonehusin/soubise/internal/buildinfo"
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+// downloadAttempts is how often an interrupted download is resumed before
+// giving up, a later Get resumes it again
+const downloadAttempts = 5
+
+type downloadStatusError struct {
+	status string
+}
+
+func (d *downloadStatusError) Error() string {
+	return fmt.Sprintf("server did not process request successfully: %v", d.status)
+}
+
+// downloadState is kept next to a partial download, to resume it only if the
+// object is still the one partially downloaded and without being counted
+// again by the server. Once complete, it is kept until the download was
+// processed so that a rerun does not request the archive again.
+type downloadState struct {
+	ETag        string `json:"etag"`
+	ResumeToken string `json:"resumeToken,omitempty"`
+	Complete    bool   `json:"complete,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Remaining   string `json:"remaining,omitempty"`
+}
+
+func readDownloadState(statePath string) *downloadState {
+	state := &downloadState{}
+	if content, err := os.ReadFile(statePath); err == nil {
+		_ = json.Unmarshal(content, state)
+	}
+	return state
+}
+
+func writeDownloadState(statePath string, state *downloadState) error {
+	if state.ETag == "" && !state.Complete {
+		_ = os.Remove(statePath)
+		return nil
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, content, 0600)
+}
+
+// downloadToPart downloads the archive into partPath, resuming from whatever
+// an earlier attempt left there. It returns how often the archive can still
+// be downloaded, if the server limits it. The state kept next to partPath is
+// left for the caller to remove along with it.
+func downloadToPart(claimTag *internal.ClaimTag, partPath string) (string, error) {
+	spinner.Start(" download", "resolving path")
+	uriBuilder, err := url.Parse(claimTag.Server)
+	if err != nil {
+		spinner.StopFail("unable to parse server")
+		return "", fmt.Errorf("unable to parse %s as url: %w", claimTag.Server, err)
+	}
+	uriBuilder.Path = path.Join(uriBuilder.Path, routes.GetObjectWithId(claimTag.Id))
+
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		spinner.StopFail("unable to create file")
+		return "", err
+	}
+	defer part.Close()
+
+	statePath := partPath + ".resume"
+	if state := readDownloadState(statePath); state.Complete {
+		if size, err := part.Seek(0, io.SeekEnd); err == nil && size == state.Size {
+			spinner.Stop("already downloaded")
+			return state.Remaining, nil
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		remaining, err := downloadAttempt(uriBuilder.String(), part, statePath)
+		if err == nil {
+			size, err := part.Seek(0, io.SeekEnd)
+			if err != nil {
+				spinner.StopFail("unable to read file")
+				return "", err
+			}
+			state := readDownloadState(statePath)
+			state.Complete, state.Size, state.Remaining = true, size, remaining
+			if err := writeDownloadState(statePath, state); err != nil {
+				spinner.StopFail("unable to write file")
+				return "", err
+			}
+			spinner.Stop("done")
+			return remaining, nil
+		}
+		if errors.As(err, new(*downloadStatusError)) || attempt == downloadAttempts {
+			spinner.StopFail("failed to download")
+			return "", err
+		}
+		spinner.Update(fmt.Sprintf("interrupted, resuming (%v)", err))
+	}
+}
+
+func downloadAttempt(uri string, part *os.File, statePath string) (string, error) {
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to compose request to server: %w", err)
+	}
+	request.Header.Set("User-Agent", fmt.Sprintf("Soubise/%v", buildinfo.Version))
+	state := readDownloadState(statePath)
+	if offset > 0 && state.ETag != "" {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", state.ETag)
+		if state.ResumeToken != "" {
+			request.Header.Set(routes.ResumeTokenHeader, state.ResumeToken)
+		}
+		spinner.Update(fmt.Sprintf("resuming after %v", humanize.Bytes(uint64(offset))))
+	} else {
+		spinner.Update("connecting")
+	}
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("unable to download from server: %w", err)
+	}
+	defer response.Body.Close()
+	remaining := response.Header.Get(routes.RemainingDownloadsHeader)
+
+	total := response.ContentLength
+	switch response.StatusCode {
+	case http.StatusOK:
+		if err := part.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := part.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	case http.StatusPartialContent:
+		start, size, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			return "", &downloadStatusError{status: "unexpected range " + response.Header.Get("Content-Range")}
+		}
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// an earlier attempt already downloaded everything
+		_, size, ok := parseContentRange(response.Header.Get("Content-Range"))
+		if ok && size == offset {
+			return remaining, nil
+		}
+		if err := part.Truncate(0); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("partial download does not match, starting over")
+	default:
+		return "", &downloadStatusError{status: response.Status}
+	}
+
+	// a resumed download keeps the token issued when it was counted
+	if token := response.Header.Get(routes.ResumeTokenHeader); token != "" {
+		state.ResumeToken = token
+	}
+	state.ETag = response.Header.Get("ETag")
+	if err := writeDownloadState(statePath, state); err != nil {
+		return "", err
+	}
+
+	spinner.Update("downloading")
+	if _, err := io.Copy(part, response.Body); err != nil {
+		return "", fmt.Errorf("unable to download from server: %w", err)
+	}
+	if size, err := part.Seek(0, io.SeekCurrent); err != nil {
+		return "", err
+	} else if total >= 0 && size != total {
+		return "", fmt.Errorf("download ended after %d of %d bytes", size, total)
+	}
+	return remaining, nil
+}
+
+// parseContentRange understands "bytes <start>-<end>/<size>" as well as
+// "bytes */<size>", returning -1 as start for the latter.
+func parseContentRange(contentRange string) (int64, int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "/", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+	size, err := strconv.ParseInt(spec[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if spec[0] == "*" {
+		return -1, size, true
+	}
+	bounds := strings.SplitN(spec[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal"
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+func TestDownloadResumes(t *testing.T) {
+	spinner.Disable()
+	content := bytes.Repeat([]byte("quick brown fox "), 4096)
+	var ranges, tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		tokens = append(tokens, r.Header.Get(routes.ResumeTokenHeader))
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set(routes.ResumeTokenHeader, "token")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	claimTag := &internal.ClaimTag{Server: server.URL, Id: "object"}
+
+	for name, c := range map[string]struct {
+		part          []byte
+		etag          string
+		expectedRange string
+	}{
+		"fresh":        {expectedRange: ""},
+		"partial":      {part: content[:1000], etag: `"object"`, expectedRange: "bytes=1000-"},
+		"complete":     {part: content, etag: `"object"`, expectedRange: "bytes=65536-"},
+		"changed":      {part: []byte("stale content"), etag: `"previous"`, expectedRange: "bytes=13-"},
+		"without etag": {part: content[:1000], expectedRange: ""},
+	} {
+		ranges, tokens = nil, nil
+		partPath := filepath.Join(t.TempDir(), "object.part")
+		if c.part != nil {
+			if err := os.WriteFile(partPath, c.part, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.etag != "" {
+			if err := writeDownloadState(partPath+".resume", &downloadState{ETag: c.etag, ResumeToken: "token"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := downloadToPart(claimTag, partPath); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		downloaded, err := os.ReadFile(partPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(downloaded, content) {
+			t.Fatalf("%s: downloaded content does not match", name)
+		}
+		if len(ranges) != 1 || ranges[0] != c.expectedRange {
+			t.Fatalf("%s: expected a single request for range %q, received %q", name, c.expectedRange, ranges)
+		}
+		if resumed := c.expectedRange != ""; resumed != (tokens[0] == "token") {
+			t.Fatalf("%s: expected the resume token to be sent only when resuming, received %q", name, tokens[0])
+		}
+	}
+}
+
+func TestCompleteDownloadIsNotRequestedAgain(t *testing.T) {
+	spinner.Disable()
+	content := bytes.Repeat([]byte("quick brown fox "), 4096)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set(routes.RemainingDownloadsHeader, "0")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	claimTag := &internal.ClaimTag{Server: server.URL, Id: "object"}
+	partPath := filepath.Join(t.TempDir(), "object.part")
+
+	// e.g. processing the first download failed
+	for i := 0; i < 2; i++ {
+		remaining, err := downloadToPart(claimTag, partPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining != "0" {
+			t.Fatalf("expected remaining downloads to be kept, received %q", remaining)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("expected a single request, received %d", requests)
+	}
+	downloaded, err := os.ReadFile(partPath)
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Fatalf("expected complete download to be kept (%v)", err)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	for contentRange, expected := range map[string][3]int64{
+		"bytes 100-199/1000": {100, 1000, 1},
+		"bytes */1000":       {-1, 1000, 1},
+		"bytes 100-199/*":    {0, 0, 0},
+		"items 1-2/3":        {0, 0, 0},
+	} {
+		start, size, ok := parseContentRange(contentRange)
+		if start != expected[0] || size != expected[1] || ok != (expected[2] == 1) {
+			t.Fatalf("%s: expected %v, received %v %v %v", contentRange, expected, start, size, ok)
+		}
+	}
+}
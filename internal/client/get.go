@@ -17,25 +17,42 @@ limitations under the License.
 package client
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"path/filepath"
 
 	"github.com/dustin/go-humanize"
 
 	"github.com/wilsonehusin/soubise/internal"
 	"github.com/wilsonehusin/soubise/internal/archive"
-	"github.com/wilsonehusin/soubise/internal/buildinfo"
+	"github.com/wilsonehusin/soubise/internal/bundle"
+	"github.com/wilsonehusin/soubise/internal/compression"
 	"github.com/wilsonehusin/soubise/internal/crypto"
 	"github.com/wilsonehusin/soubise/internal/printer"
-	"github.com/wilsonehusin/soubise/internal/server/routes"
 	"github.com/wilsonehusin/soubise/internal/spinner"
 )
 
-func Get(refPath string) error {
+type GetOptions struct {
+	// Passphrase unwraps the encryption key for ClaimTags shared without one
+	Passphrase string
+	// Identity is the path to an identity file, which unwraps the encryption
+	// key for ClaimTags shared to recipients
+	Identity string
+	// TrustedKeys is the path to a file of verifying keys, which signed
+	// archives are checked against
+	TrustedKeys string
+	// RequireSignature refuses files which are not signed by a trusted key,
+	// before decrypting any of it
+	RequireSignature bool
+	// Output is the directory the file is written, or bundles are unpacked, to
+	Output string
+}
+
+func Get(refPath string, opts *GetOptions) error {
 	claimTag, err := internal.Parse(refPath)
 	if err != nil {
 		return err
@@ -46,91 +63,337 @@ func Get(refPath string) error {
 	}
 	printer.Stdout("  Server: %v\n\n", uriBuilder.String())
 
-	key64, err := crypto.Base64FromString(claimTag.EncryptionKey)
-	if err != nil {
-		return fmt.Errorf("unable to decode encryption key: %w", err)
+	var trusted []trustedKey
+	if opts.TrustedKeys != "" {
+		trusted, err = loadTrustedKeys(opts.TrustedKeys)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.RequireSignature && len(trusted) == 0 {
+		return fmt.Errorf("signature can not be required without trusted keys, set --trusted-keys")
 	}
 
-	archiveBlob, err := downloadShareable(claimTag)
+	output := opts.Output
+	if output == "" {
+		output = "."
+	}
+
+	// the archive is downloaded next to the output first, so that interrupted
+	// downloads can be resumed
+	partPath := filepath.Join(output, claimTag.Id+".part")
+	remainingDownloads, err := downloadToPart(claimTag, partPath)
 	if err != nil {
+		if finfo, statErr := os.Stat(partPath); statErr == nil && finfo.Size() > 0 {
+			printer.Stderr("Partially downloaded archive is kept at %v, rerun to resume.\n", partPath)
+		} else {
+			_ = os.Remove(partPath)
+			_ = os.Remove(partPath + ".resume")
+		}
 		return fmt.Errorf("unable to download file: %w", err)
 	}
+	archiveFile, err := os.Open(partPath)
+	if err != nil {
+		return fmt.Errorf("unable to read downloaded file: %w", err)
+	}
+	defer archiveFile.Close()
+
+	if err := processDownload(claimTag, archiveFile, output, trusted, opts); err != nil {
+		printer.Stderr("Downloaded archive is kept at %v, to retry without downloading it again.\n", partPath)
+		return err
+	}
+	printRemainingDownloads(remainingDownloads)
+	archiveFile.Close()
+	err = os.Remove(partPath)
+	_ = os.Remove(partPath + ".resume")
+	return err
+}
+
+func processDownload(claimTag *internal.ClaimTag, archiveFile *os.File, output string, trusted []trustedKey, opts *GetOptions) error {
+	if opts.RequireSignature {
+		if err := verifySignatureAhead(archiveFile, trusted); err != nil {
+			return fmt.Errorf("unable to verify signature: %w", err)
+		}
+	}
 
 	spinner.Start(" unpack", "reconstructing")
-	archiveToStore, err := archive.LoadArchive(*archiveBlob)
+	archiveToStore, content, err := archive.ReadArchive(archiveFile)
 	if err != nil {
 		spinner.StopFail("failed")
 		return fmt.Errorf("unable to understand archive: %w", err)
 	}
 	spinner.Stop("done")
 
-	spinner.Start(" decrypt", "doing math")
-	decryptedContent, err := crypto.DecryptBlob(archiveToStore.Content, key64)
+	key64, err := resolveKey(claimTag, archiveToStore, opts)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := archiveToStore.OpenMetadata(key64)
 	if err != nil {
-		spinner.StopFail("failed")
 		return fmt.Errorf("unable to decrypt file: %w", err)
 	}
-	spinner.Stop("done")
+	printMetadata(metadata)
+
+	decrypted, err := decryptContent(archiveToStore, content, key64)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt file: %w", err)
+	}
+	decompressed, err := compression.NewReader(metadata.Compression, decrypted)
+	if err != nil {
+		return fmt.Errorf("unable to decompress file: %w", err)
+	}
+	defer decompressed.Close()
+	plaintext := &untilArchiveEnd{r: decompressed, rest: content}
 
-	if err := writeToFile(archiveToStore.Name, *decryptedContent); err != nil {
+	if metadata.Bundle {
+		if err := unpackToDir(output, plaintext, metadata.SHA256); err != nil {
+			return fmt.Errorf("unable to unpack downloaded archive: %w", err)
+		}
+		printSigner(archiveToStore.Signer, trusted)
+		return nil
+	}
+
+	name, err := sanitizeName(metadata.Name)
+	if err != nil {
+		return err
+	}
+	if err := writeToFile(filepath.Join(output, name), plaintext, metadata.SHA256); err != nil {
 		return fmt.Errorf("unable to write downloaded archive: %w", err)
 	}
+	printSigner(archiveToStore.Signer, trusted)
 
 	return nil
 }
 
-func writeToFile(name string, content []byte) error {
-	// TODO: check if user wants to overwrite
-	spinner.Start(" write to file", "creating file")
-	dest, err := os.Create(name)
-	if err != nil {
-		spinner.StopFail("unable to create file")
+func printMetadata(m *archive.Metadata) {
+	if m.Bundle {
+		printer.Stdout("    Files: %v (bundled)\n", m.Name)
+	} else {
+		printer.Stdout("     File: %v\n", m.Name)
+	}
+	if m.Size > 0 {
+		printer.Stdout("     Size: %v\n", humanize.Bytes(uint64(m.Size)))
+	}
+	if m.ContentType != "" {
+		printer.Stdout("     Type: %v\n", m.ContentType)
+	}
+	if m.SHA256 != nil {
+		printer.Stdout("   SHA256: %x\n", m.SHA256)
+	}
+	if m.Message != "" {
+		printer.Stdout("  Message: %v\n", m.Message)
+	}
+	printer.Stdout("\n")
+}
+
+func printRemainingDownloads(remaining string) {
+	switch remaining {
+	case "":
+	case "0":
+		printer.Stdout("Downloads: none remaining, the file is no longer available\n")
+	default:
+		printer.Stdout("Downloads: %v remaining\n", remaining)
+	}
+}
+
+// sanitizeName ensures the name chosen by the sender can only refer to a file
+// directly in the output directory.
+func sanitizeName(name string) (string, error) {
+	base := filepath.Base(filepath.Clean("/" + name))
+	if base == "/" || base == "." || base == ".." {
+		return "", fmt.Errorf("archive does not carry a usable file name: %q", name)
+	}
+	return base, nil
+}
+
+func resolveKey(claimTag *internal.ClaimTag, a *archive.Archive, opts *GetOptions) (*crypto.Base64Data, error) {
+	if claimTag.EncryptionKey != "" {
+		key64, err := crypto.Base64FromString(claimTag.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode encryption key: %w", err)
+		}
+		return key64, nil
+	}
+
+	var passphraseWrap *crypto.KeyWrap
+	var recipientWraps []crypto.KeyWrap
+	for i := range a.KeyWraps {
+		switch a.KeyWraps[i].Kind {
+		case crypto.PassphraseKeyWrap:
+			passphraseWrap = &a.KeyWraps[i]
+		case crypto.RecipientKeyWrap:
+			recipientWraps = append(recipientWraps, a.KeyWraps[i])
+		}
+	}
+
+	if len(recipientWraps) > 0 && (opts.Identity != "" || passphraseWrap == nil) {
+		if opts.Identity == "" {
+			return nil, fmt.Errorf("file is encrypted to recipients, retry with --identity")
+		}
+		identity, err := loadIdentity(opts.Identity)
+		if err != nil {
+			return nil, err
+		}
+		for _, wrap := range recipientWraps {
+			if key64, err := wrap.UnwrapWithIdentity(identity); err == nil {
+				return key64, nil
+			}
+		}
+		if passphraseWrap == nil || opts.Passphrase == "" {
+			return nil, fmt.Errorf("%w: %v is not a recipient of this file", crypto.ErrUnwrapKey, identity.PublicKey())
+		}
+	}
+
+	if passphraseWrap != nil {
+		if opts.Passphrase == "" {
+			return nil, fmt.Errorf("file is protected by a passphrase, retry with --password")
+		}
+		spinner.Start(" unlock", "deriving key from passphrase")
+		key64, err := passphraseWrap.UnwrapWithPassphrase([]byte(opts.Passphrase))
+		if err != nil {
+			spinner.StopFail("failed")
+			return nil, err
+		}
+		spinner.Stop("done")
+		return key64, nil
+	}
+
+	return nil, fmt.Errorf("no encryption key available for this file")
+}
+
+func decryptContent(a *archive.Archive, content io.Reader, key *crypto.Base64Data) (io.Reader, error) {
+	switch a.Suite {
+	case archive.SuiteStreamAESGCM:
+		return crypto.NewDecryptReader(content, key)
+	case archive.SuiteLegacyBlob:
+		spinner.Start(" decrypt", "doing math")
+		blob, err := io.ReadAll(content)
+		if err != nil {
+			spinner.StopFail("failed")
+			return nil, err
+		}
+		decrypted, err := crypto.DecryptBlob(blob, key)
+		if err != nil {
+			spinner.StopFail("failed")
+			return nil, err
+		}
+		spinner.Stop("done")
+		return bytes.NewReader(*decrypted), nil
+	}
+	return nil, fmt.Errorf("unsupported cipher suite %d", a.Suite)
+}
+
+// unpackToDir unpacks into a staging directory within dir first, its entries
+// are only moved into dir once the content was verified.
+func unpackToDir(dir string, content io.Reader, expectedChecksum []byte) error {
+	spinner.Start(" unpack to directory", "downloading and decrypting")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		spinner.StopFail("unable to create directory")
 		return err
 	}
-	defer dest.Close()
-	size, err := dest.Write(content)
+	staging, err := os.MkdirTemp(dir, ".soubise-unpack-")
 	if err != nil {
-		spinner.StopFail("unable to write content to file")
+		spinner.StopFail("unable to create directory")
 		return err
 	}
-	spinner.Stop(fmt.Sprintf("%s (%s)", name, humanize.Bytes(uint64(size))))
+	defer os.RemoveAll(staging)
+
+	checksum := sha256.New()
+	tee := io.TeeReader(content, checksum)
+	if err := bundle.Unpack(tee, staging); err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	// tar readers may stop before the padding at the end of the stream, which
+	// also has to be read for signatures to be verified
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	if expectedChecksum != nil && !bytes.Equal(checksum.Sum(nil), expectedChecksum) {
+		spinner.StopFail("checksum mismatch")
+		return fmt.Errorf("content does not match SHA256 %x", expectedChecksum)
+	}
+	if err := moveEntries(staging, dir); err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	spinner.Stop(dir)
 	return nil
 }
 
-func downloadShareable(claimTag *internal.ClaimTag) (*[]byte, error) {
-	spinner.Start(" download", "resolving path")
-	uriBuilder, err := url.Parse(claimTag.Server)
+// moveEntries renames every entry of src into dest, replacing files like
+// writeToFile does. Directories are never merged, nothing is moved if one
+// already exists.
+func moveEntries(src string, dest string) error {
+	entries, err := os.ReadDir(src)
 	if err != nil {
-		spinner.StopFail("unable to parse server")
-		return nil, fmt.Errorf("unable to parse %s as url: %w", claimTag.Server, err)
+		return err
 	}
-	uriBuilder.Path = path.Join(uriBuilder.Path, routes.GetObjectWithId(claimTag.Id))
-	request, err := http.NewRequest("GET", uriBuilder.String(), nil)
-	if err != nil {
-		spinner.StopFail("unable to compose request")
-		return nil, fmt.Errorf("unable to compose request ot server: %w", err)
+	for _, entry := range entries {
+		existing, err := os.Lstat(filepath.Join(dest, entry.Name()))
+		if err == nil && (existing.IsDir() || entry.IsDir()) {
+			return fmt.Errorf("%v already exists", filepath.Join(dest, entry.Name()))
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
-	request.Header.Set("User-Agent", fmt.Sprintf("Soubise/%v", buildinfo.Version))
-
-	client := &http.Client{}
-	spinner.Update("pulling data")
-	response, err := client.Do(request)
-	if err != nil {
-		spinner.StopFail("failed to download")
-		return nil, fmt.Errorf("unable to download from server: %w", err)
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		spinner.StopFail("error")
-		return nil, fmt.Errorf("server did not process request successfully: %v", response.Status)
+func writeToFile(name string, content io.Reader, expectedChecksum []byte) error {
+	// TODO: check if user wants to overwrite
+	spinner.Start(" write to file", "downloading and decrypting")
+	// content is authenticated segment by segment, it only replaces name once
+	// verified completely
+	dest, err := createTemp(name)
+	if err != nil {
+		spinner.StopFail("unable to create file")
+		return err
 	}
-
-	body, err := io.ReadAll(response.Body)
+	defer os.Remove(dest.Name())
+	defer dest.Close()
+	checksum := sha256.New()
+	size, err := io.Copy(dest, io.TeeReader(content, checksum))
 	if err != nil {
-		spinner.StopFail("failed")
-		return nil, fmt.Errorf("unable to parse response: %w", err)
+		spinner.StopFail("unable to write content to file")
+		return err
 	}
-	spinner.Stop("done")
+	if expectedChecksum != nil && !bytes.Equal(checksum.Sum(nil), expectedChecksum) {
+		spinner.StopFail("checksum mismatch")
+		return fmt.Errorf("content does not match SHA256 %x", expectedChecksum)
+	}
+	if err := dest.Close(); err != nil {
+		spinner.StopFail("unable to write content to file")
+		return err
+	}
+	if err := os.Rename(dest.Name(), name); err != nil {
+		spinner.StopFail("unable to write content to file")
+		return err
+	}
+	spinner.Stop(fmt.Sprintf("%s (%s)", name, humanize.Bytes(uint64(size))))
+	return nil
+}
 
-	return &body, nil
+// createTemp creates a hidden file next to name, to be renamed into place
+// once complete. Unlike os.CreateTemp, it is given the same permissions
+// os.Create would give name.
+func createTemp(name string) (*os.File, error) {
+	for {
+		suffix, err := crypto.RandLen(6)
+		if err != nil {
+			return nil, err
+		}
+		temp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".soubise-"+suffix.String())
+		f, err := os.OpenFile(temp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
 }
@@ -0,0 +1,86 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/bundle"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+func TestUnpackToDirVerifiesFirst(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "fox.txt"), []byte("jumpsoverthelazydog"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var packed bytes.Buffer
+	if err := bundle.Pack(&packed, []string{filepath.Join(src, "fox.txt")}); err != nil {
+		t.Fatal(err)
+	}
+	checksum := sha256.Sum256(packed.Bytes())
+
+	dest := t.TempDir()
+	if err := unpackToDir(dest, bytes.NewReader(packed.Bytes()), []byte("mismatch")); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+	if entries, err := os.ReadDir(dest); err != nil || len(entries) != 0 {
+		t.Fatalf("expected nothing to be unpacked before verification, received %v (%v)", entries, err)
+	}
+
+	if err := unpackToDir(dest, bytes.NewReader(packed.Bytes()), checksum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(dest, "fox.txt")); err != nil || string(content) != "jumpsoverthelazydog" {
+		t.Fatalf("expected unpacked file, received %q (%v)", content, err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 1 {
+		t.Fatalf("expected staging directory to be removed, received %v", entries)
+	}
+}
+
+func TestWriteToFileReplacesOnceVerified(t *testing.T) {
+	spinner.Disable()
+	dest := t.TempDir()
+	name := filepath.Join(dest, "fox.txt")
+	if err := os.WriteFile(name, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("jumpsoverthelazydog")
+	checksum := sha256.Sum256(content)
+
+	if err := writeToFile(name, bytes.NewReader(content), []byte("mismatch")); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+	if received, err := os.ReadFile(name); err != nil || string(received) != "previous" {
+		t.Fatalf("expected existing file to be kept, received %q (%v)", received, err)
+	}
+
+	if err := writeToFile(name, bytes.NewReader(content), checksum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if received, err := os.ReadFile(name); err != nil || !bytes.Equal(received, content) {
+		t.Fatalf("expected file to be replaced, received %q (%v)", received, err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 1 {
+		t.Fatalf("expected temporary files to be removed, received %v", entries)
+	}
+}
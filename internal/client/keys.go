@@ -0,0 +1,171 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+	"github.com/wilsonehusin/soubise/internal/printer"
+)
+
+// Keygen creates a new identity, or a signing key if signing is set, written
+// to output unless it is empty, in which case it is printed.
+func Keygen(output string, signing bool) error {
+	var private, public fmt.Stringer
+	publicLabel, publicTitle := "public key", "Public key"
+	if signing {
+		signingKey, err := crypto.GenerateSigningKey()
+		if err != nil {
+			return fmt.Errorf("unable to generate signing key: %w", err)
+		}
+		private, public = signingKey, signingKey.VerifyingKey()
+		publicLabel, publicTitle = "verifying key", "Verifying key"
+	} else {
+		identity, err := crypto.GenerateIdentity()
+		if err != nil {
+			return fmt.Errorf("unable to generate identity: %w", err)
+		}
+		private, public = identity, identity.PublicKey()
+	}
+	content := fmt.Sprintf("# created: %v\n# %v: %v\n%v\n",
+		time.Now().Format(time.RFC3339), publicLabel, public, private)
+
+	if output == "" {
+		printer.Stdout("%v", content)
+		return nil
+	}
+
+	fd, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create key file: %w", err)
+	}
+	if _, err := fd.WriteString(content); err != nil {
+		fd.Close()
+		return fmt.Errorf("unable to write key file: %w", err)
+	}
+	if err := fd.Close(); err != nil {
+		return fmt.Errorf("unable to write key file: %w", err)
+	}
+	printer.Stdout("%v: %v\n", publicTitle, public)
+	return nil
+}
+
+// loadRecipients accepts public keys, or paths to files listing public keys
+// one per line.
+func loadRecipients(values []string) ([]*crypto.PublicKey, error) {
+	var recipients []*crypto.PublicKey
+	for _, value := range values {
+		if strings.HasPrefix(value, crypto.PublicKeyPrefix) {
+			recipient, err := crypto.ParsePublicKey(value)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+			continue
+		}
+
+		lines, err := readKeyFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read recipients: %w", err)
+		}
+		for _, line := range lines {
+			recipient, err := crypto.ParsePublicKey(line)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", value, err)
+			}
+			recipients = append(recipients, recipient)
+		}
+	}
+	return recipients, nil
+}
+
+func loadIdentity(path string) (*crypto.Identity, error) {
+	lines, err := readKeyFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read identity: %w", err)
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("expected exactly one identity in %v", path)
+	}
+	return crypto.ParseIdentity(lines[0])
+}
+
+func loadSigningKey(path string) (*crypto.SigningKey, error) {
+	lines, err := readKeyFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read signing key: %w", err)
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("expected exactly one signing key in %v", path)
+	}
+	return crypto.ParseSigningKey(lines[0])
+}
+
+type trustedKey struct {
+	key  *crypto.VerifyingKey
+	name string
+}
+
+// loadTrustedKeys reads verifying keys one per line, each optionally followed
+// by the name of its owner.
+func loadTrustedKeys(path string) ([]trustedKey, error) {
+	lines, err := readKeyFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read trusted keys: %w", err)
+	}
+	var trusted []trustedKey
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		key, err := crypto.ParseVerifyingKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		trusted = append(trusted, trustedKey{key: key, name: strings.Join(fields[1:], " ")})
+	}
+	return trusted, nil
+}
+
+// readKeyFile returns lines of the file, ignoring empty lines and comments.
+func readKeyFile(path string) ([]string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if lines == nil {
+		return nil, fmt.Errorf("no key found in %v", path)
+	}
+	return lines, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal"
+	"github.com/wilsonehusin/soubise/internal/buildinfo"
+	"github.com/wilsonehusin/soubise/internal/printer"
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+// Delete removes a shared file from the server, refPath has to be the
+// ClaimTag including the owner key printed by Share.
+func Delete(refPath string) error {
+	claimTag, err := parseOwnerClaimTag(refPath)
+	if err != nil {
+		return err
+	}
+	printer.Stdout("  Server: %v\n\n", claimTag.Server)
+
+	spinner.Start(" delete", "connecting")
+	response, err := ownerRequest(claimTag, "DELETE", nil)
+	if err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	response.Body.Close()
+	spinner.Stop("done")
+	return nil
+}
+
+// Extend changes the expiry of a shared file to lifetime from now, refPath
+// has to be the ClaimTag including the owner key printed by Share.
+func Extend(refPath string, lifetime time.Duration) error {
+	claimTag, err := parseOwnerClaimTag(refPath)
+	if err != nil {
+		return err
+	}
+	printer.Stdout("  Server: %v\n\n", claimTag.Server)
+
+	body, err := json.Marshal(&routes.ExtendRequest{Lifetime: lifetime.String()})
+	if err != nil {
+		return err
+	}
+
+	spinner.Start(" extend", "connecting")
+	response, err := ownerRequest(claimTag, "PATCH", body)
+	if err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	defer response.Body.Close()
+
+	extended := &routes.ExtendResponse{}
+	if err := json.NewDecoder(response.Body).Decode(extended); err != nil {
+		spinner.StopFail("failed")
+		return fmt.Errorf("unable to read response from server: %w", err)
+	}
+	spinner.Stop("done")
+	printer.Stdout("  Expires: %v (%v from now)\n", extended.Expiry.Format(time.RFC1123), time.Until(extended.Expiry).Round(time.Second))
+	return nil
+}
+
+func parseOwnerClaimTag(refPath string) (*internal.ClaimTag, error) {
+	claimTag, err := internal.Parse(refPath)
+	if err != nil {
+		return nil, err
+	}
+	if claimTag.OwnerKey == "" {
+		return nil, fmt.Errorf("reference path does not carry the owner key, use the one printed when sharing")
+	}
+	return claimTag, nil
+}
+
+func ownerRequest(claimTag *internal.ClaimTag, method string, body []byte) (*http.Response, error) {
+	uriBuilder, err := url.Parse(claimTag.Server)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s as url: %w", claimTag.Server, err)
+	}
+	uriBuilder.Path = path.Join(uriBuilder.Path, routes.GetObjectWithId(claimTag.Id))
+
+	var content io.Reader
+	if body != nil {
+		content = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, uriBuilder.String(), content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compose request to server: %w", err)
+	}
+	request.Header.Set("User-Agent", fmt.Sprintf("Soubise/%v", buildinfo.Version))
+	request.Header.Set("Authorization", "Bearer "+claimTag.OwnerKey)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach server: %w", err)
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		response.Body.Close()
+		return nil, fmt.Errorf("server did not process request successfully: %v", response.Status)
+	}
+	return response, nil
+}
@@ -19,141 +19,295 @@ package client
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
 	"net/url"
-	"os"
-	"path"
-	"path/filepath"
 	"time"
 
 	"github.com/dustin/go-humanize"
 
 	"github.com/wilsonehusin/soubise/internal"
 	"github.com/wilsonehusin/soubise/internal/archive"
-	"github.com/wilsonehusin/soubise/internal/buildinfo"
+	"github.com/wilsonehusin/soubise/internal/compression"
 	"github.com/wilsonehusin/soubise/internal/crypto"
 	"github.com/wilsonehusin/soubise/internal/printer"
-	"github.com/wilsonehusin/soubise/internal/server/routes"
 	"github.com/wilsonehusin/soubise/internal/spinner"
 )
 
-func Share(pathToFile string, lifetime time.Duration, server string) error {
-	uriBuilder, err := url.Parse(server)
-	if err != nil {
+type ShareOptions struct {
+	Lifetime time.Duration
+	Server   string
+	// Passphrase wraps the encryption key into the archive instead of
+	// including it in the ClaimTag
+	Passphrase string
+	// Recipients are public keys, or files listing them, which the
+	// encryption key is wrapped to instead of including it in the ClaimTag
+	Recipients []string
+	// SigningKey is the path to a signing key file, which signs the archive
+	// so recipients can verify who shared it
+	SigningKey string
+	// Message is delivered to the recipient along with the file
+	Message string
+	// Compression is applied before encryption, unless the file is already
+	// compressed
+	Compression string
+	// MaxDownloads makes the server delete the file once it has been
+	// downloaded this many times, unless 0
+	MaxDownloads uint32
+}
+
+func Share(paths []string, opts *ShareOptions) error {
+	if _, err := url.Parse(opts.Server); err != nil {
 		return err
 	}
-	uriBuilder.Path = path.Join(uriBuilder.Path, routes.CreateObject)
-	printer.Stdout("   Server: %v\n", server)
-
-	encryptionKey := crypto.GenerateKey()
+	printer.Stdout("   Server: %v\n", opts.Server)
 
-	archiveToShare, err := prepareShareable(pathToFile, encryptionKey, lifetime)
+	encryptionKey, err := crypto.GenerateKey()
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to generate encryption key: %w", err)
 	}
 
-	encoded, err := archiveToShare.ToBytes()
+	recipients, err := loadRecipients(opts.Recipients)
 	if err != nil {
 		return err
 	}
 
-	// TODO: compression? ¯\_(ツ)_/¯
-	buf := bytes.NewBuffer(encoded)
+	var signer *crypto.SigningKey
+	if opts.SigningKey != "" {
+		signer, err = loadSigningKey(opts.SigningKey)
+		if err != nil {
+			return err
+		}
+	}
 
-	request, err := http.NewRequest("POST", uriBuilder.String(), buf)
+	src, err := newSource(paths)
 	if err != nil {
 		return err
 	}
 
-	request.Header.Set("User-Agent", fmt.Sprintf("Soubise/%v", buildinfo.Version))
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-	client := &http.Client{}
-	spinner.Start("  upload", "sending to server")
-	response, err := client.Do(request)
+	archiveToShare, metadata, err := prepareShareable(src, encryptionKey, opts)
 	if err != nil {
-		spinner.StopFail("failed to upload\n")
 		return err
 	}
 
-	defer response.Body.Close()
+	// an interrupted upload of the same content is resumed as it was started,
+	// with the key and options of the earlier run
+	state := loadUploadState(opts.Server, paths)
+	if state != nil && !bytes.Equal(state.Metadata.SHA256, metadata.SHA256) {
+		state.remove()
+		state = nil
+	}
+	if state != nil {
+		if encryptionKey, err = crypto.Base64FromString(state.Key); err != nil {
+			return fmt.Errorf("unable to resume upload: %w", err)
+		}
+		archiveToShare, metadata = state.Archive, state.Metadata
+		printer.Stdout("   Resume: upload started earlier, expires %v\n\n", archiveToShare.Expiry.Format(time.RFC1123))
+	} else if err := wrapKey(archiveToShare, encryptionKey, recipients, opts); err != nil {
+		return err
+	}
+	if signer != nil {
+		printer.Stdout("Signed by: %v\n", signer.VerifyingKey())
+	}
+	if len(recipients) > 0 || signer != nil {
+		printer.Stdout("\n")
+	}
+	claimKey := encryptionKey.String()
+	if len(archiveToShare.KeyWraps) > 0 {
+		claimKey = ""
+	}
 
-	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		spinner.StopFail("error")
-		return fmt.Errorf("server did not process request successfully: %v", response.Status)
+	if state == nil {
+		if state, err = newUploadState(opts.Server, paths); err == nil {
+			state.Key, state.Archive, state.Metadata = encryptionKey.String(), archiveToShare, metadata
+			err = state.save()
+		}
+		if err != nil {
+			printer.Stderr("Unable to save upload progress, an interrupted upload has to start over: %v\n", err)
+			state = nil
+		}
 	}
-	spinner.Stop("done")
-	printer.Stdout("\n")
 
-	rawBody, err := io.ReadAll(response.Body)
-	if err != nil {
-		return fmt.Errorf("unable to read response from server: %w", err)
+	body, bodyWriter := io.Pipe()
+	go func() {
+		bodyWriter.CloseWithError(writeShareable(bodyWriter, src, archiveToShare, metadata, encryptionKey, signer))
+	}()
+	defer body.Close()
+
+	shareId, ownerKey, err := upload(opts.Server, body, state)
+	if errors.Is(err, errUploadChanged) {
+		state.remove()
+		return fmt.Errorf("%w, run again to start over", err)
+	} else if err != nil {
+		if state != nil && state.Session != "" {
+			printer.Stderr("Upload progress is kept at %v, run again to resume.\n", state.path)
+		} else if state != nil {
+			state.remove()
+		}
+		return err
+	}
+	if state != nil {
+		state.remove()
 	}
-	shareId := string(rawBody)
+	printer.Stdout("\n")
+
 	claimTag := &internal.ClaimTag{
-		Server:        server,
+		Server:        opts.Server,
 		Id:            shareId,
-		EncryptionKey: encryptionKey.String(),
+		EncryptionKey: claimKey,
 	}
 
 	printer.Stdout("Encrypted file has been stored successfully! Use the following to share:\n")
 	printer.Stdout("  %v\n", claimTag.String())
+	if hasKeyWrap(archiveToShare, crypto.PassphraseKeyWrap) {
+		printer.Stdout("\nThe link alone does not decrypt the file, send the passphrase through a separate channel.\n")
+	} else if hasKeyWrap(archiveToShare, crypto.RecipientKeyWrap) {
+		printer.Stdout("\nThe link alone does not decrypt the file, only the recipients listed above can.\n")
+	}
+
+	if ownerKey != "" {
+		claimTag.OwnerKey = ownerKey
+		printer.Stdout("\nKeep the following to yourself, it allows deleting or extending the share:\n")
+		printer.Stdout("  %v\n", claimTag.String())
+	}
 
 	return nil
 }
 
-func prepareShareable(pathToFile string, encryptionKey *crypto.Base64Data, lifetime time.Duration) (*archive.Archive, error) {
-	finfo, err := os.Stat(pathToFile)
-	if err != nil {
-		return nil, fmt.Errorf("unable to find %v: %w\n", pathToFile, err)
+func hasKeyWrap(a *archive.Archive, kind string) bool {
+	for _, wrap := range a.KeyWraps {
+		if wrap.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapKey adds key wraps to a, so that the passphrase or recipients decrypt it
+// rather than the ClaimTag.
+func wrapKey(a *archive.Archive, encryptionKey *crypto.Base64Data, recipients []*crypto.PublicKey, opts *ShareOptions) error {
+	if opts.Passphrase != "" {
+		spinner.Start("  protect", "deriving key from passphrase")
+		wrap, err := crypto.WrapWithPassphrase(encryptionKey, []byte(opts.Passphrase))
+		if err != nil {
+			spinner.StopFail("failed")
+			return err
+		}
+		spinner.Stop("done")
+		a.KeyWraps = append(a.KeyWraps, *wrap)
 	}
-	if finfo.IsDir() {
-		return nil, fmt.Errorf("%v looks like a directory, Soubise can only process a specific file for now\n", pathToFile)
+	for _, recipient := range recipients {
+		wrap, err := crypto.WrapForRecipient(encryptionKey, recipient)
+		if err != nil {
+			return err
+		}
+		printer.Stdout("Recipient: %v\n", recipient)
+		a.KeyWraps = append(a.KeyWraps, *wrap)
 	}
+	return nil
+}
 
-	name := filepath.Base(pathToFile)
-	printer.Stdout("     File: %v\n", name)
-	printer.Stdout("     Size: %v\n", humanize.Bytes(uint64(finfo.Size())))
+func prepareShareable(src *source, encryptionKey *crypto.Base64Data, opts *ShareOptions) (*archive.Archive, *archive.Metadata, error) {
+	if src.bundle {
+		printer.Stdout("    Files: %v (bundled)\n", src.name)
+	} else {
+		printer.Stdout("     File: %v\n", src.name)
+	}
 
-	fd, err := os.Open(pathToFile)
+	contentType, err := src.contentType()
 	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %w", err)
+		return nil, nil, fmt.Errorf("unable to read file: %w", err)
+	}
+
+	fd, err := src.open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open file: %w", err)
 	}
 	defer fd.Close()
 
-	content, err := io.ReadAll(fd)
+	checksum := sha256.New()
+	size, err := io.Copy(checksum, fd)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read file: %w", err)
+		return nil, nil, fmt.Errorf("unable to read file: %w", err)
+	}
+	printer.Stdout("     Size: %v\n", humanize.Bytes(uint64(size)))
+	printer.Stdout("     Type: %v\n", contentType)
+	printer.Stdout("   SHA256: %x\n", checksum.Sum(nil))
+	if opts.Message != "" {
+		printer.Stdout("  Message: %v\n", opts.Message)
 	}
-	checksum := sha256.Sum256(content)
-	printer.Stdout("   SHA256: %x\n", checksum)
 
-	expiry := time.Now().Add(lifetime)
-	printer.Stdout("  Expires: %v (%v from now)\n\n", expiry.Format(time.RFC1123), lifetime)
+	algorithm := opts.Compression
+	if algorithm == "" {
+		algorithm = compression.None
+	} else if algorithm != compression.None && compression.IsCompressed(contentType) {
+		printer.Stdout(" Compress: %v skipped, already compressed\n", algorithm)
+		algorithm = compression.None
+	} else {
+		printer.Stdout(" Compress: %v\n", algorithm)
+	}
+
+	expiry := time.Now().Add(opts.Lifetime)
+	printer.Stdout("  Expires: %v (%v from now)\n", expiry.Format(time.RFC1123), opts.Lifetime)
+	if opts.MaxDownloads > 0 {
+		printer.Stdout("Downloads: %v at most\n", opts.MaxDownloads)
+	}
+	printer.Stdout("\n")
+
+	shareable := &archive.Archive{
+		Suite:        archive.SuiteStreamAESGCM,
+		Expiry:       expiry,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	metadata := &archive.Metadata{
+		Name:        src.name,
+		Size:        size,
+		Bundle:      src.bundle,
+		ContentType: contentType,
+		SHA256:      checksum.Sum(nil),
+		Message:     opts.Message,
+		Compression: algorithm,
+	}
+	if err := shareable.SealMetadata(metadata, encryptionKey); err != nil {
+		return nil, nil, err
+	}
+	return shareable, metadata, nil
+}
 
-	spinner.Start(" encrypt", "running some math")
-	encrypted, err := crypto.EncryptBlob(content, encryptionKey)
+// writeShareable streams the archive header followed by the encrypted content
+// of src into w, without holding the content in memory.
+func writeShareable(w io.Writer, src *source, header *archive.Archive, metadata *archive.Metadata, encryptionKey *crypto.Base64Data, signer *crypto.SigningKey) error {
+	fd, err := src.open()
 	if err != nil {
-		spinner.StopFail("failed to encrypt content")
-		return nil, fmt.Errorf("unable to encrypt file: %w", err)
+		return fmt.Errorf("unable to open file: %w", err)
 	}
-	spinner.Update("validating")
-	decrypted, err := crypto.DecryptBlob(*encrypted, encryptionKey)
+	defer fd.Close()
+
+	archiveWriter, err := archive.NewWriter(w, header)
 	if err != nil {
-		spinner.StopFail("failed to validate")
-		return nil, fmt.Errorf("unable to validate encrypted file: %w", err)
+		return err
 	}
-	if !bytes.Equal(content, *decrypted) {
-		spinner.StopFail("inconsistent")
-		return nil, fmt.Errorf("inconsistent encryption behavior")
+	if signer != nil {
+		archiveWriter.SignWith(signer)
 	}
-	spinner.Stop("done")
 
-	return &archive.Archive{
-		Name:    name,
-		Content: *encrypted,
-		Expiry:  expiry,
-	}, nil
+	encrypter, err := crypto.NewEncryptWriter(archiveWriter, encryptionKey)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt file: %w", err)
+	}
+	compressor, err := compression.NewWriter(metadata.Compression, encrypter)
+	if err != nil {
+		return fmt.Errorf("unable to compress file: %w", err)
+	}
+	if _, err := io.Copy(compressor, fd); err != nil {
+		return fmt.Errorf("unable to encrypt file: %w", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("unable to compress file: %w", err)
+	}
+	if err := encrypter.Close(); err != nil {
+		return fmt.Errorf("unable to encrypt file: %w", err)
+	}
+	return archiveWriter.Close()
 }
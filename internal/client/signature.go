@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/crypto"
+	"github.com/wilsonehusin/soubise/internal/printer"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+// untilArchiveEnd reads content from r, then consumes what is left of the
+// archive once r is exhausted, so that its signature is verified before the
+// content is considered complete.
+type untilArchiveEnd struct {
+	r    io.Reader
+	rest io.Reader
+}
+
+func (u *untilArchiveEnd) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, u.rest); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// verifySignatureAhead verifies the archive is signed by a trusted key, before
+// any of it is decrypted.
+func verifySignatureAhead(archiveFile *os.File, trusted []trustedKey) error {
+	spinner.Start(" verify", "checking signature")
+	a, content, err := archive.ReadArchive(archiveFile)
+	if err != nil {
+		spinner.StopFail("failed")
+		return fmt.Errorf("unable to understand archive: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		spinner.StopFail("invalid signature")
+		return err
+	}
+	if a.Signer == nil {
+		spinner.StopFail("not signed")
+		return fmt.Errorf("file is not signed")
+	}
+	if _, ok := lookupSigner(a.Signer, trusted); !ok {
+		spinner.StopFail("untrusted signer")
+		return fmt.Errorf("file is signed by %v, which is not a trusted key", a.Signer)
+	}
+	if _, err := archiveFile.Seek(0, io.SeekStart); err != nil {
+		spinner.StopFail("failed")
+		return err
+	}
+	spinner.Stop("done")
+	return nil
+}
+
+func lookupSigner(signer *crypto.VerifyingKey, trusted []trustedKey) (string, bool) {
+	for _, t := range trusted {
+		if t.key.Equal(signer) {
+			return t.name, true
+		}
+	}
+	return "", false
+}
+
+func printSigner(signer *crypto.VerifyingKey, trusted []trustedKey) {
+	if signer == nil {
+		if len(trusted) > 0 {
+			printer.Stdout("Signed by: nobody, the file is not signed\n")
+		}
+		return
+	}
+	name, ok := lookupSigner(signer, trusted)
+	switch {
+	case !ok:
+		printer.Stdout("Signed by: %v (not a trusted key)\n", signer)
+	case name != "":
+		printer.Stdout("Signed by: %v (%v, verified)\n", name, signer)
+	default:
+		printer.Stdout("Signed by: %v (verified)\n", signer)
+	}
+}
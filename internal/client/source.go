@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/wilsonehusin/soubise/internal/bundle"
+)
+
+// source is the plaintext to be shared, either a single file or a bundle of
+// files and directories. It is read twice: once to describe it in the archive
+// metadata and once more while uploading.
+type source struct {
+	paths  []string
+	name   string
+	bundle bool
+}
+
+func newSource(paths []string) (*source, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("nothing to share")
+	}
+
+	names := []string{}
+	for _, p := range paths {
+		finfo, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find %v: %w", p, err)
+		}
+		name := filepath.Base(filepath.Clean(p))
+		if finfo.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+
+	s := &source{
+		paths: paths,
+		name:  strings.Join(names, ", "),
+	}
+	if finfo, _ := os.Stat(paths[0]); len(paths) > 1 || !finfo.Mode().IsRegular() {
+		s.bundle = true
+	}
+	return s, nil
+}
+
+func (s *source) open() (io.ReadCloser, error) {
+	if !s.bundle {
+		return os.Open(s.paths[0])
+	}
+
+	packed, packer := io.Pipe()
+	go func() {
+		packer.CloseWithError(bundle.Pack(packer, s.paths))
+	}()
+	return packed, nil
+}
+
+// contentType guesses the MIME type from the file extension, falling back to
+// sniffing the beginning of the content.
+func (s *source) contentType() (string, error) {
+	if s.bundle {
+		return bundle.ContentType, nil
+	}
+	if byExtension := mime.TypeByExtension(filepath.Ext(s.name)); byExtension != "" {
+		return byExtension, nil
+	}
+
+	fd, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
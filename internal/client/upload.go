@@ -0,0 +1,376 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/buildinfo"
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+// uploadChunkSize is how much of the archive is sent per request, unless the
+// server accepts less. A failed chunk is held in memory to be resent.
+const uploadChunkSize = 8 << 20
+
+// uploadAttempts is how often a chunk is sent before giving up
+const uploadAttempts = 5
+
+type uploadStatusError struct {
+	status string
+}
+
+func (u *uploadStatusError) Error() string {
+	return fmt.Sprintf("server did not process request successfully: %v", u.status)
+}
+
+var errUploadChanged = errors.New("archive differs from the one partially uploaded")
+
+// upload sends the archive read from body to server, returning its id and
+// owner key. The archive is sent in chunks, a failed chunk is retried from the
+// last chunk the server acknowledged. Unless state is nil, it is saved after
+// every chunk, and the upload it describes is resumed if the server still
+// holds its chunks, body has to encode the same archive then. Servers which do
+// not support upload sessions receive the archive in a single request.
+func upload(server string, body io.Reader, state *uploadState) (string, string, error) {
+	spinner.Start("  upload", "encrypting and sending to server")
+	id, ownerKey, err := uploadArchive(server, body, state)
+	if err != nil {
+		spinner.StopFail("failed to upload\n")
+		return "", "", err
+	}
+	spinner.Stop("done")
+	return id, ownerKey, nil
+}
+
+func uploadArchive(server string, body io.Reader, state *uploadState) (string, string, error) {
+	serverUri, err := url.Parse(server)
+	if err != nil {
+		return "", "", err
+	}
+	uri := func(route string) string {
+		u := *serverUri
+		u.Path = path.Join(u.Path, route)
+		return u.String()
+	}
+
+	digest := sha256.New()
+	var session string
+	var chunkSize, sent int64
+	index := 0
+	if state != nil && state.Session != "" {
+		resumed, err := resumeUpload(uri, state, body, digest)
+		if err != nil {
+			return "", "", err
+		}
+		if resumed {
+			session, chunkSize, index, sent = state.Session, state.ChunkSize, state.Chunks, state.Sent
+			spinner.Update(fmt.Sprintf("resuming after %v", humanize.Bytes(uint64(sent))))
+		}
+	}
+	if session == "" {
+		created, err := createUploadSession(uri(routes.CreateUpload))
+		if err != nil {
+			return "", "", err
+		}
+		if created == nil {
+			return completeRequest(sendRequest("POST", uri(routes.CreateObject), body))
+		}
+		session = created.Session
+		chunkSize = int64(uploadChunkSize)
+		if created.MaxChunkSize > 0 && created.MaxChunkSize < chunkSize {
+			chunkSize = created.MaxChunkSize
+		}
+		if state != nil {
+			state.Session, state.ChunkSize = session, chunkSize
+			state.Chunks, state.Sent, state.Digest = 0, 0, nil
+			if err := state.save(); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	// a saved upload is left for a later run to resume
+	giveUp := func() {
+		if state == nil {
+			discardUploadSession(uri(routes.UploadWithSession(session)))
+		}
+	}
+
+	chunk := make([]byte, chunkSize)
+	for ; ; index++ {
+		n, err := io.ReadFull(body, chunk)
+		if err == io.EOF {
+			break
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			giveUp()
+			return "", "", err
+		}
+		if err := sendChunk(uri, session, index, chunk[:n]); err != nil {
+			giveUp()
+			return "", "", err
+		}
+		digest.Write(chunk[:n])
+		sent += int64(n)
+		if state != nil {
+			state.Chunks, state.Sent, state.Digest = index+1, sent, digest.Sum(nil)
+			if err := state.save(); err != nil {
+				return "", "", err
+			}
+		}
+		spinner.Update(fmt.Sprintf("sent %v", humanize.Bytes(uint64(sent))))
+		if last {
+			break
+		}
+	}
+
+	return completeRequest(sendRequest("POST", uri(routes.CompleteUploadWithSession(session)), nil))
+}
+
+// resumeUpload skips what state records as sent from body, as long as the
+// server still holds it. It fails with errUploadChanged if body does not
+// start with what was sent.
+func resumeUpload(uri func(string) string, state *uploadState, body io.Reader, digest hash.Hash) (bool, error) {
+	sessionUri := uri(routes.UploadWithSession(state.Session))
+	status, err := getUploadStatus(sessionUri)
+	if errors.As(err, new(*uploadStatusError)) {
+		// e.g. the server removed the abandoned session
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to reach server: %w", err)
+	}
+	if status.Chunks != state.Chunks || status.Size != state.Sent {
+		discardUploadSession(sessionUri)
+		return false, nil
+	}
+	if _, err := io.CopyN(digest, body, state.Sent); err != nil {
+		return false, err
+	}
+	if !bytes.Equal(digest.Sum(nil), state.Digest) {
+		discardUploadSession(sessionUri)
+		return false, errUploadChanged
+	}
+	return true, nil
+}
+
+// uploadStateSuffix names the file kept next to the shared files while they
+// are uploaded
+const uploadStateSuffix = ".soubise-upload"
+
+// uploadState is kept next to the shared files while they are uploaded, so
+// that a later run can resume the upload. It holds what is needed to encode
+// the same archive again, the encryption key included, and is removed once
+// the upload completes.
+type uploadState struct {
+	Server   string            `json:"server"`
+	Paths    []string          `json:"paths"`
+	Key      string            `json:"key"`
+	Archive  *archive.Archive  `json:"archive"`
+	Metadata *archive.Metadata `json:"metadata"`
+
+	Session   string `json:"session,omitempty"`
+	ChunkSize int64  `json:"chunkSize,omitempty"`
+	// Chunks were acknowledged by the server, holding Sent bytes of the
+	// archive with the SHA-256 Digest
+	Chunks int    `json:"chunks,omitempty"`
+	Sent   int64  `json:"sent,omitempty"`
+	Digest []byte `json:"digest,omitempty"`
+
+	path string
+}
+
+// newUploadState describes the upload of paths, to be saved next to the first
+// of them.
+func newUploadState(server string, paths []string) (*uploadState, error) {
+	absPaths := make([]string, len(paths))
+	for i, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		absPaths[i] = absPath
+	}
+	return &uploadState{
+		Server: server,
+		Paths:  absPaths,
+		path:   absPaths[0] + uploadStateSuffix,
+	}, nil
+}
+
+// loadUploadState returns the state an earlier run saved for uploading paths
+// to server, or nil if there is none.
+func loadUploadState(server string, paths []string) *uploadState {
+	state, err := newUploadState(server, paths)
+	if err != nil {
+		return nil
+	}
+	content, err := os.ReadFile(state.path)
+	if err != nil {
+		return nil
+	}
+	saved := &uploadState{path: state.path}
+	if err := json.Unmarshal(content, saved); err != nil || saved.Archive == nil || saved.Metadata == nil {
+		return nil
+	}
+	if saved.Server != state.Server || strings.Join(saved.Paths, "\x00") != strings.Join(state.Paths, "\x00") {
+		return nil
+	}
+	return saved
+}
+
+func (s *uploadState) save() error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, content, 0600); err != nil {
+		return fmt.Errorf("unable to save upload progress: %w", err)
+	}
+	return nil
+}
+
+func (s *uploadState) remove() {
+	_ = os.Remove(s.path)
+}
+
+// createUploadSession returns nil without error if the server does not
+// support upload sessions.
+func createUploadSession(uri string) (*routes.UploadSession, error) {
+	response, err := sendRequest("POST", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach server: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, nil
+	}
+	session := &routes.UploadSession{}
+	if err := json.NewDecoder(response.Body).Decode(session); err != nil || session.Session == "" {
+		return nil, nil
+	}
+	return session, nil
+}
+
+func sendChunk(uri func(string) string, session string, index int, data []byte) error {
+	for attempt := 1; ; attempt++ {
+		err := putChunk(uri(routes.UploadChunkWithIndex(session, index)), data)
+		if err == nil {
+			return nil
+		}
+		if errors.As(err, new(*uploadStatusError)) || attempt == uploadAttempts {
+			return err
+		}
+		// the chunk may have arrived even though its response did not
+		if status, statusErr := getUploadStatus(uri(routes.UploadWithSession(session))); statusErr == nil && status.Chunks > index {
+			return nil
+		}
+		spinner.Update(fmt.Sprintf("interrupted, resending chunk %d (%v)", index, err))
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+func putChunk(uri string, data []byte) error {
+	response, err := sendRequest("PUT", uri, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusConflict, response.StatusCode >= 500:
+		// another attempt may still be in progress, or the server is
+		// temporarily unable to store the chunk
+		return fmt.Errorf("server did not accept chunk: %v", response.Status)
+	default:
+		return &uploadStatusError{status: response.Status}
+	}
+}
+
+func getUploadStatus(uri string) (*routes.UploadStatus, error) {
+	response, err := sendRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &uploadStatusError{status: response.Status}
+	}
+	status := &routes.UploadStatus{}
+	if err := json.NewDecoder(response.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// discardUploadSession lets the server remove the chunks of an upload which
+// is given up, it would otherwise do so once the session is abandoned.
+func discardUploadSession(uri string) {
+	if response, err := sendRequest("DELETE", uri, nil); err == nil {
+		response.Body.Close()
+	}
+}
+
+// completeRequest reads the id and owner key from the response to a request
+// which stored an archive.
+func completeRequest(response *http.Response, err error) (string, string, error) {
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return "", "", &uploadStatusError{status: response.Status}
+	}
+	rawBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read response from server: %w", err)
+	}
+	return string(rawBody), response.Header.Get(routes.OwnerKeyHeader), nil
+}
+
+func sendRequest(method, uri string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compose request to server: %w", err)
+	}
+	request.Header.Set("User-Agent", fmt.Sprintf("Soubise/%v", buildinfo.Version))
+	if body != nil {
+		request.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	client := &http.Client{}
+	return client.Do(request)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/spinner"
+)
+
+// interruptingHandler hijacks the connection of the first chunk request once
+// the chunk has been handled, as if the network failed before the response
+// arrived.
+type interruptingHandler struct {
+	http.Handler
+	interrupted bool
+}
+
+func (h *interruptingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" || h.interrupted {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	h.interrupted = true
+	h.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestUploadResumes(t *testing.T) {
+	spinner.Disable()
+	content := bytes.Repeat([]byte("quick brown fox "), uploadChunkSize/8)
+
+	var stored []byte
+	chunks := map[string][]byte{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"session":"session","maxChunkSize":16777216}`))
+	})
+	mux.HandleFunc("/api/v1/upload/session/", func(w http.ResponseWriter, r *http.Request) {
+		switch index := strings.TrimPrefix(r.URL.Path, "/api/v1/upload/session/"); {
+		case r.Method == "PUT":
+			chunks[index], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		case index == "complete":
+			for i := 0; i < len(chunks); i++ {
+				stored = append(stored, chunks[strconv.Itoa(i)]...)
+			}
+			w.Header().Set("Soubise-Owner-Key", "owner")
+			_, _ = w.Write([]byte("object"))
+		}
+	})
+	mux.HandleFunc("/api/v1/upload/session", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"chunks":` + strconv.Itoa(len(chunks)) + `}`))
+	})
+	server := httptest.NewServer(&interruptingHandler{Handler: mux})
+	defer server.Close()
+
+	id, ownerKey, err := upload(server.URL, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "object" || ownerKey != "owner" {
+		t.Fatalf("expected object with owner key, received %q and %q", id, ownerKey)
+	}
+	if len(chunks) != 2 || !bytes.Equal(stored, content) {
+		t.Fatalf("expected content in 2 chunks, received %d chunks of %d bytes", len(chunks), len(stored))
+	}
+}
+
+func TestUploadWithoutSessions(t *testing.T) {
+	spinner.Disable()
+	content := []byte("quick brown fox")
+	var stored []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/obj/create" {
+			stored, _ = io.ReadAll(r.Body)
+			_, _ = w.Write([]byte("object"))
+			return
+		}
+		_, _ = w.Write([]byte("soubise"))
+	}))
+	defer server.Close()
+
+	id, _, err := upload(server.URL, bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "object" || !bytes.Equal(stored, content) {
+		t.Fatalf("expected content to be stored in a single request, received %q", stored)
+	}
+}
+
+func TestUploadResumesAcrossRuns(t *testing.T) {
+	spinner.Disable()
+	content := bytes.Repeat([]byte("quick brown fox "), uploadChunkSize/8)
+
+	chunks := map[int][]byte{}
+	failChunk, puts := 1, 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/upload", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"session":"session","maxChunkSize":16777216}`))
+	})
+	mux.HandleFunc("/api/v1/upload/session/", func(w http.ResponseWriter, r *http.Request) {
+		switch index := strings.TrimPrefix(r.URL.Path, "/api/v1/upload/session/"); {
+		case r.Method == "PUT":
+			puts++
+			i, _ := strconv.Atoi(index)
+			if i == failChunk {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			chunks[i], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+		case index == "complete":
+			var stored []byte
+			for i := 0; i < len(chunks); i++ {
+				stored = append(stored, chunks[i]...)
+			}
+			if !bytes.Equal(stored, content) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, _ = w.Write([]byte("object"))
+		}
+	})
+	mux.HandleFunc("/api/v1/upload/session", func(w http.ResponseWriter, r *http.Request) {
+		size := 0
+		for _, chunk := range chunks {
+			size += len(chunk)
+		}
+		_, _ = w.Write([]byte(`{"chunks":` + strconv.Itoa(len(chunks)) + `,"size":` + strconv.Itoa(size) + `}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	paths := []string{filepath.Join(t.TempDir(), "fox.txt")}
+	state, err := newUploadState(server.URL, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Archive, state.Metadata = &archive.Archive{}, &archive.Metadata{}
+	if _, _, err := upload(server.URL, bytes.NewReader(content), state); err == nil {
+		t.Fatal("expected upload to fail")
+	}
+
+	// a later run
+	state = loadUploadState(server.URL, paths)
+	if state == nil || state.Chunks != 1 {
+		t.Fatalf("expected progress to be saved, received %+v", state)
+	}
+	failChunk = -1
+	changed := bytes.Repeat([]byte("lazy dog "), uploadChunkSize/4)
+	if _, _, err := upload(server.URL, bytes.NewReader(changed), state); !errors.Is(err, errUploadChanged) {
+		t.Fatalf("expected a different archive not to be resumed, received %v", err)
+	}
+
+	puts = 0
+	id, _, err := upload(server.URL, bytes.NewReader(content), loadUploadState(server.URL, paths))
+	if err != nil || id != "object" {
+		t.Fatalf("expected upload to be resumed, received %q (%v)", id, err)
+	}
+	if puts != 1 {
+		t.Fatalf("expected only the remaining chunk to be sent, received %d", puts)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+func Validate(algorithm string) error {
+	switch algorithm {
+	case None, Gzip, Zstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected one of %s, %s, %s", algorithm, Zstd, Gzip, None)
+}
+
+// NewWriter compresses everything written to it into dest, Close must be
+// called to flush it. It does not close dest.
+func NewWriter(algorithm string, dest io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case None, "":
+		return nopWriteCloser{dest}, nil
+	case Gzip:
+		return gzip.NewWriter(dest), nil
+	case Zstd:
+		return zstd.NewWriter(dest)
+	}
+	return nil, Validate(algorithm)
+}
+
+func NewReader(algorithm string, source io.Reader) (io.ReadCloser, error) {
+	switch algorithm {
+	case None, "":
+		return io.NopCloser(source), nil
+	case Gzip:
+		return gzip.NewReader(source)
+	case Zstd:
+		decoder, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, Validate(algorithm)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+var compressedTypes = map[string]bool{
+	"application/gzip":                        true,
+	"application/x-gzip":                      true,
+	"application/zstd":                        true,
+	"application/x-bzip2":                     true,
+	"application/x-xz":                        true,
+	"application/x-7z-compressed":             true,
+	"application/zip":                         true,
+	"application/x-zip-compressed":            true,
+	"application/vnd.rar":                     true,
+	"application/x-rar-compressed":            true,
+	"application/java-archive":                true,
+	"application/vnd.android.package-archive": true,
+	"application/epub+zip":                    true,
+	"image/jpeg":                              true,
+	"image/png":                               true,
+	"image/gif":                               true,
+	"image/webp":                              true,
+	"image/avif":                              true,
+	"image/heic":                              true,
+}
+
+// IsCompressed reports whether content of the given MIME type is already
+// compressed, such that compressing it again is a waste of time.
+func IsCompressed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") {
+		return true
+	}
+	// office documents are zip files underneath
+	if strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument.") {
+		return true
+	}
+	return compressedTypes[mediaType]
+}
@@ -0,0 +1,79 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compression
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	plain := bytes.Repeat([]byte("timestamp,level,message\n"), 4096)
+
+	for _, algorithm := range []string{None, Gzip, Zstd} {
+		var compressed bytes.Buffer
+		w, err := NewWriter(algorithm, &compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(plain); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if algorithm != None && compressed.Len() >= len(plain)/10 {
+			t.Fatalf("%s: expected repetitive content to shrink, received %d bytes from %d", algorithm, compressed.Len(), len(plain))
+		}
+
+		r, err := NewReader(algorithm, &compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if !bytes.Equal(received, plain) {
+			t.Fatalf("%s: decompressed content does not match", algorithm)
+		}
+	}
+
+	if _, err := NewWriter("lzma", io.Discard); err == nil {
+		t.Fatal("expected unknown algorithm to be rejected")
+	}
+}
+
+func TestIsCompressed(t *testing.T) {
+	cases := map[string]bool{
+		"image/jpeg":               true,
+		"video/mp4":                true,
+		"application/zip":          true,
+		"application/gzip":         true,
+		"text/csv; charset=utf-8":  false,
+		"text/plain":               false,
+		"application/octet-stream": false,
+		"":                         false,
+	}
+	for contentType, expected := range cases {
+		if IsCompressed(contentType) != expected {
+			t.Fatalf("expected IsCompressed(%q) to be %v", contentType, expected)
+		}
+	}
+}
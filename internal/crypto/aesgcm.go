@@ -24,10 +24,12 @@ import (
 
 const keyByteLength = 44 // encryption key and nonce
 
-func GenerateKey() *Base64Data {
+func GenerateKey() (*Base64Data, error) {
 	return RandLen(keyByteLength)
 }
 
+// EncryptBlob seals blob in a single AES-GCM operation, which requires the
+// whole content in memory. New content should use NewEncryptWriter instead.
 func EncryptBlob(blob []byte, key *Base64Data) (*[]byte, error) {
 	compoundKey := key.Bytes()
 	if len(compoundKey) != keyByteLength {
@@ -51,6 +53,8 @@ func EncryptBlob(blob []byte, key *Base64Data) (*[]byte, error) {
 	return &encrypted, nil
 }
 
+// DecryptBlob opens content sealed by EncryptBlob, as found in archives which
+// were created before content was streamed.
 func DecryptBlob(blob []byte, key *Base64Data) (*[]byte, error) {
 	compoundKey := key.Bytes()
 	if len(compoundKey) != keyByteLength {
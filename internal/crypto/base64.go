@@ -18,15 +18,8 @@ package crypto
 
 import (
 	"encoding/base64"
-	"math"
-	"math/rand"
-	"time"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 type Base64Data struct {
 	data []byte
 }
@@ -39,14 +32,6 @@ func (b *Base64Data) String() string {
 	return base64.URLEncoding.EncodeToString(b.data)
 }
 
-func RandLen(length int) *Base64Data {
-	values := make([]byte, length)
-	for i := range values {
-		values[i] = uint8(rand.Intn(math.MaxUint8))
-	}
-	return &Base64Data{data: values}
-}
-
 func Base64FromString(str string) (*Base64Data, error) {
 	values, err := base64.URLEncoding.DecodeString(str)
 	if err != nil {
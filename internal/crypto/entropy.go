@@ -0,0 +1,57 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	entropyMu     sync.Mutex
+	entropySource io.Reader = rand.Reader
+)
+
+// SetEntropySource replaces the source of every key and identifier generated
+// by this package, which is crypto/rand unless told otherwise. It exists for
+// tests which require deterministic output, and returns a function restoring
+// the previous source.
+func SetEntropySource(source io.Reader) (restore func()) {
+	entropyMu.Lock()
+	previous := entropySource
+	entropySource = source
+	entropyMu.Unlock()
+
+	return func() {
+		entropyMu.Lock()
+		entropySource = previous
+		entropyMu.Unlock()
+	}
+}
+
+func RandLen(length int) (*Base64Data, error) {
+	values := make([]byte, length)
+
+	entropyMu.Lock()
+	defer entropyMu.Unlock()
+	if _, err := io.ReadFull(entropySource, values); err != nil {
+		return nil, fmt.Errorf("reading from entropy source: %w", err)
+	}
+	return &Base64Data{data: values}, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEntropySource(t *testing.T) {
+	seed := bytes.Repeat([]byte{0x5b}, keyByteLength)
+	restore := SetEntropySource(bytes.NewReader(seed))
+	defer restore()
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key.Bytes(), seed) {
+		t.Fatalf("expected key %x from injected source, received %x", seed, key.Bytes())
+	}
+
+	if _, err := RandLen(1); err == nil {
+		t.Fatal("expected exhausted entropy source to fail")
+	}
+}
+
+func TestEntropyDefaultSource(t *testing.T) {
+	first, err := RandLen(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := RandLen(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("expected distinct values from default entropy source")
+	}
+}
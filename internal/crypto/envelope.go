@@ -0,0 +1,54 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"fmt"
+)
+
+// envelopeSegment marks the nonce of the metadata envelope, which shares its
+// key with the content stream but can never collide with a segment nonce.
+const envelopeSegment = 0x02
+
+// SealEnvelope encrypts a small blob of metadata alongside content which is
+// encrypted with the same key through NewEncryptWriter.
+func SealEnvelope(plain []byte, key *Base64Data) ([]byte, error) {
+	c, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, c.envelopeNonce(), plain, nil), nil
+}
+
+func OpenEnvelope(sealed []byte, key *Base64Data) ([]byte, error) {
+	c, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := c.aead.Open(nil, c.envelopeNonce(), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failure on envelope: %w", err)
+	}
+	return plain, nil
+}
+
+func (s *streamCipher) envelopeNonce() []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.noncePrefix)
+	nonce[len(nonce)-1] = envelopeSegment
+	return nonce
+}
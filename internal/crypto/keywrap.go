@@ -0,0 +1,89 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+)
+
+// KeyWrap carries the content encryption key sealed with a key encryption key,
+// which allows archives to be decrypted without the content key being part of
+// the ClaimTag. Kind determines how the key encryption key is derived, fields
+// which are irrelevant to a Kind are left empty.
+type KeyWrap struct {
+	Kind string
+
+	// passphrase parameters
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+
+	// recipient parameters
+	EphemeralKey []byte
+
+	Nonce  []byte
+	Sealed []byte
+}
+
+var ErrUnwrapKey = errors.New("unable to unwrap encryption key")
+
+func sealKey(kek []byte, key *Base64Data) (nonce []byte, sealed []byte, err error) {
+	aesgcm, err := newKeyCipher(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	random, err := RandLen(aesgcm.NonceSize())
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = random.Bytes()
+	return nonce, aesgcm.Seal(nil, nonce, key.Bytes(), nil), nil
+}
+
+func openKey(kek []byte, nonce []byte, sealed []byte) (*Base64Data, error) {
+	aesgcm, err := newKeyCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aesgcm.NonceSize() {
+		return nil, fmt.Errorf("%w: malformed nonce", ErrUnwrapKey)
+	}
+	key, err := aesgcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrUnwrapKey
+	}
+	if len(key) != keyByteLength {
+		return nil, fmt.Errorf("%w: malformed key", ErrUnwrapKey)
+	}
+	return &Base64Data{data: key}, nil
+}
+
+func newKeyCipher(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("initiating cipher block: %w", err)
+	}
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("initiating AED cipher block: %w", err)
+	}
+	return aesgcm, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const PassphraseKeyWrap = "argon2id"
+
+// Argon2id parameters used for new archives, following the second recommended
+// option of RFC 9106 with a higher number of passes.
+const (
+	passphraseTime    = 3
+	passphraseMemory  = 64 * 1024 // KiB
+	passphraseThreads = 4
+	passphraseSalt    = 16
+	kekLength         = 32
+
+	// parameters are read from untrusted archives, refuse anything which
+	// would make unwrapping unreasonably expensive
+	maxPassphraseTime   = 16
+	maxPassphraseMemory = 1024 * 1024 // KiB
+)
+
+func WrapWithPassphrase(key *Base64Data, passphrase []byte) (*KeyWrap, error) {
+	salt, err := RandLen(passphraseSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	wrap := &KeyWrap{
+		Kind:    PassphraseKeyWrap,
+		Salt:    salt.Bytes(),
+		Time:    passphraseTime,
+		Memory:  passphraseMemory,
+		Threads: passphraseThreads,
+	}
+	wrap.Nonce, wrap.Sealed, err = sealKey(wrap.passphraseKek(passphrase), key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping key with passphrase: %w", err)
+	}
+	return wrap, nil
+}
+
+func (k *KeyWrap) UnwrapWithPassphrase(passphrase []byte) (*Base64Data, error) {
+	if k.Kind != PassphraseKeyWrap {
+		return nil, fmt.Errorf("%w: key is not wrapped with a passphrase", ErrUnwrapKey)
+	}
+	if k.Time == 0 || k.Time > maxPassphraseTime || k.Memory > maxPassphraseMemory || k.Threads == 0 {
+		return nil, fmt.Errorf("%w: unsupported passphrase parameters", ErrUnwrapKey)
+	}
+	key, err := openKey(k.passphraseKek(passphrase), k.Nonce, k.Sealed)
+	if err == ErrUnwrapKey {
+		return nil, fmt.Errorf("%w: wrong passphrase", ErrUnwrapKey)
+	}
+	return key, err
+}
+
+func (k *KeyWrap) passphraseKek(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, k.Salt, k.Time, k.Memory, k.Threads, kekLength)
+}
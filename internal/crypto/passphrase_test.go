@@ -0,0 +1,52 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPassphraseWrap(t *testing.T) {
+	key := mustGenerateKey(t)
+
+	wrap, err := WrapWithPassphrase(key, []byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrap.Sealed, key.Bytes()) {
+		t.Fatal("wrapped key contains the plain key")
+	}
+
+	unwrapped, err := wrap.UnwrapWithPassphrase([]byte("correct horse battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped.Bytes(), key.Bytes()) {
+		t.Fatal("unwrapped key does not match original key")
+	}
+
+	if _, err := wrap.UnwrapWithPassphrase([]byte("incorrect horse")); !errors.Is(err, ErrUnwrapKey) {
+		t.Fatalf("expected wrong passphrase to fail with ErrUnwrapKey, received %v", err)
+	}
+
+	wrap.Memory = maxPassphraseMemory + 1
+	if _, err := wrap.UnwrapWithPassphrase([]byte("correct horse battery staple")); !errors.Is(err, ErrUnwrapKey) {
+		t.Fatalf("expected excessive parameters to be refused, received %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const RecipientKeyWrap = "x25519"
+
+const (
+	PublicKeyPrefix = "soubise-pub:"
+	IdentityPrefix  = "soubise-identity:"
+
+	recipientInfo = "soubise x25519 key wrap"
+)
+
+// PublicKey is the X25519 public key of a recipient, which encryption keys
+// can be wrapped to.
+type PublicKey struct {
+	key []byte
+}
+
+// Identity is the X25519 private key of a recipient, which unwraps encryption
+// keys wrapped to its PublicKey.
+type Identity struct {
+	key []byte
+}
+
+func GenerateIdentity() (*Identity, error) {
+	random, err := RandLen(curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: random.Bytes()}, nil
+}
+
+func ParseIdentity(s string) (*Identity, error) {
+	key, err := parsePrefixed(IdentityPrefix, s, curve25519.ScalarSize)
+	if err != nil {
+		return nil, fmt.Errorf("malformed identity: %w", err)
+	}
+	return &Identity{key: key}, nil
+}
+
+func (i *Identity) PublicKey() *PublicKey {
+	key, err := curve25519.X25519(i.key, curve25519.Basepoint)
+	if err != nil {
+		// only possible with a malformed scalar, which ParseIdentity refuses
+		panic(err)
+	}
+	return &PublicKey{key: key}
+}
+
+func (i *Identity) String() string {
+	return IdentityPrefix + base64.RawURLEncoding.EncodeToString(i.key)
+}
+
+func ParsePublicKey(s string) (*PublicKey, error) {
+	key, err := parsePrefixed(PublicKeyPrefix, s, curve25519.PointSize)
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %w", err)
+	}
+	return &PublicKey{key: key}, nil
+}
+
+func (p *PublicKey) String() string {
+	return PublicKeyPrefix + base64.RawURLEncoding.EncodeToString(p.key)
+}
+
+func parsePrefixed(prefix string, s string, size int) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("expected %v prefix", prefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("expected %d bytes, received %d", size, len(key))
+	}
+	return key, nil
+}
+
+// WrapForRecipient seals key with a key encryption key agreed between a fresh
+// ephemeral key and the recipient, only the recipient's Identity can unwrap it.
+func WrapForRecipient(key *Base64Data, recipient *PublicKey) (*KeyWrap, error) {
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral.key, recipient.key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping key for recipient: %w", err)
+	}
+
+	wrap := &KeyWrap{
+		Kind:         RecipientKeyWrap,
+		EphemeralKey: ephemeral.PublicKey().key,
+	}
+	kek, err := recipientKek(shared, wrap.EphemeralKey, recipient.key)
+	if err != nil {
+		return nil, err
+	}
+	wrap.Nonce, wrap.Sealed, err = sealKey(kek, key)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping key for recipient: %w", err)
+	}
+	return wrap, nil
+}
+
+func (k *KeyWrap) UnwrapWithIdentity(identity *Identity) (*Base64Data, error) {
+	if k.Kind != RecipientKeyWrap {
+		return nil, fmt.Errorf("%w: key is not wrapped for a recipient", ErrUnwrapKey)
+	}
+	shared, err := curve25519.X25519(identity.key, k.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed ephemeral key", ErrUnwrapKey)
+	}
+	kek, err := recipientKek(shared, k.EphemeralKey, identity.PublicKey().key)
+	if err != nil {
+		return nil, err
+	}
+	key, err := openKey(kek, k.Nonce, k.Sealed)
+	if err == ErrUnwrapKey {
+		return nil, fmt.Errorf("%w: key is wrapped for another recipient", ErrUnwrapKey)
+	}
+	return key, err
+}
+
+func recipientKek(shared []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeral)+len(recipient))
+	salt = append(salt, ephemeral...)
+	salt = append(salt, recipient...)
+
+	kek := make([]byte, kekLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientInfo)), kek); err != nil {
+		return nil, fmt.Errorf("deriving key encryption key: %w", err)
+	}
+	return kek, nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRecipientWrap(t *testing.T) {
+	key := mustGenerateKey(t)
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrap, err := WrapForRecipient(key, identity.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrap.Sealed, key.Bytes()) {
+		t.Fatal("wrapped key contains the plain key")
+	}
+
+	unwrapped, err := wrap.UnwrapWithIdentity(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped.Bytes(), key.Bytes()) {
+		t.Fatal("unwrapped key does not match original key")
+	}
+
+	if _, err := wrap.UnwrapWithIdentity(stranger); !errors.Is(err, ErrUnwrapKey) {
+		t.Fatalf("expected other identity to fail with ErrUnwrapKey, received %v", err)
+	}
+
+	wrap.EphemeralKey = make([]byte, len(wrap.EphemeralKey))
+	if _, err := wrap.UnwrapWithIdentity(identity); !errors.Is(err, ErrUnwrapKey) {
+		t.Fatalf("expected low order ephemeral key to be refused, received %v", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedIdentity, err := ParseIdentity(identity.String() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedIdentity.String() != identity.String() {
+		t.Fatalf("expected identity %v, received %v", identity, parsedIdentity)
+	}
+
+	publicKey := identity.PublicKey()
+	parsedPublicKey, err := ParsePublicKey(publicKey.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedPublicKey.String() != publicKey.String() {
+		t.Fatalf("expected public key %v, received %v", publicKey, parsedPublicKey)
+	}
+
+	for _, malformed := range []string{
+		"",
+		publicKey.String(),
+		IdentityPrefix + "c2hvcnQ",
+		IdentityPrefix + "!!!",
+	} {
+		if _, err := ParseIdentity(malformed); err == nil {
+			t.Fatalf("expected %q to be refused as identity", malformed)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+const (
+	SigningKeyPrefix   = "soubise-signing:"
+	VerifyingKeyPrefix = "soubise-verify:"
+
+	SignatureSize = ed25519.SignatureSize
+)
+
+// SigningKey is the Ed25519 private key of a sender, which signs archives.
+type SigningKey struct {
+	key ed25519.PrivateKey
+}
+
+// VerifyingKey is the Ed25519 public key of a sender, which recipients trust
+// to verify archives signed by its SigningKey.
+type VerifyingKey struct {
+	key ed25519.PublicKey
+}
+
+func GenerateSigningKey() (*SigningKey, error) {
+	seed, err := RandLen(ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{key: ed25519.NewKeyFromSeed(seed.Bytes())}, nil
+}
+
+func ParseSigningKey(s string) (*SigningKey, error) {
+	seed, err := parsePrefixed(SigningKeyPrefix, s, ed25519.SeedSize)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signing key: %w", err)
+	}
+	return &SigningKey{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (s *SigningKey) String() string {
+	return SigningKeyPrefix + base64.RawURLEncoding.EncodeToString(s.key.Seed())
+}
+
+func (s *SigningKey) VerifyingKey() *VerifyingKey {
+	return &VerifyingKey{key: s.key.Public().(ed25519.PublicKey)}
+}
+
+func (s *SigningKey) Sign(message []byte) []byte {
+	return ed25519.Sign(s.key, message)
+}
+
+func ParseVerifyingKey(s string) (*VerifyingKey, error) {
+	key, err := parsePrefixed(VerifyingKeyPrefix, s, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("malformed verifying key: %w", err)
+	}
+	return &VerifyingKey{key: key}, nil
+}
+
+// VerifyingKeyFromBytes is the counterpart of Bytes, used to decode keys
+// embedded in archives.
+func VerifyingKeyFromBytes(key []byte) (*VerifyingKey, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("malformed verifying key: expected %d bytes, received %d", ed25519.PublicKeySize, len(key))
+	}
+	return &VerifyingKey{key: key}, nil
+}
+
+func (v *VerifyingKey) Bytes() []byte {
+	return v.key
+}
+
+func (v *VerifyingKey) String() string {
+	return VerifyingKeyPrefix + base64.RawURLEncoding.EncodeToString(v.key)
+}
+
+func (v *VerifyingKey) Equal(other *VerifyingKey) bool {
+	return other != nil && v.key.Equal(other.key)
+}
+
+func (v *VerifyingKey) Verify(message []byte, signature []byte) bool {
+	return ed25519.Verify(v.key, message, signature)
+}
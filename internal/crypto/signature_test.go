@@ -0,0 +1,45 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import "testing"
+
+func TestSigningKey(t *testing.T) {
+	signer, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigningKey(signer.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := ParseVerifyingKey(signer.VerifyingKey().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifier.Equal(parsed.VerifyingKey()) {
+		t.Fatal("parsed signing key does not match original key")
+	}
+
+	signature := parsed.Sign([]byte("message"))
+	if !verifier.Verify([]byte("message"), signature) {
+		t.Fatal("expected signature to verify")
+	}
+	if verifier.Verify([]byte("massage"), signature) {
+		t.Fatal("expected signature of another message to be refused")
+	}
+}
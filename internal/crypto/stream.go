@@ -0,0 +1,237 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Content is encrypted in segments following the STREAM construction: every
+// segment is sealed with its own nonce, composed of a prefix taken from the
+// key material, a segment counter and a flag marking the final segment. This
+// allows encryption and decryption in constant memory while still detecting
+// truncation, reordering and tampering of segments.
+const (
+	SegmentSize = 64 * 1024
+
+	noncePrefixLength = 7
+	lastSegment       = 0x01
+)
+
+var (
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	ErrStreamOverflow  = errors.New("encrypted stream exceeded maximum segment count")
+	ErrStreamClosed    = errors.New("encrypted stream is already closed")
+)
+
+type streamCipher struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	counter     uint32
+	overflow    bool
+}
+
+func newStreamCipher(key *Base64Data) (*streamCipher, error) {
+	compoundKey := key.Bytes()
+	if len(compoundKey) != keyByteLength {
+		return nil, fmt.Errorf("malformed key")
+	}
+
+	block, err := aes.NewCipher(compoundKey[0:32])
+	if err != nil {
+		return nil, fmt.Errorf("initiating cipher block: %w", err)
+	}
+
+	aesgcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("initiating AED cipher block: %w", err)
+	}
+
+	return &streamCipher{
+		aead:        aesgcm,
+		noncePrefix: compoundKey[32 : 32+noncePrefixLength],
+	}, nil
+}
+
+func (s *streamCipher) nonce(last bool) ([]byte, error) {
+	if s.overflow {
+		return nil, ErrStreamOverflow
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.noncePrefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLength:], s.counter)
+	if last {
+		nonce[len(nonce)-1] = lastSegment
+	}
+	s.counter++
+	if s.counter == 0 {
+		s.overflow = true
+	}
+	return nonce, nil
+}
+
+type encryptWriter struct {
+	cipher *streamCipher
+	dest   io.Writer
+	buf    []byte
+	sealed []byte
+	closed bool
+}
+
+// NewEncryptWriter returns a WriteCloser which encrypts everything written to
+// it into dest. Close must be called to flush the final segment, it does not
+// close dest.
+func NewEncryptWriter(dest io.Writer, key *Base64Data) (io.WriteCloser, error) {
+	c, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		cipher: c,
+		dest:   dest,
+		buf:    make([]byte, 0, SegmentSize),
+		sealed: make([]byte, 0, SegmentSize+c.aead.Overhead()),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, ErrStreamClosed
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only flushed once more data arrives, since the
+		// final segment has to be sealed differently
+		if len(e.buf) == SegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):SegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return ErrStreamClosed
+	}
+	e.closed = true
+	return e.flush(true)
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	nonce, err := e.cipher.nonce(last)
+	if err != nil {
+		return err
+	}
+	e.sealed = e.cipher.aead.Seal(e.sealed[:0], nonce, e.buf, nil)
+	e.buf = e.buf[:0]
+	if _, err := e.dest.Write(e.sealed); err != nil {
+		return fmt.Errorf("writing encrypted segment: %w", err)
+	}
+	return nil
+}
+
+type decryptReader struct {
+	cipher *streamCipher
+	source *bufio.Reader
+	sealed []byte
+	plain  []byte
+	offset int
+	done   bool
+	err    error
+}
+
+// NewDecryptReader returns a Reader which decrypts the stream produced by
+// NewEncryptWriter. Each segment is authenticated before any of its content is
+// returned, a stream which ends before its final segment yields
+// ErrStreamTruncated.
+func NewDecryptReader(source io.Reader, key *Base64Data) (io.Reader, error) {
+	c, err := newStreamCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		cipher: c,
+		source: bufio.NewReader(source),
+		sealed: make([]byte, SegmentSize+c.aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for d.offset == len(d.plain) {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.plain[d.offset:])
+	d.offset += n
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.source, d.sealed)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.source.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return ErrStreamTruncated
+	default:
+		return err
+	}
+
+	nonce, err := d.cipher.nonce(last)
+	if err != nil {
+		return err
+	}
+	plain, err := d.cipher.aead.Open(d.plain[:0], nonce, d.sealed[:n], nil)
+	if err != nil {
+		if last {
+			// segments only end early on the final one, anything else means
+			// the stream was cut short or tampered with
+			return fmt.Errorf("decryption failure on final segment: %w", err)
+		}
+		return fmt.Errorf("decryption failure on segment %d: %w", d.cipher.counter-1, err)
+	}
+	d.plain = plain
+	d.offset = 0
+	d.done = last
+	return nil
+}
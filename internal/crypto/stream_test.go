@@ -0,0 +1,95 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func mustGenerateKey(t *testing.T) *Base64Data {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encryptStream(t *testing.T, plain []byte, key *Base64Data) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewEncryptWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := mustGenerateKey(t)
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		plain := bytes.Repeat([]byte("soubise"), size/7+1)[:size]
+		sealed := encryptStream(t, plain, key)
+
+		r, err := NewDecryptReader(bytes.NewReader(sealed), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(received, plain) {
+			t.Fatalf("size %d: decrypted content does not match", size)
+		}
+	}
+}
+
+func TestStreamRejectsTampering(t *testing.T) {
+	key := mustGenerateKey(t)
+	plain := bytes.Repeat([]byte{0x42}, 2*SegmentSize+5)
+	sealed := encryptStream(t, plain, key)
+	overhead := len(sealed) - len(plain)
+	segment := overhead / 3
+
+	cases := map[string][]byte{
+		"flipped bit":     append(append([]byte{}, sealed[:10]...), append([]byte{sealed[10] ^ 0x01}, sealed[11:]...)...),
+		"truncated":       sealed[:len(sealed)-1],
+		"dropped final":   sealed[:2*(SegmentSize+segment)],
+		"dropped segment": append(append([]byte{}, sealed[:SegmentSize+segment]...), sealed[2*(SegmentSize+segment):]...),
+		"empty":           {},
+		"other key":       encryptStream(t, plain, mustGenerateKey(t)),
+	}
+
+	for name, tampered := range cases {
+		r, err := NewDecryptReader(bytes.NewReader(tampered), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Fatalf("%s: expected decryption to fail", name)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package migrate copies archives which are still downloadable between storage
+// backends, keeping their ids so that claim tags keep working.
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+type Options struct {
+	// DryRun reports what would be migrated without writing anything
+	DryRun bool
+}
+
+type Report struct {
+	// Migrated archives were copied, or would be copied in a dry run
+	Migrated int
+	// Present archives were already copied by an earlier migration
+	Present int
+	// Expired archives are no longer downloadable and are left behind
+	Expired int
+	// Failed archives could not be copied, migrating again retries them
+	Failed int
+	// Bytes of archives copied, or to be copied in a dry run
+	Bytes int64
+}
+
+// Migrate copies every archive which has not expired from one backend to the
+// other, along with its Metadata. Archives are verified by their checksum once
+// copied, and ones already present are not copied again, so that an
+// interrupted migration can be resumed by running it again.
+//
+// Metadata is copied on every run, the source should no longer be served by
+// the time of the last run to carry over downloads counted since.
+func Migrate(ctx context.Context, from, to storage.Storage, opts Options) (*Report, error) {
+	report := &Report{}
+	var ids []string
+	err := from.List(ctx, "", func(id string) error {
+		// Metadata is migrated along with its archive, and uploads in progress
+		// do not survive switching servers
+		if storage.IsValidId(id) {
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing archives: %w", err)
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := migrate(from, to, id, opts, report); err != nil {
+			report.Failed++
+			log.Error().Err(err).Str("Id", id).Msg("migrating archive")
+		}
+	}
+	return report, nil
+}
+
+func migrate(from, to storage.Storage, id string, opts Options, report *Report) error {
+	metadata, err := storage.GetMetadataFrom(from, id)
+	if errors.As(err, new(*storage.StorageNotFoundError)) {
+		// archives uploaded before Metadata existed
+		metadata = nil
+	} else if err != nil {
+		return fmt.Errorf("reading metadata: %w", err)
+	}
+	live, err := isLive(from, id, metadata)
+	if err != nil {
+		return err
+	}
+	if !live {
+		report.Expired++
+		log.Debug().Str("Id", id).Msg("skipping expired archive")
+		return nil
+	}
+
+	info, err := from.Stat(id)
+	if err != nil {
+		return err
+	}
+	present, err := isPresent(from, to, id, info.Size)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.DryRun && present:
+		report.Present++
+	case opts.DryRun:
+		report.Migrated++
+		report.Bytes += info.Size
+		log.Info().Str("Id", id).Int64("Size", info.Size).Msg("would migrate archive")
+	case present:
+		// downloads counted since the archive was copied
+		if metadata != nil {
+			if err := storage.PutMetadataTo(to, id, metadata); err != nil {
+				return fmt.Errorf("writing metadata: %w", err)
+			}
+		}
+		report.Present++
+		log.Debug().Str("Id", id).Msg("archive already migrated")
+	default:
+		if err := copyArchive(from, to, id, metadata); err != nil {
+			return err
+		}
+		report.Migrated++
+		report.Bytes += info.Size
+		log.Info().Str("Id", id).Int64("Size", info.Size).Msg("migrated archive")
+	}
+	return nil
+}
+
+// isLive reports whether id can still be downloaded, Metadata taking
+// precedence over the archive header.
+func isLive(from storage.Storage, id string, metadata *storage.Metadata) (bool, error) {
+	if metadata != nil {
+		if remaining, limited := metadata.RemainingDownloads(); limited && remaining == 0 {
+			return false, nil
+		}
+		return metadata.Expiry.After(time.Now()), nil
+	}
+
+	r, _, err := from.Open(id)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	storedArchive, _, err := archive.PeekArchive(r)
+	if err != nil {
+		return false, fmt.Errorf("reading archive header: %w", err)
+	}
+	return !storedArchive.HasExpired(), nil
+}
+
+// isPresent reports whether to already holds the same archive, comparing
+// archives of the same size by their checksum.
+func isPresent(from, to storage.Storage, id string, size int64) (bool, error) {
+	info, err := to.Stat(id)
+	if errors.As(err, new(*storage.StorageNotFoundError)) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if info.Size != size {
+		return false, nil
+	}
+	expected, err := checksum(from, id)
+	if err != nil {
+		return false, err
+	}
+	actual, err := checksum(to, id)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(expected, actual), nil
+}
+
+// copyArchive streams id from one backend to the other along with metadata,
+// unless it is nil, removing the copy if it does not match the checksum of
+// what was read.
+func copyArchive(from, to storage.Storage, id string, metadata *storage.Metadata) error {
+	r, _, err := from.Open(id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if metadata != nil {
+		err = storage.PutWithMetadataTo(to, id, io.TeeReader(r, h), metadata)
+	} else {
+		err = to.Put(id, io.TeeReader(r, h))
+	}
+	if err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+
+	actual, err := checksum(to, id)
+	if err != nil {
+		return fmt.Errorf("verifying archive: %w", err)
+	}
+	if !bytes.Equal(h.Sum(nil), actual) {
+		if err := storage.DeleteFrom(to, id); err != nil {
+			log.Error().Err(err).Str("Id", id).Msg("removing corrupted copy")
+		}
+		return &ChecksumMismatchError{Id: id}
+	}
+	return nil
+}
+
+func checksum(s storage.Storage, id string) ([]byte, error) {
+	r, _, err := s.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+type ChecksumMismatchError struct {
+	Id string
+}
+
+const ChecksumMismatchErrorString = "copied archive does not match its checksum"
+
+func (c *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s: %s", ChecksumMismatchErrorString, c.Id)
+}
@@ -0,0 +1,247 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/broker"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+func putArchive(t *testing.T, s storage.Storage, expiry time.Time, metadata *storage.Metadata) string {
+	t.Helper()
+	var bin bytes.Buffer
+	w, err := archive.NewWriter(&bin, &archive.Archive{Suite: archive.SuiteStreamAESGCM, Expiry: expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("jumpsoverthelazydog"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := storage.NewId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(id, &bin); err != nil {
+		t.Fatal(err)
+	}
+	if metadata != nil {
+		if err := storage.PutMetadataTo(s, id, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return id
+}
+
+func readAll(t *testing.T, s storage.Storage, id string) []byte {
+	t.Helper()
+	r, _, err := s.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soubise-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	from := storage.NewInMemoryStorage(&broker.InMemoryBroker{})
+	// stores Metadata natively, unlike the source
+	to, err := storage.NewBoltStorage(filepath.Join(dir, "soubise.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+	active := putArchive(t, from, past, &storage.Metadata{Expiry: future, MaxDownloads: 3, Downloads: 1})
+	legacy := putArchive(t, from, future, nil)
+	expired := putArchive(t, from, past, nil)
+	exhausted := putArchive(t, from, future, &storage.Metadata{Expiry: future, MaxDownloads: 1, Downloads: 1})
+	if err := from.Put("upload.0", bytes.NewReader([]byte("chunk"))); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(context.Background(), from, to, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || report.Expired != 2 || report.Bytes == 0 {
+		t.Fatalf("expected 2 archives to be migrated and 2 expired, received %+v", report)
+	}
+	if _, err := to.Stat(active); err == nil {
+		t.Fatal("expected dry run not to copy archives")
+	}
+
+	if report, err = Migrate(context.Background(), from, to, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || report.Expired != 2 || report.Failed != 0 {
+		t.Fatalf("expected 2 archives to be migrated and 2 expired, received %+v", report)
+	}
+	for _, id := range []string{active, legacy} {
+		if !bytes.Equal(readAll(t, from, id), readAll(t, to, id)) {
+			t.Fatalf("expected %s to be copied as is", id)
+		}
+	}
+	for _, id := range []string{expired, exhausted, "upload.0"} {
+		if _, err := to.Stat(id); err == nil {
+			t.Fatalf("expected %s not to be migrated", id)
+		}
+	}
+	metadata, err := storage.GetMetadataFrom(to, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Downloads != 1 || metadata.MaxDownloads != 3 || !metadata.Expiry.Equal(future) {
+		t.Fatalf("expected metadata to be migrated, received %+v", metadata)
+	}
+
+	// resuming skips archives which were already copied, unless they differ
+	content := readAll(t, to, legacy)
+	content[len(content)-1] ^= 0xff
+	if err := to.Put(legacy, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = Migrate(context.Background(), from, to, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 1 || report.Present != 1 {
+		t.Fatalf("expected 1 archive to be migrated again and 1 present, received %+v", report)
+	}
+	if !bytes.Equal(readAll(t, from, legacy), readAll(t, to, legacy)) {
+		t.Fatalf("expected %s to be copied again", legacy)
+	}
+}
+
+// failingMetadataStorage refuses to store Metadata objects
+type failingMetadataStorage struct {
+	storage.Storage
+}
+
+func (f *failingMetadataStorage) Put(id string, data io.Reader) error {
+	if strings.HasSuffix(id, ".meta") {
+		return errors.New("disk is full")
+	}
+	return f.Storage.Put(id, data)
+}
+
+// countingStorage counts how often each object is opened
+type countingStorage struct {
+	storage.Storage
+	opened map[string]int
+}
+
+func (c *countingStorage) Open(id string) (io.ReadCloser, int64, error) {
+	c.opened[id]++
+	return c.Storage.Open(id)
+}
+
+func TestMigrateResumes(t *testing.T) {
+	from := storage.NewInMemoryStorage(&broker.InMemoryBroker{})
+	to := storage.NewInMemoryStorage(&broker.InMemoryBroker{})
+	future := time.Now().Add(time.Hour)
+	active := putArchive(t, from, future, &storage.Metadata{Expiry: future, MaxDownloads: 3, Downloads: 1})
+
+	// an archive is only migrated along with its Metadata
+	report, err := Migrate(context.Background(), from, &failingMetadataStorage{Storage: to}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 0 || report.Failed != 1 {
+		t.Fatalf("expected archive to fail without its metadata, received %+v", report)
+	}
+	if _, err := to.Stat(active); err == nil {
+		t.Fatal("expected archive not to be stored without its metadata")
+	}
+
+	if report, err = Migrate(context.Background(), from, to, Options{}); err != nil || report.Migrated != 1 {
+		t.Fatalf("expected archive to be migrated, received %+v (%v)", report, err)
+	}
+	if err := storage.PutMetadataTo(from, active, &storage.Metadata{Expiry: future, MaxDownloads: 3, Downloads: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// resuming verifies archives which were already copied instead of
+	// copying them again, without losing downloads counted since
+	counting := &countingStorage{Storage: to, opened: map[string]int{}}
+	if report, err = Migrate(context.Background(), from, counting, Options{}); err != nil || report.Present != 1 {
+		t.Fatalf("expected archive to be present, received %+v (%v)", report, err)
+	}
+	if counting.opened[active] != 1 {
+		t.Fatalf("expected present archive to be read once for its checksum, opened %d times", counting.opened[active])
+	}
+	if metadata, err := storage.GetMetadataFrom(to, active); err != nil || metadata.Downloads != 2 {
+		t.Fatalf("expected downloads to be carried over, received %+v (%v)", metadata, err)
+	}
+
+	// a copy of the same size along with Metadata is not taken as migrated
+	// unless its checksum matches
+	info, err := to.Stat(active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := to.Put(active, bytes.NewReader(make([]byte, info.Size))); err != nil {
+		t.Fatal(err)
+	}
+	for _, dryRun := range []bool{true, false} {
+		if report, err = Migrate(context.Background(), from, to, Options{DryRun: dryRun}); err != nil || report.Migrated != 1 {
+			t.Fatalf("expected differing copy to be migrated again (dry run %v), received %+v (%v)", dryRun, report, err)
+		}
+	}
+	if matches, err := isPresent(from, to, active, info.Size); err != nil || !matches {
+		t.Fatalf("expected copy to match once migrated again (%v)", err)
+	}
+}
+
+func TestDryRunDoesNotRepair(t *testing.T) {
+	replaced := storage.NewInMemoryStorage(&broker.InMemoryBroker{})
+	remaining := storage.NewInMemoryStorage(&broker.InMemoryBroker{})
+	future := time.Now().Add(time.Hour)
+	active := putArchive(t, remaining, future, nil)
+	from := storage.NewMirroredStorage(replaced, remaining)
+
+	report, err := Migrate(context.Background(), from, storage.NewInMemoryStorage(&broker.InMemoryBroker{}), Options{DryRun: true})
+	if err != nil || report.Migrated != 1 {
+		t.Fatalf("expected archive to be migrated, received %+v (%v)", report, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := replaced.Stat(active); err == nil {
+		t.Fatal("expected dry run not to repair the source")
+	}
+}
@@ -28,8 +28,12 @@ import (
 func NewBrokerFromPath(brokerPath string) broker.Broker {
 	var b broker.Broker
 	switch {
-	case strings.HasPrefix(brokerPath, "redis://"):
-		log.Fatal().Dict("Broker", zerolog.Dict().Str("Kind", "redis")).Msg("not implemented")
+	case strings.HasPrefix(brokerPath, "redis://"), strings.HasPrefix(brokerPath, "rediss://"):
+		redisBroker, err := broker.NewRedisBroker(brokerPath)
+		if err != nil {
+			log.Fatal().Err(err).Dict("Broker", zerolog.Dict().Str("Kind", "redis")).Msg("broker initialization")
+		}
+		b = redisBroker
 	default:
 		b = &broker.InMemoryBroker{}
 		log.Warn().Dict("Broker", zerolog.Dict().Str("Kind", b.Kind())).
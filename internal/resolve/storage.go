@@ -17,8 +17,14 @@ limitations under the License.
 package resolve
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
@@ -33,17 +39,227 @@ func NewStorageFromPath(storagePath string, b broker.Broker) storage.Storage {
 
 	var s storage.Storage
 	switch {
+	case strings.HasPrefix(storagePath, "mirror:"):
+		paths := backendPaths(strings.TrimPrefix(storagePath, "mirror:"))
+		if len(paths) == 0 {
+			log.Fatal().Msg("mirror storage requires at least one backend")
+		}
+		backends := newStoragesFromPaths(paths, b)
+		s = storage.NewMirroredStorage(backends...)
+		log.Info().Dict("Storage", zerolog.Dict().Str("Kind", s.Kind())).
+			Int("Replicas", len(backends)).Msg("mirroring archives across backends")
+	case strings.HasPrefix(storagePath, "erasure:"):
+		data, parity, paths, err := erasurePath(storagePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid erasure storage path")
+		}
+		s, err = storage.NewErasureStorage(data, parity, newStoragesFromPaths(paths, b)...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("erasure storage initialization")
+		}
+		log.Info().Dict("Storage", zerolog.Dict().Str("Kind", s.Kind())).
+			Int("Data", data).Int("Parity", parity).Msg("erasure coding archives across backends")
+	case strings.HasPrefix(storagePath, "cache+"):
+		backendPath, budget, err := cachePath(storagePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid cache storage path")
+		}
+		s = storage.NewCachedStorage(NewStorageFromPath(backendPath, b), budget)
+		log.Info().Dict("Storage", zerolog.Dict().Str("Kind", s.Kind())).
+			Str("Size", humanize.IBytes(uint64(budget))).Msg("caching archives in memory")
 	case storagePath == "inmemory":
 		s = storage.NewInMemoryStorage(b)
 		log.Warn().Dict("Storage", zerolog.Dict().Str("Kind", s.Kind())).Msg("do NOT use in production, data is NOT persistent")
 	case strings.HasPrefix(storagePath, "file://"):
 		s = storage.NewLocalFsStorage(b, storagePath[7:])
+	case strings.HasPrefix(storagePath, "sqlite://"):
+		var err error
+		s, err = storage.NewSQLiteStorage(storagePath[9:])
+		if err != nil {
+			log.Fatal().Err(err).Msg("sqlite storage initialization")
+		}
+	case strings.HasPrefix(storagePath, "bolt://"):
+		var err error
+		s, err = storage.NewBoltStorage(storagePath[7:])
+		if err != nil {
+			log.Fatal().Err(err).Msg("bolt storage initialization")
+		}
 	case strings.HasPrefix(storagePath, "s3://"):
-		log.Fatal().Msg("s3 storage not implemented")
+		config, err := s3ConfigFromPath(storagePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid s3 storage path")
+		}
+		s, err = storage.NewS3Storage(*config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("s3 storage initialization")
+		}
 	case strings.HasPrefix(storagePath, "gcs://"):
-		log.Fatal().Msg("gcs storage not implemented")
+		config, err := gcsConfigFromPath(storagePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid gcs storage path")
+		}
+		s, err = storage.NewGCSStorage(*config)
+		if err != nil {
+			log.Fatal().Err(err).Msg("gcs storage initialization")
+		}
 	default:
 		log.Fatal().Msg("filesystem storage not implemented")
 	}
 	return s
 }
+
+// StorageExists reports whether every local file or directory storagePath
+// refers to exists, which NewStorageFromPath would create otherwise. Remote
+// storage is assumed to exist.
+func StorageExists(storagePath string) bool {
+	var paths []string
+	switch {
+	case strings.HasPrefix(storagePath, "mirror:"):
+		paths = backendPaths(strings.TrimPrefix(storagePath, "mirror:"))
+	case strings.HasPrefix(storagePath, "erasure:"):
+		_, _, erasurePaths, err := erasurePath(storagePath)
+		if err != nil {
+			return false
+		}
+		paths = erasurePaths
+	case strings.HasPrefix(storagePath, "cache+"):
+		backendPath, _, err := cachePath(storagePath)
+		if err != nil {
+			return false
+		}
+		paths = []string{backendPath}
+	case strings.HasPrefix(storagePath, "file://"), strings.HasPrefix(storagePath, "bolt://"):
+		_, err := os.Stat(storagePath[7:])
+		return err == nil
+	case strings.HasPrefix(storagePath, "sqlite://"):
+		_, err := os.Stat(storagePath[9:])
+		return err == nil
+	default:
+		return true
+	}
+	for _, backendPath := range paths {
+		if !StorageExists(backendPath) {
+			return false
+		}
+	}
+	return true
+}
+
+func newStoragesFromPaths(paths []string, b broker.Broker) []storage.Storage {
+	backends := make([]storage.Storage, len(paths))
+	for i, backendPath := range paths {
+		backends[i] = NewStorageFromPath(backendPath, b)
+	}
+	return backends
+}
+
+// backendPaths reads <backend path>,<backend path>,... skipping empty entries.
+func backendPaths(list string) []string {
+	var paths []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// erasurePath reads erasure:<data>+<parity>:<backend path>,... which requires
+// as many backends as data and parity shards.
+func erasurePath(storagePath string) (int, int, []string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(storagePath, "erasure:"), ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, nil, errors.New("expected erasure:<data>+<parity>:<backend path>,...")
+	}
+	shards := strings.SplitN(parts[0], "+", 2)
+	if len(shards) != 2 {
+		return 0, 0, nil, fmt.Errorf("expected <data>+<parity> shards, received %q", parts[0])
+	}
+	data, err := strconv.Atoi(shards[0])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("data shards: %w", err)
+	}
+	parity, err := strconv.Atoi(shards[1])
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("parity shards: %w", err)
+	}
+	paths := backendPaths(parts[1])
+	if len(paths) != data+parity {
+		return 0, 0, nil, fmt.Errorf("%d+%d shards require %d backends, received %d", data, parity, data+parity, len(paths))
+	}
+	return data, parity, paths, nil
+}
+
+// defaultCacheSize is used when a cache+ path does not specify size
+const defaultCacheSize = 256 << 20
+
+// cachePath reads cache+<backend path>?size=512MiB, returning the backend path
+// without the size parameter.
+func cachePath(storagePath string) (string, int64, error) {
+	u, err := url.Parse(strings.TrimPrefix(storagePath, "cache+"))
+	if err != nil {
+		return "", 0, err
+	}
+	query := u.Query()
+	budget := uint64(defaultCacheSize)
+	if size := query.Get("size"); size != "" {
+		if budget, err = humanize.ParseBytes(size); err != nil {
+			return "", 0, fmt.Errorf("size: %w", err)
+		}
+	}
+	query.Del("size")
+	u.RawQuery = query.Encode()
+	return u.String(), int64(budget), nil
+}
+
+// s3ConfigFromPath reads s3://bucket/prefix?endpoint=...&region=...&path-style=true
+// along with optional credentials (a shared credentials file), profile and
+// part-size (in bytes) parameters.
+func s3ConfigFromPath(storagePath string) (*storage.S3Config, error) {
+	u, err := url.Parse(storagePath)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	config := &storage.S3Config{
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		Endpoint:        query.Get("endpoint"),
+		Region:          query.Get("region"),
+		CredentialsFile: query.Get("credentials"),
+		Profile:         query.Get("profile"),
+	}
+	if pathStyle := query.Get("path-style"); pathStyle != "" {
+		if config.PathStyle, err = strconv.ParseBool(pathStyle); err != nil {
+			return nil, fmt.Errorf("path-style: %w", err)
+		}
+	}
+	if partSize := query.Get("part-size"); partSize != "" {
+		if config.PartSize, err = strconv.ParseInt(partSize, 10, 64); err != nil {
+			return nil, fmt.Errorf("part-size: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// gcsConfigFromPath reads gcs://bucket/prefix?credentials=service-account.json
+// along with optional endpoint and chunk-size (in bytes) parameters.
+func gcsConfigFromPath(storagePath string) (*storage.GCSConfig, error) {
+	u, err := url.Parse(storagePath)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	config := &storage.GCSConfig{
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		CredentialsFile: query.Get("credentials"),
+		Endpoint:        query.Get("endpoint"),
+	}
+	if chunkSize := query.Get("chunk-size"); chunkSize != "" {
+		if config.ChunkSize, err = strconv.Atoi(chunkSize); err != nil {
+			return nil, fmt.Errorf("chunk-size: %w", err)
+		}
+	}
+	return config, nil
+}
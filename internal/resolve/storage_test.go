@@ -0,0 +1,99 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resolve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCachePath(t *testing.T) {
+	for storagePath, expected := range map[string]struct {
+		backendPath string
+		budget      int64
+	}{
+		"cache+file:///data?size=512MiB":                  {"file:///data", 512 << 20},
+		"cache+file:///data":                              {"file:///data", defaultCacheSize},
+		"cache+inmemory?size=1GB":                         {"inmemory", 1000 * 1000 * 1000},
+		"cache+s3://bucket/shares?size=64MiB&region=eu-1": {"s3://bucket/shares?region=eu-1", 64 << 20},
+	} {
+		backendPath, budget, err := cachePath(storagePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backendPath != expected.backendPath || budget != expected.budget {
+			t.Fatalf("%s: expected %s with %d bytes, received %s with %d bytes", storagePath, expected.backendPath, expected.budget, backendPath, budget)
+		}
+	}
+	if _, _, err := cachePath("cache+file:///data?size=lots"); err == nil {
+		t.Fatal("expected invalid size to be rejected")
+	}
+}
+
+func TestBackendPaths(t *testing.T) {
+	paths := backendPaths("file:///disk1, file:///disk2,,s3://bucket/shares?region=eu-1")
+	expected := []string{"file:///disk1", "file:///disk2", "s3://bucket/shares?region=eu-1"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Fatalf("expected %v, received %v", expected, paths)
+	}
+}
+
+func TestErasurePath(t *testing.T) {
+	data, parity, paths, err := erasurePath("erasure:2+1:file:///disk1,file:///disk2,file:///disk3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != 2 || parity != 1 || len(paths) != 3 || paths[2] != "file:///disk3" {
+		t.Fatalf("expected 2+1 shards across 3 backends, received %d+%d across %v", data, parity, paths)
+	}
+	for _, storagePath := range []string{
+		"erasure:file:///disk1,file:///disk2",
+		"erasure:2:file:///disk1,file:///disk2",
+		"erasure:two+1:file:///disk1,file:///disk2,file:///disk3",
+		"erasure:2+1:file:///disk1,file:///disk2",
+	} {
+		if _, _, _, err := erasurePath(storagePath); err == nil {
+			t.Fatalf("%s: expected path to be rejected", storagePath)
+		}
+	}
+}
+
+func TestStorageExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soubise-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+	for storagePath, expected := range map[string]bool{
+		"file://" + dir:                                true,
+		"file://" + missing:                            false,
+		"sqlite://" + missing:                          false,
+		"cache+bolt://" + missing + "?size=1MiB":       false,
+		"mirror:file://" + dir + ",file://" + missing:  false,
+		"erasure:1+1:file://" + dir + ",file://" + dir: true,
+		"s3://bucket/shares?region=eu-1":               true,
+		"inmemory":                                     true,
+	} {
+		if exists := StorageExists(storagePath); exists != expected {
+			t.Fatalf("%s: expected %v, received %v", storagePath, expected, exists)
+		}
+	}
+}
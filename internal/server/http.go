@@ -17,8 +17,8 @@ limitations under the License.
 package server
 
 import (
-	"container/heap"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -26,6 +26,7 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/wilsonehusin/soubise/internal/archive"
 	"github.com/wilsonehusin/soubise/internal/storage"
 )
 
@@ -35,6 +36,9 @@ type Config struct {
 	PreCheckExpiry bool
 	ActiveExpiry   bool
 	TickExpiry     time.Duration
+	// UploadTimeout is how long an upload session may be idle before it is
+	// considered abandoned and discarded
+	UploadTimeout time.Duration
 }
 
 type HttpServer struct {
@@ -81,32 +85,56 @@ func (h *HttpServer) Start() error {
 		}
 		log.Info().Int64("Duration", int64(interval)).Msg("actively checking expired archives")
 		go func() {
-			heap.Init(storage.ExpiryHeap)
+			// the schedule is only kept in memory, archives stored before
+			// boot are scheduled again and those which expired in the
+			// meantime are deleted right away
+			scheduled, err := scheduleStoredArchives(h.ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("rebuilding expiry schedule, archives stored before boot are not deleted on expiry")
+			} else {
+				log.Info().Int("Archives", scheduled).Msg("rebuilt expiry schedule")
+			}
+			sweep := func() {
+				for _, expiredTag := range storage.PopExpired() {
+					deleteExpired(expiredTag)
+				}
+			}
+			sweep()
+
 			ticker := time.NewTicker(interval)
 			for {
 				select {
 				case <-ticker.C:
-					for {
-						if storage.ExpiryHeap.Len() > 0 && (*storage.ExpiryHeap)[0].HasExpired() {
-							expiredTag := heap.Pop(storage.ExpiryHeap).(storage.ExpiryTag)
-							log.Debug().
-								Time("Expiry", expiredTag.Expiry).
-								Str("Id", expiredTag.Id).
-								Msg("found expired archive, deleting")
-							err := storage.Delete(expiredTag.Id)
-							log.Err(err).Str("Id", expiredTag.Id).Msg("delete expired archive")
-						} else {
-							break
-						}
-					}
+					sweep()
 				case <-h.ctx.Done():
-					// TODO: save heap state
 					return
 				}
 			}
 		}()
 	}
 
+	uploadTimeout := 1 * time.Hour
+	if h.Config.UploadTimeout != 0 {
+		uploadTimeout = h.Config.UploadTimeout
+	}
+	go func() {
+		ticker := time.NewTicker(uploadTimeout / 4)
+		for {
+			select {
+			case <-ticker.C:
+				collected, err := storage.CollectAbandonedUploads(h.ctx, uploadTimeout)
+				if err != nil {
+					log.Error().Err(err).Msg("collecting abandoned uploads")
+				}
+				for _, session := range collected {
+					log.Debug().Str("Session", session).Msg("discarded abandoned upload")
+				}
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+
 	go func() {
 		if err := h.server.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatal().Err(err).Msg("http server aborted")
@@ -116,6 +144,63 @@ func (h *HttpServer) Start() error {
 	return nil
 }
 
+// scheduleStoredArchives schedules the expiry of every archive in storage,
+// returning how many were scheduled.
+func scheduleStoredArchives(ctx context.Context) (int, error) {
+	scheduled := 0
+	err := storage.List(ctx, "", func(id string) error {
+		// metadata and upload chunks are stored next to archives
+		if !storage.IsValidId(id) {
+			return nil
+		}
+		expiry, err := storedExpiry(id)
+		if err != nil {
+			log.Error().Err(err).Str("Id", id).Msg("reading archive expiry")
+			return nil
+		}
+		storage.ScheduleExpiry(id, expiry)
+		scheduled++
+		return nil
+	})
+	return scheduled, err
+}
+
+func storedExpiry(id string) (time.Time, error) {
+	metadata, err := storage.GetMetadata(id)
+	if err == nil {
+		return metadata.Expiry, nil
+	} else if !errors.As(err, new(*storage.StorageNotFoundError)) {
+		return time.Time{}, err
+	}
+
+	// archives uploaded before Metadata existed only carry their expiry
+	obj, _, err := storage.Open(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer obj.Close()
+	storedArchive, _, err := archive.PeekArchive(obj)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return storedArchive.Expiry, nil
+}
+
+func deleteExpired(expiredTag storage.ExpiryTag) {
+	log.Debug().
+		Time("Expiry", expiredTag.Expiry).
+		Str("Id", expiredTag.Id).
+		Msg("found expired archive, deleting")
+	// the expiry may have been extended since it was scheduled, in which case
+	// the new expiry is scheduled separately
+	deleted, err := storage.DeleteExpired(expiredTag.Id)
+	if err == nil && !deleted {
+		log.Debug().Str("Id", expiredTag.Id).Msg("archive expiry was extended, skipping")
+		return
+	}
+	log.Err(err).Str("Id", expiredTag.Id).Msg("delete expired archive")
+}
+
 func (h *HttpServer) Stop() error {
 	ctx, forceStopServer := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
 	defer forceStopServer()
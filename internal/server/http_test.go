@@ -0,0 +1,78 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/broker"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+func storeArchive(t *testing.T, expiry time.Time) string {
+	t.Helper()
+	var bin bytes.Buffer
+	w, err := archive.NewWriter(&bin, &archive.Archive{Suite: archive.SuiteStreamAESGCM, Expiry: expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("jumpsoverthelazydog")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := storage.Create(&bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestScheduleStoredArchives(t *testing.T) {
+	if err := storage.SetStorage(storage.NewInMemoryStorage(&broker.InMemoryBroker{})); err != nil {
+		t.Fatal(err)
+	}
+	expired := storeArchive(t, time.Now().Add(-time.Hour))
+	active := storeArchive(t, time.Now().Add(time.Hour))
+	extended := storeArchive(t, time.Now().Add(-time.Hour))
+	if err := storage.PutMetadata(extended, &storage.Metadata{Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled, err := scheduleStoredArchives(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheduled != 3 {
+		t.Fatalf("expected 3 archives to be scheduled, received %d", scheduled)
+	}
+	popped := storage.PopExpired()
+	if len(popped) != 1 || popped[0].Id != expired {
+		t.Fatalf("expected only %s to have expired, received %v", expired, popped)
+	}
+	deleteExpired(popped[0])
+	for id, exists := range map[string]bool{expired: false, active: true, extended: true} {
+		if _, _, err := storage.Open(id); (err == nil) != exists {
+			t.Fatalf("expected %s to exist: %v, received %v", id, exists, err)
+		}
+	}
+}
@@ -17,9 +17,7 @@ limitations under the License.
 package middleware
 
 import (
-	"math/rand"
 	"net/http"
-	"time"
 
 	"github.com/google/uuid"
 )
@@ -28,10 +26,6 @@ const (
 	RequestIdKey = "X-SOUBISE-REQUEST-ID"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 func RequestIdentifier(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set(RequestIdKey, uuid.NewString())
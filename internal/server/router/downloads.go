@@ -0,0 +1,210 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+var (
+	errExpired        = errors.New("expired object was requested")
+	errDownloadLimit  = errors.New("object has reached its download limit")
+	errMultipleRanges = errors.New("multiple ranges were requested")
+)
+
+const resumeTokenByteLength = 32
+
+// resumeTokenLifetime is how long a counted download can be resumed with the
+// token issued for it
+const resumeTokenLifetime = time.Hour
+
+// checkRange refuses requests for multiple ranges, which could serve an object
+// many times over in one response.
+func checkRange(r *http.Request) error {
+	if strings.Contains(r.Header.Get("Range"), ",") {
+		return errMultipleRanges
+	}
+	return nil
+}
+
+func hashResumeToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// canResume tells whether tokenHash belongs to a download of m which was
+// counted already and can still be resumed.
+func canResume(m *storage.Metadata, tokenHash []byte) bool {
+	now := time.Now()
+	for _, resume := range m.Resumes {
+		if resume.Expiry.After(now) && bytes.Equal(resume.TokenHash, tokenHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResume allows resuming a download as long as the object has not
+// expired, even once it reached its download limit.
+func checkResume(m *storage.Metadata) error {
+	if m.Expiry.Before(time.Now()) {
+		return errExpired
+	}
+	return nil
+}
+
+// reserveDownload counts a download before it starts, so that concurrent
+// downloads can never exceed the limit. The download can be resumed with the
+// token hashed to tokenHash until it completes.
+func reserveDownload(tokenHash []byte) func(*storage.Metadata) error {
+	return func(m *storage.Metadata) error {
+		if m.Expiry.Before(time.Now()) {
+			return errExpired
+		}
+		if m.MaxDownloads == 0 {
+			return nil
+		}
+		if m.Downloads >= m.MaxDownloads {
+			return errDownloadLimit
+		}
+		m.Downloads++
+		m.Resumes = append(liveResumes(m.Resumes, nil), storage.Resume{
+			TokenHash: tokenHash,
+			Expiry:    time.Now().Add(resumeTokenLifetime).Truncate(time.Second),
+		})
+		return nil
+	}
+}
+
+// liveResumes returns resumes without the expired ones and the one for
+// tokenHash.
+func liveResumes(resumes []storage.Resume, tokenHash []byte) []storage.Resume {
+	now := time.Now()
+	var live []storage.Resume
+	for _, resume := range resumes {
+		if resume.Expiry.After(now) && !bytes.Equal(resume.TokenHash, tokenHash) {
+			live = append(live, resume)
+		}
+	}
+	return live
+}
+
+// releaseDownload gives back a download reserved by reserveDownload which
+// failed before any content was sent. Downloads which were interrupted later
+// stay counted, as they can be resumed without being counted again.
+func releaseDownload(r *http.Request, id string, tokenHash []byte) {
+	_, err := storage.UpdateMetadata(id, func(m *storage.Metadata) error {
+		if m.Downloads > 0 {
+			m.Downloads--
+		}
+		m.Resumes = liveResumes(m.Resumes, tokenHash)
+		return nil
+	})
+	if err != nil {
+		requestLogger(r).Error().Err(err).Msg("release download")
+	}
+}
+
+// settleDownload forgets the token hashed to tokenHash once its download
+// completed. An object which reached its download limit is deleted as soon as
+// no download of it can be resumed anymore, until then it expires along with
+// the last token.
+func settleDownload(r *http.Request, id string, tokenHash []byte, completed bool) {
+	metadata, err := storage.UpdateMetadata(id, func(m *storage.Metadata) error {
+		if completed {
+			m.Resumes = liveResumes(m.Resumes, tokenHash)
+		} else {
+			m.Resumes = liveResumes(m.Resumes, nil)
+		}
+		if m.Downloads < m.MaxDownloads {
+			return nil
+		}
+		var last time.Time
+		for _, resume := range m.Resumes {
+			if resume.Expiry.After(last) {
+				last = resume.Expiry
+			}
+		}
+		if len(m.Resumes) > 0 && last.Before(m.Expiry) {
+			m.Expiry = last
+		}
+		return nil
+	})
+	if err != nil {
+		requestLogger(r).Error().Err(err).Msg("settle download")
+		return
+	}
+	if remaining, _ := metadata.RemainingDownloads(); remaining > 0 {
+		return
+	}
+	if len(metadata.Resumes) > 0 {
+		storage.ScheduleExpiry(id, metadata.Expiry)
+		return
+	}
+	requestLogger(r).Info().Msg("deleting object which reached its download limit")
+	if err := storage.Delete(id); err != nil {
+		requestLogger(r).Error().Err(err).Msg("unsuccessful deletion")
+	}
+}
+
+// completes tells whether the response recorded by rec delivered an object of
+// size up to its end.
+func completes(rec *responseRecorder, size int64) bool {
+	if rec.err != nil {
+		return false
+	}
+	switch rec.status {
+	case http.StatusOK:
+		return rec.written == size
+	case http.StatusPartialContent:
+		var start, end, total int64
+		_, err := fmt.Sscanf(rec.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		return err == nil && end == size-1
+	}
+	return false
+}
+
+// responseRecorder remembers the status, the first write error and how much
+// was written of a response, to tell whether a download completed.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	err     error
+	written int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
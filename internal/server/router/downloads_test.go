@@ -0,0 +1,180 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+func getObjectRange(t *testing.T, url string, byteRange string, resumeToken string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	if resumeToken != "" {
+		req.Header.Set(routes.ResumeTokenHeader, resumeToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return resp, body
+}
+
+func TestConcurrentDownloadsRespectLimit(t *testing.T) {
+	server := newTestServer(t)
+	const maxDownloads, extra = 3, 7
+	id, _ := createTestObject(t, server, maxDownloads)
+	url := server.URL + routes.GetObjectWithId(id)
+
+	statuses := make(chan int, maxDownloads+extra)
+	var wg sync.WaitGroup
+	for i := 0; i < maxDownloads+extra; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp, _ := getObjectRange(t, url, "", ""); resp != nil {
+				statuses <- resp.StatusCode
+			}
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	succeeded := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			succeeded++
+		case http.StatusNotFound:
+		default:
+			t.Fatalf("unexpected status %d", status)
+		}
+	}
+	if succeeded != maxDownloads {
+		t.Fatalf("expected exactly %d downloads, received %d", maxDownloads, succeeded)
+	}
+	if resp, _ := getObjectRange(t, url, "", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected object to be gone, received %v", resp.Status)
+	}
+}
+
+func TestResumedDownloadsAreNotCounted(t *testing.T) {
+	server := newTestServer(t)
+	id, _ := createTestObject(t, server, 1)
+	url := server.URL + routes.GetObjectWithId(id)
+	expected := encodeTestArchive(t, 1)
+
+	// an interrupted download, then resumed
+	resp, first := getObjectRange(t, url, "bytes=0-99", "")
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get(routes.RemainingDownloadsHeader) != "0" {
+		t.Fatalf("expected first part to be counted, received %v with %q remaining", resp.Status, resp.Header.Get(routes.RemainingDownloadsHeader))
+	}
+	token := resp.Header.Get(routes.ResumeTokenHeader)
+	if token == "" {
+		t.Fatal("expected a resume token to be issued")
+	}
+	rest := fmt.Sprintf("bytes=%d-", len(first))
+	if resp, _ := getObjectRange(t, url, rest, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected ranges without resume token to be refused at the limit, received %v", resp.Status)
+	}
+	if resp, _ := getObjectRange(t, url, rest, "notthetoken"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected ranges with another resume token to be refused at the limit, received %v", resp.Status)
+	}
+	metadata, err := storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Downloads != 1 {
+		t.Fatalf("expected one download to be counted, received %d", metadata.Downloads)
+	}
+
+	resp, remainder := getObjectRange(t, url, rest, token)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected download to be resumed, received %v", resp.Status)
+	}
+	// archives differ by their random content key, only the length matches
+	if len(first)+len(remainder) != len(expected) {
+		t.Fatalf("expected %d bytes in total, received %d", len(expected), len(first)+len(remainder))
+	}
+
+	// nothing can be resumed once the last download completed
+	if _, err := storage.GetMetadata(id); err == nil {
+		t.Fatal("expected object to be deleted once its last download completed")
+	}
+	if resp, _ := getObjectRange(t, url, rest, token); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected completed download not to be resumed, received %v", resp.Status)
+	}
+}
+
+func TestMultipleRangesAreRefused(t *testing.T) {
+	server := newTestServer(t)
+	id, _ := createTestObject(t, server, 1)
+	url := server.URL + routes.GetObjectWithId(id)
+
+	if resp, _ := getObjectRange(t, url, "bytes=1-,0-0", ""); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("expected multiple ranges to be refused, received %v", resp.Status)
+	}
+	resp, body := getObjectRange(t, url, "", "")
+	if resp.StatusCode != http.StatusOK || !bytes.HasPrefix(body, []byte("SOUBISE")) {
+		t.Fatalf("expected download not to be spent, received %v", resp.Status)
+	}
+}
+
+func TestUnservedDownloadsAreReleased(t *testing.T) {
+	server := newTestServer(t)
+	id, _ := createTestObject(t, server, 1)
+	url := server.URL + routes.GetObjectWithId(id)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", fmt.Sprintf("%q", id))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, received %v", resp.Status)
+	}
+
+	resp, body := getObjectRange(t, url, "", "")
+	if resp.StatusCode != http.StatusOK || !bytes.HasPrefix(body, []byte("SOUBISE")) {
+		t.Fatalf("expected download not to be spent, received %v", resp.Status)
+	}
+}
@@ -17,16 +17,19 @@ limitations under the License.
 package router
 
 import (
-	"bytes"
-	"container/heap"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 
 	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/crypto"
 	"github.com/wilsonehusin/soubise/internal/server/middleware"
 	"github.com/wilsonehusin/soubise/internal/server/routes"
 	"github.com/wilsonehusin/soubise/internal/storage"
@@ -41,6 +44,13 @@ func NewMux() http.Handler {
 
 	router.HandleFunc(routes.CreateObject, createObject).Methods("POST")
 	router.HandleFunc(routes.GetObjectId, getObject).Methods("GET")
+	router.HandleFunc(routes.GetObjectId, deleteObject).Methods("DELETE")
+	router.HandleFunc(routes.GetObjectId, extendObject).Methods("PATCH")
+	router.HandleFunc(routes.CreateUpload, createUpload).Methods("POST")
+	router.HandleFunc(routes.UploadId, getUpload).Methods("GET")
+	router.HandleFunc(routes.UploadId, deleteUpload).Methods("DELETE")
+	router.HandleFunc(routes.UploadChunk, putChunk).Methods("PUT")
+	router.HandleFunc(routes.CompleteUpload, completeUpload).Methods("POST")
 
 	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// TODO: redirect to product landing page / GitHub repository
@@ -56,19 +66,18 @@ func requestLogger(r *http.Request) *zerolog.Logger {
 }
 
 func createObject(w http.ResponseWriter, r *http.Request) {
-	bodyBuffer := bytes.NewBuffer([]byte{})
-	if _, err := io.Copy(bodyBuffer, r.Body); err != nil {
-		requestLogger(r).Error().Err(err).Send()
-		return
-	}
-
 	requestLogger(r).Debug().
 		Dict("Storage", zerolog.Dict().
 			Str("Action", "create")).
 		Msg("processing archive")
 
-	bodyBytes := bodyBuffer.Bytes()
-	toStore, err := archive.LoadArchive(bodyBytes)
+	storeArchive(w, r, r.Body)
+}
+
+// storeArchive stores the archive read from content, responding with its id
+// and owner key.
+func storeArchive(w http.ResponseWriter, r *http.Request, content io.Reader) {
+	toStore, body, err := archive.PeekUpload(content)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		requestLogger(r).Error().
@@ -76,15 +85,26 @@ func createObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := storage.Create(bodyBytes)
+	ownerKey, err := crypto.RandLen(ownerKeyByteLength)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().
+			Err(err).Msg("generate owner key")
+		return
+	}
+	ownerHash := sha256.Sum256([]byte(ownerKey.String()))
+	id, err := storage.CreateWithMetadata(body, &storage.Metadata{
+		Expiry:       toStore.Expiry,
+		OwnerHash:    ownerHash[:],
+		MaxDownloads: toStore.MaxDownloads,
+	})
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		requestLogger(r).Error().
 			Err(err).Msg("create object")
 		return
 	}
-
-	heap.Push(storage.ExpiryHeap, storage.ExpiryTag{Id: id, Expiry: toStore.Expiry})
+	storage.ScheduleExpiry(id, toStore.Expiry)
 
 	requestLogger(r).Info().
 		Dict("Storage", zerolog.Dict().
@@ -92,6 +112,7 @@ func createObject(w http.ResponseWriter, r *http.Request) {
 			Str("Action", "create")).
 		Msg("created archive")
 
+	w.Header().Set(routes.OwnerKeyHeader, ownerKey.String())
 	if _, err := w.Write([]byte(id)); err != nil {
 		requestLogger(r).Error().Err(err).Send()
 		return
@@ -106,29 +127,87 @@ func getObject(w http.ResponseWriter, r *http.Request) {
 			Str("Action", "get")).
 		Msg("processing archive")
 
-	obj, err := storage.Get(id)
-	if len(obj) == 0 || err != nil {
+	if !storage.IsValidId(id) {
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(fmt.Errorf("malformed object id was requested")).Send()
+		return
+	}
+
+	if err := checkRange(r); err != nil {
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		requestLogger(r).Error().Err(err).Send()
+		return
+	}
+
+	var metadata *storage.Metadata
+	var err error
+	counted := true
+	token := r.Header.Get(routes.ResumeTokenHeader)
+	tokenHash := hashResumeToken(token)
+	if token != "" {
+		if metadata, err = storage.GetMetadata(id); err == nil && canResume(metadata, tokenHash) {
+			counted = false
+			err = checkResume(metadata)
+		}
+	}
+	if counted {
+		newToken, tokenErr := crypto.RandLen(resumeTokenByteLength)
+		if tokenErr != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			requestLogger(r).Error().Err(tokenErr).Msg("generate resume token")
+			return
+		}
+		token = newToken.String()
+		tokenHash = hashResumeToken(token)
+		metadata, err = storage.UpdateMetadata(id, reserveDownload(tokenHash))
+	}
+	switch {
+	case errors.Is(err, errExpired):
+		expireObject(w, r, id)
+		return
+	case errors.Is(err, errDownloadLimit):
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(err).Send()
+		return
+	case errors.As(err, new(*storage.StorageNotFoundError)):
+		// archives uploaded before Metadata existed only carry their expiry
+		metadata = nil
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().Err(err).Msg("read object metadata")
+		return
+	}
+	remaining, limited := uint32(0), false
+	if metadata != nil {
+		remaining, limited = metadata.RemainingDownloads()
+	}
+	release := func() {
+		if limited && counted {
+			releaseDownload(r, id, tokenHash)
+		}
+	}
+
+	obj, size, err := storage.Open(id)
+	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		requestLogger(r).Error().
 			Err(err).Send()
+		release()
 		return
 	}
+	defer obj.Close()
 
-	objArchive, err := archive.LoadArchive(obj)
+	objArchive, content, err := archive.PeekArchive(obj)
 	if err != nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		requestLogger(r).Error().
 			Err(err).Send()
+		release()
 		return
 	}
 
-	if objArchive.HasExpired() {
-		w.WriteHeader(http.StatusNotFound)
-		requestLogger(r).Error().Err(fmt.Errorf("expired object was requested")).Send()
-		requestLogger(r).Info().Msg("deleting expired object")
-		if err := storage.Delete(id); err != nil {
-			requestLogger(r).Error().Err(err).Msg("unsuccessful deletion")
-		}
+	if metadata == nil && objArchive.HasExpired() {
+		expireObject(w, r, id)
 		return
 	}
 
@@ -136,9 +215,51 @@ func getObject(w http.ResponseWriter, r *http.Request) {
 		Dict("Storage", zerolog.Dict().
 			Str("Id", id).
 			Str("Action", "get")).
+		Bool("Resumed", !counted).
 		Msg("found archive")
 
-	if _, err := w.Write(obj); err != nil {
-		requestLogger(r).Fatal().Err(err).Send()
+	if limited {
+		w.Header().Set(routes.RemainingDownloadsHeader, strconv.FormatUint(uint64(remaining), 10))
+		w.Header().Set(routes.ResumeTokenHeader, token)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	seeker, seekable := obj.(io.ReadSeeker)
+	if seekable {
+		_, err = seeker.Seek(0, io.SeekStart)
+	}
+	if !seekable || err != nil {
+		// ranges are only supported by backends which can seek
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		_, err := io.Copy(recorder, content)
+		if recorder.err == nil {
+			recorder.err = err
+		}
+	} else {
+		// objects are never modified once created, their id identifies the
+		// content as well as any hash would
+		w.Header().Set("ETag", fmt.Sprintf("%q", id))
+		http.ServeContent(recorder, r, "", time.Time{}, seeker)
+	}
+	if recorder.err != nil || recorder.status >= 300 {
+		requestLogger(r).Error().Err(recorder.err).Int("Status", recorder.status).Msg("serving archive")
+		// error responses, e.g. for unsatisfiable ranges, carry no content
+		if recorder.status >= 300 || recorder.written == 0 {
+			release()
+			return
+		}
+	}
+	if limited {
+		settleDownload(r, id, tokenHash, completes(recorder, size))
+	}
+}
+
+func expireObject(w http.ResponseWriter, r *http.Request, id string) {
+	w.WriteHeader(http.StatusNotFound)
+	requestLogger(r).Error().Err(fmt.Errorf("expired object was requested")).Send()
+	requestLogger(r).Info().Msg("deleting expired object")
+	if err := storage.Delete(id); err != nil {
+		requestLogger(r).Error().Err(err).Msg("unsuccessful deletion")
 	}
 }
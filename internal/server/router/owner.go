@@ -0,0 +1,153 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+const ownerKeyByteLength = 32
+
+// authorizeOwner verifies the request carries the owner key of the object,
+// otherwise responds with an error and returns false.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, id string) (*storage.Metadata, bool) {
+	if !storage.IsValidId(id) {
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(fmt.Errorf("malformed object id was requested")).Send()
+		return nil, false
+	}
+
+	metadata, err := storage.GetMetadata(id)
+	if errors.As(err, new(*storage.StorageNotFoundError)) {
+		// archives uploaded before owner keys were issued can not be managed
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(err).Send()
+		return nil, false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().Err(err).Msg("read object metadata")
+		return nil, false
+	}
+	if metadata.Expiry.Before(time.Now()) {
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(fmt.Errorf("expired object was requested")).Send()
+		return nil, false
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		requestLogger(r).Error().Err(fmt.Errorf("owner key is missing")).Send()
+		return nil, false
+	}
+	ownerHash := sha256.Sum256([]byte(strings.TrimPrefix(authorization, "Bearer ")))
+	if metadata.OwnerHash == nil || subtle.ConstantTimeCompare(ownerHash[:], metadata.OwnerHash) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		requestLogger(r).Error().Err(fmt.Errorf("owner key does not match")).Send()
+		return nil, false
+	}
+	return metadata, true
+}
+
+func deleteObject(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["Id"]
+	requestLogger(r).Debug().
+		Dict("Storage", zerolog.Dict().
+			Str("Id", id).
+			Str("Action", "delete")).
+		Msg("processing archive")
+
+	if _, ok := authorizeOwner(w, r, id); !ok {
+		return
+	}
+
+	if err := storage.Delete(id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().Err(err).Msg("unsuccessful deletion")
+		return
+	}
+
+	requestLogger(r).Info().
+		Dict("Storage", zerolog.Dict().
+			Str("Id", id).
+			Str("Action", "delete")).
+		Msg("deleted archive")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func extendObject(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["Id"]
+	requestLogger(r).Debug().
+		Dict("Storage", zerolog.Dict().
+			Str("Id", id).
+			Str("Action", "extend")).
+		Msg("processing archive")
+
+	if _, ok := authorizeOwner(w, r, id); !ok {
+		return
+	}
+
+	request := &routes.ExtendRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		requestLogger(r).Error().Err(err).Msg("request does not form ExtendRequest")
+		return
+	}
+	lifetime, err := time.ParseDuration(request.Lifetime)
+	if err != nil || lifetime <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		requestLogger(r).Error().Err(fmt.Errorf("invalid lifetime %q", request.Lifetime)).Send()
+		return
+	}
+
+	expiry := time.Now().Add(lifetime).Truncate(time.Second)
+	metadata, err := storage.UpdateMetadata(id, func(m *storage.Metadata) error {
+		m.Expiry = expiry
+		return nil
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().Err(err).Msg("update object metadata")
+		return
+	}
+	storage.ScheduleExpiry(id, metadata.Expiry)
+
+	requestLogger(r).Info().
+		Dict("Storage", zerolog.Dict().
+			Str("Id", id).
+			Str("Action", "extend")).
+		Time("Expiry", metadata.Expiry).
+		Msg("extended archive")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&routes.ExtendResponse{Expiry: metadata.Expiry}); err != nil {
+		requestLogger(r).Error().Err(err).Send()
+	}
+}
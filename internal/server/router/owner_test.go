@@ -0,0 +1,166 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/archive"
+	"github.com/wilsonehusin/soubise/internal/broker"
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+var setupStorage sync.Once
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	setupStorage.Do(func() {
+		if err := storage.SetStorage(storage.NewInMemoryStorage(&broker.InMemoryBroker{})); err != nil {
+			t.Fatal(err)
+		}
+	})
+	server := httptest.NewServer(NewMux())
+	t.Cleanup(server.Close)
+	return server
+}
+
+func encodeTestArchive(t *testing.T, maxDownloads uint32) []byte {
+	t.Helper()
+	var bin bytes.Buffer
+	w, err := archive.NewWriter(&bin, &archive.Archive{
+		Suite:        archive.SuiteStreamAESGCM,
+		Expiry:       time.Now().Add(time.Hour),
+		MaxDownloads: maxDownloads,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(bytes.Repeat([]byte("jumpsoverthelazydog"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bin.Bytes()
+}
+
+// createTestObject uploads an archive, returning its id and owner key.
+func createTestObject(t *testing.T, server *httptest.Server, maxDownloads uint32) (string, string) {
+	t.Helper()
+	resp, err := http.Post(server.URL+routes.CreateObject, "application/octet-stream", bytes.NewReader(encodeTestArchive(t, maxDownloads)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	id, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected object to be created, received %v (%v)", resp.Status, err)
+	}
+	return string(id), resp.Header.Get(routes.OwnerKeyHeader)
+}
+
+func ownerRequest(t *testing.T, server *httptest.Server, method string, id string, ownerKey string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+routes.GetObjectWithId(id), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ownerKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ownerKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestOwnerAuthorization(t *testing.T) {
+	server := newTestServer(t)
+	id, ownerKey := createTestObject(t, server, 0)
+	if ownerKey == "" {
+		t.Fatal("expected owner key to be issued")
+	}
+
+	for _, method := range []string{http.MethodDelete, http.MethodPatch} {
+		if resp := ownerRequest(t, server, method, id, "", `{"lifetime":"48h"}`); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s without owner key: expected 401, received %v", method, resp.Status)
+		}
+		if resp := ownerRequest(t, server, method, id, "not"+ownerKey, `{"lifetime":"48h"}`); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s with wrong owner key: expected 403, received %v", method, resp.Status)
+		}
+	}
+
+	if resp := ownerRequest(t, server, http.MethodPatch, id, ownerKey, `{"lifetime":"48h"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected object to be extended, received %v", resp.Status)
+	}
+	metadata, err := storage.GetMetadata(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Expiry.Before(time.Now().Add(47 * time.Hour)) {
+		t.Fatalf("expected expiry to be extended, received %v", metadata.Expiry)
+	}
+
+	if resp := ownerRequest(t, server, http.MethodDelete, id, ownerKey, ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected object to be deleted, received %v", resp.Status)
+	}
+	if _, err := storage.Stat(id); err == nil {
+		t.Fatal("expected object to be gone")
+	}
+	if resp := ownerRequest(t, server, http.MethodDelete, id, ownerKey, ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected deleted object to be gone, received %v", resp.Status)
+	}
+}
+
+func TestOwnerAuthorizationLegacyObjects(t *testing.T) {
+	server := newTestServer(t)
+
+	// uploaded before Metadata existed
+	withoutMetadata, err := storage.Create(bytes.NewReader(encodeTestArchive(t, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// uploaded before owner keys were issued
+	withoutOwner, err := storage.Create(bytes.NewReader(encodeTestArchive(t, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.PutMetadata(withoutOwner, &storage.Metadata{Expiry: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, expected := range map[string]int{withoutMetadata: http.StatusNotFound, withoutOwner: http.StatusForbidden} {
+		for _, method := range []string{http.MethodDelete, http.MethodPatch} {
+			if resp := ownerRequest(t, server, method, id, "anything", `{"lifetime":"48h"}`); resp.StatusCode != expected {
+				t.Fatalf("%s %s: expected %d, received %v", method, id, expected, resp.Status)
+			}
+		}
+		if _, err := storage.Stat(id); err != nil {
+			t.Fatalf("expected %s to remain, received %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+	"github.com/wilsonehusin/soubise/internal/storage"
+)
+
+// maxChunkSize bounds the body of a single chunk, clients pick any size up to it
+const maxChunkSize = 16 << 20
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	session, err := storage.NewUpload()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		requestLogger(r).Error().Err(err).Msg("create upload session")
+		return
+	}
+	requestLogger(r).Info().
+		Dict("Storage", zerolog.Dict().
+			Str("Session", session).
+			Str("Action", "upload")).
+		Msg("created upload session")
+
+	writeJSON(w, r, &routes.UploadSession{
+		Session:      session,
+		MaxChunkSize: maxChunkSize,
+	})
+}
+
+// uploadSession returns the session named by r, otherwise responds with an
+// error and returns false.
+func uploadSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session := mux.Vars(r)["Session"]
+	if !storage.IsValidId(session) {
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(errors.New("malformed upload session was requested")).Send()
+		return "", false
+	}
+	return session, true
+}
+
+func getUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+	chunks, size, err := storage.UploadStatus(session)
+	if err != nil {
+		uploadError(w, r, err)
+		return
+	}
+	writeJSON(w, r, &routes.UploadStatus{
+		Chunks: chunks,
+		Size:   size,
+	})
+}
+
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+	if err := storage.DiscardUpload(session); err != nil {
+		uploadError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func putChunk(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(mux.Vars(r)["Index"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		requestLogger(r).Error().Err(err).Msg("malformed chunk index")
+		return
+	}
+	requestLogger(r).Debug().
+		Dict("Storage", zerolog.Dict().
+			Str("Session", session).
+			Int("Chunk", index).
+			Str("Action", "upload")).
+		Msg("processing chunk")
+
+	body := http.MaxBytesReader(w, r.Body, maxChunkSize)
+	if err := storage.PutChunk(session, index, body); err != nil {
+		uploadError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func completeUpload(w http.ResponseWriter, r *http.Request) {
+	session, ok := uploadSession(w, r)
+	if !ok {
+		return
+	}
+	requestLogger(r).Debug().
+		Dict("Storage", zerolog.Dict().
+			Str("Session", session).
+			Str("Action", "create")).
+		Msg("processing archive")
+
+	content, err := storage.CompleteUpload(session)
+	if err != nil {
+		uploadError(w, r, err)
+		return
+	}
+	// the chunks are stored as one object now, or the upload has to be redone
+	defer func() {
+		if err := storage.DiscardUpload(session); err != nil {
+			requestLogger(r).Error().Err(err).Msg("discard upload session")
+		}
+	}()
+	storeArchive(w, r, content)
+}
+
+func uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, storage.ErrUploadNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, storage.ErrUploadBusy), errors.As(err, new(*storage.ChunkOrderError)):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	requestLogger(r).Error().Err(err).Msg("upload session")
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		requestLogger(r).Error().Err(err).Send()
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package router
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/server/routes"
+)
+
+func TestMalformedUploadSessions(t *testing.T) {
+	server := newTestServer(t)
+	for _, session := range []string{"not-a-session", "thequickbrownfox.lazydog"} {
+		for _, request := range []struct{ method, route string }{
+			{http.MethodGet, routes.UploadWithSession(session)},
+			{http.MethodDelete, routes.UploadWithSession(session)},
+			{http.MethodPut, routes.UploadChunkWithIndex(session, 0)},
+			{http.MethodPost, routes.CompleteUploadWithSession(session)},
+		} {
+			req, err := http.NewRequest(request.method, server.URL+request.route, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("%s %s: expected 404, received %v", request.method, request.route, resp.Status)
+			}
+		}
+	}
+}
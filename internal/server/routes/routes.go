@@ -18,6 +18,8 @@ package routes
 
 import (
 	"path"
+	"strconv"
+	"time"
 )
 
 const (
@@ -25,8 +27,63 @@ const (
 
 	GetObject   = "/api/v1/obj"
 	GetObjectId = "/api/v1/obj/{Id}"
+
+	CreateUpload   = "/api/v1/upload"
+	UploadId       = "/api/v1/upload/{Session}"
+	UploadChunk    = "/api/v1/upload/{Session}/{Index:[0-9]+}"
+	CompleteUpload = "/api/v1/upload/{Session}/complete"
 )
 
+// OwnerKeyHeader carries the owner key issued on CreateObject, which has to be
+// presented as bearer token to delete or extend the object
+const OwnerKeyHeader = "Soubise-Owner-Key"
+
+// RemainingDownloadsHeader tells how often an object with a download limit can
+// still be downloaded after the current response
+const RemainingDownloadsHeader = "Soubise-Remaining-Downloads"
+
+// ResumeTokenHeader carries the token issued along with a counted download of
+// an object with a download limit, which has to be presented again to resume
+// that download without counting it twice
+const ResumeTokenHeader = "Soubise-Resume-Token"
+
+// ExtendRequest is the body of PATCH requests to GetObjectId, the object
+// expires Lifetime (e.g. "48h") after the request
+type ExtendRequest struct {
+	Lifetime string `json:"lifetime"`
+}
+
+type ExtendResponse struct {
+	Expiry time.Time `json:"expiry"`
+}
+
+// UploadSession is returned on CreateUpload, chunks of the archive are then
+// PUT to UploadChunk in order before POSTing to CompleteUpload, which responds
+// like CreateObject
+type UploadSession struct {
+	Session      string `json:"session"`
+	MaxChunkSize int64  `json:"maxChunkSize"`
+}
+
+// UploadStatus is returned on GET requests to UploadId, telling how many
+// chunks the server has acknowledged
+type UploadStatus struct {
+	Chunks int   `json:"chunks"`
+	Size   int64 `json:"size"`
+}
+
 func GetObjectWithId(id string) string {
 	return path.Join(GetObject, id)
 }
+
+func UploadWithSession(session string) string {
+	return path.Join(CreateUpload, session)
+}
+
+func UploadChunkWithIndex(session string, index int) string {
+	return path.Join(CreateUpload, session, strconv.Itoa(index))
+}
+
+func CompleteUploadWithSession(session string) string {
+	return path.Join(CreateUpload, session, "complete")
+}
@@ -0,0 +1,374 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltChunkSize is how much content is stored per key, values much larger
+// than a page make bbolt rewrite and fragment its file
+const boltChunkSize = 1 << 20
+
+var (
+	// boltObjects maps ids to boltObject
+	boltObjects = []byte("objects")
+	// boltChunks maps blob and chunk number to content
+	boltChunks = []byte("chunks")
+	// boltMetadata maps ids to Metadata, apart from objects so that it can be
+	// scanned without paging through content
+	boltMetadata = []byte("metadata")
+)
+
+type boltObject struct {
+	// Blob prefixes the keys of the chunks, a new blob is written every Put
+	// and replaces the previous one once complete
+	Blob      []byte    `json:"blob"`
+	Size      int64     `json:"size"`
+	ChunkSize int64     `json:"chunkSize"`
+	ModTime   time.Time `json:"modTime"`
+}
+
+// BoltStorage keeps objects along with their Metadata in a single bbolt file.
+type BoltStorage struct {
+	db        *bolt.DB
+	chunkSize int64
+}
+
+func NewBoltStorage(path string) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStorage{db: db, chunkSize: boltChunkSize}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltObjects, boltChunks, boltMetadata} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return s.deleteOrphanedChunks(tx)
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing bolt storage: %w", err)
+	}
+	return s, nil
+}
+
+// deleteOrphanedChunks removes blobs which were left behind by a crash
+// during Put.
+func (s *BoltStorage) deleteOrphanedChunks(tx *bolt.Tx) error {
+	referenced := map[string]bool{}
+	if err := tx.Bucket(boltObjects).ForEach(func(_, v []byte) error {
+		object := &boltObject{}
+		if err := json.Unmarshal(v, object); err != nil {
+			return err
+		}
+		referenced[string(object.Blob)] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	chunks := tx.Bucket(boltChunks)
+	var orphaned [][]byte
+	if err := chunks.ForEach(func(k, _ []byte) error {
+		if !referenced[string(blobOfChunk(k))] {
+			orphaned = append(orphaned, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range orphaned {
+		if err := chunks.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func chunkKeyOfBlob(blob []byte, seq int64) []byte {
+	k := make([]byte, len(blob)+8)
+	copy(k, blob)
+	binary.BigEndian.PutUint64(k[len(blob):], uint64(seq))
+	return k
+}
+
+func blobOfChunk(k []byte) []byte {
+	return k[:len(k)-8]
+}
+
+func deleteBlob(tx *bolt.Tx, blob []byte) error {
+	// deleting while iterating makes the cursor skip keys
+	chunks := tx.Bucket(boltChunks)
+	var keys [][]byte
+	c := chunks.Cursor()
+	for k, _ := c.Seek(blob); k != nil && bytes.Equal(blobOfChunk(k), blob); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for _, k := range keys {
+		if err := chunks.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getBoltObject(tx *bolt.Tx, id string) (*boltObject, error) {
+	v := tx.Bucket(boltObjects).Get([]byte(id))
+	if v == nil {
+		return nil, &StorageNotFoundError{}
+	}
+	object := &boltObject{}
+	if err := json.Unmarshal(v, object); err != nil {
+		return nil, fmt.Errorf("decoding object %s: %w", id, err)
+	}
+	return object, nil
+}
+
+func (s *BoltStorage) Put(id string, data io.Reader) error {
+	return s.putObject(id, data, nil)
+}
+
+// putObject stores data under id, along with m unless it is nil.
+func (s *BoltStorage) putObject(id string, data io.Reader, m *Metadata) error {
+	blobId, err := NewId()
+	if err != nil {
+		return err
+	}
+	object := &boltObject{Blob: []byte(blobId), ChunkSize: s.chunkSize}
+	discard := func() {
+		_ = s.db.Update(func(tx *bolt.Tx) error {
+			return deleteBlob(tx, object.Blob)
+		})
+	}
+
+	// every chunk is committed separately, so that other writers are not
+	// blocked for the duration of an upload
+	chunk := make([]byte, s.chunkSize)
+	for seq := int64(0); ; seq++ {
+		n, err := io.ReadFull(data, chunk)
+		if n > 0 {
+			if err := s.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(boltChunks).Put(chunkKeyOfBlob(object.Blob, seq), chunk[:n])
+			}); err != nil {
+				discard()
+				return err
+			}
+			object.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			discard()
+			return err
+		}
+	}
+
+	object.ModTime = time.Now()
+	encoded, err := json.Marshal(object)
+	if err != nil {
+		discard()
+		return err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if previous, err := getBoltObject(tx, id); err == nil {
+			if err := deleteBlob(tx, previous.Blob); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket(boltObjects).Put([]byte(id), encoded); err != nil {
+			return err
+		}
+		if m != nil {
+			return putBoltMetadata(tx, id, m)
+		}
+		return nil
+	}); err != nil {
+		discard()
+		return err
+	}
+	return nil
+}
+
+func (s *BoltStorage) Open(id string) (io.ReadCloser, int64, error) {
+	var object *boltObject
+	if err := s.db.View(func(tx *bolt.Tx) (err error) {
+		object, err = getBoltObject(tx, id)
+		return err
+	}); err != nil {
+		return nil, 0, err
+	}
+	readChunk := func(seq int64) ([]byte, error) {
+		var chunk []byte
+		err := s.db.View(func(tx *bolt.Tx) error {
+			v := tx.Bucket(boltChunks).Get(chunkKeyOfBlob(object.Blob, seq))
+			if v == nil {
+				return fmt.Errorf("object %s is missing chunk %d", id, seq)
+			}
+			// values are only valid during the transaction
+			chunk = append([]byte(nil), v...)
+			return nil
+		})
+		return chunk, err
+	}
+	return newChunkedObject(object.Size, object.ChunkSize, readChunk), object.Size, nil
+}
+
+func (s *BoltStorage) Stat(id string) (*ObjectInfo, error) {
+	var object *boltObject
+	if err := s.db.View(func(tx *bolt.Tx) (err error) {
+		object, err = getBoltObject(tx, id)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: object.Size, ModTime: object.ModTime}, nil
+}
+
+func (s *BoltStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	// ids are collected first, fn may need to write
+	var ids []string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltObjects).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			ids = append(ids, string(k))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStorage) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteBoltObject(tx, id)
+	})
+}
+
+// DeleteExpired removes the object like Delete, unless its expiry was extended.
+func (s *BoltStorage) DeleteExpired(id string) (bool, error) {
+	deleted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		m, err := getBoltMetadata(tx, id)
+		if err == nil && !m.HasExpired() {
+			return nil
+		} else if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+			return err
+		}
+		deleted = true
+		return deleteBoltObject(tx, id)
+	})
+	return deleted, err
+}
+
+func deleteBoltObject(tx *bolt.Tx, id string) error {
+	object, err := getBoltObject(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := deleteBlob(tx, object.Blob); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltMetadata).Delete([]byte(id)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltObjects).Delete([]byte(id))
+}
+
+func (s *BoltStorage) Kind() string {
+	return "bolt"
+}
+
+func (s *BoltStorage) PutMetadata(id string, m *Metadata) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBoltMetadata(tx, id, m)
+	})
+}
+
+func (s *BoltStorage) PutWithMetadata(id string, data io.Reader, m *Metadata) error {
+	return s.putObject(id, data, m)
+}
+
+func (s *BoltStorage) GetMetadata(id string) (*Metadata, error) {
+	var m *Metadata
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		m, err = getBoltMetadata(tx, id)
+		return err
+	})
+	return m, err
+}
+
+func (s *BoltStorage) UpdateMetadata(id string, update func(*Metadata) error) (*Metadata, error) {
+	var m *Metadata
+	err := s.db.Update(func(tx *bolt.Tx) (err error) {
+		if m, err = getBoltMetadata(tx, id); err != nil {
+			return err
+		}
+		if err := update(m); err != nil {
+			return err
+		}
+		return putBoltMetadata(tx, id, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func putBoltMetadata(tx *bolt.Tx, id string, m *Metadata) error {
+	if _, err := getBoltObject(tx, id); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding metadata: %w", err)
+	}
+	return tx.Bucket(boltMetadata).Put([]byte(id), encoded)
+}
+
+func getBoltMetadata(tx *bolt.Tx, id string) (*Metadata, error) {
+	v := tx.Bucket(boltMetadata).Get([]byte(id))
+	if v == nil {
+		return nil, &StorageNotFoundError{}
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(v, m); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	return m, nil
+}
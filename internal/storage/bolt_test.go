@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	backends["bolt"] = newTemporaryBoltStorage(filepath.Join(mustTempDir(), "soubise.bolt"))
+}
+
+func mustTempDir() string {
+	dir, err := os.MkdirTemp("", "soubise-bolt-*")
+	if err != nil {
+		panic(err)
+	}
+	return dir
+}
+
+func newTemporaryBoltStorage(path string) Storage {
+	s, err := NewBoltStorage(path)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func countChunks(t *testing.T, s *BoltStorage) int {
+	t.Helper()
+	chunks := 0
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		chunks = tx.Bucket(boltChunks).Stats().KeyN
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func TestBoltChunks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "soubise.bolt")
+	s := newTemporaryBoltStorage(path).(*BoltStorage)
+	s.chunkSize = 7
+	v := []byte("jumpsoverthelazydog")
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, s); chunks != 3 {
+		t.Fatalf("expected 3 chunks, received %d", chunks)
+	}
+
+	r, _, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeker := r.(io.ReadSeeker)
+	for _, offset := range []int64{0, 6, 7, 15, 18} {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := io.ReadAll(seeker); err != nil || !bytes.Equal(val, v[offset:]) {
+			t.Fatalf("expected %q from offset %d, received %q (%v)", v[offset:], offset, val, err)
+		}
+	}
+
+	// replacing an object drops its previous chunks
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v[:10])); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := countChunks(t, s); chunks != 2 {
+		t.Fatalf("expected 2 chunks after replacing the object, received %d", chunks)
+	}
+
+	// a Put interrupted by a crash leaves chunks behind
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltChunks).Put(chunkKeyOfBlob([]byte("crashedcrashedcrashedcra"), 0), []byte("orphaned"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = newTemporaryBoltStorage(path).(*BoltStorage)
+	defer s.db.Close()
+	if chunks := countChunks(t, s); chunks != 2 {
+		t.Fatalf("expected orphaned chunks to be removed when opening, received %d chunks", chunks)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// CachedStorage keeps recently written or read archives of a slower backend
+// in memory, evicting the least recently used once they exceed a byte budget.
+// Every hit is checked against the backend with Stat, so archives deleted by
+// another replica are not served from the cache.
+type CachedStorage struct {
+	backend Storage
+	budget  int64
+	// maxEntry keeps a single archive from evicting the whole cache
+	maxEntry int64
+
+	lock    sync.Mutex
+	used    int64
+	entries map[string]*list.Element
+	recency *list.List
+}
+
+type cacheEntry struct {
+	id      string
+	content []byte
+	modTime time.Time
+}
+
+// NewCachedStorage caches up to budget bytes of backend, Metadata is never
+// cached as it changes while being read.
+func NewCachedStorage(backend Storage, budget int64) Storage {
+	c := &CachedStorage{
+		backend:  backend,
+		budget:   budget,
+		maxEntry: budget / 4,
+		entries:  map[string]*list.Element{},
+		recency:  list.New(),
+	}
+	if native, ok := backend.(MetadataStorage); ok {
+		return &cachedMetadataStorage{CachedStorage: c, MetadataStorage: native}
+	}
+	return c
+}
+
+// cachedMetadataStorage keeps Metadata stored natively by the backend.
+type cachedMetadataStorage struct {
+	*CachedStorage
+	MetadataStorage
+}
+
+func (c *cachedMetadataStorage) PutWithMetadata(id string, data io.Reader, m *Metadata) error {
+	c.invalidate(id)
+	return c.MetadataStorage.PutWithMetadata(id, data, m)
+}
+
+func (c *cachedMetadataStorage) DeleteExpired(id string) (bool, error) {
+	c.invalidate(id)
+	if native, ok := c.MetadataStorage.(expiringStorage); ok {
+		return native.DeleteExpired(id)
+	}
+	return deleteExpiredFrom(c, id)
+}
+
+func (c *CachedStorage) cacheable(id string) bool {
+	// Metadata and upload chunks are stored next to archives
+	return IsValidId(id)
+}
+
+func (c *CachedStorage) Put(id string, data io.Reader) error {
+	c.invalidate(id)
+	if !c.cacheable(id) {
+		return c.backend.Put(id, data)
+	}
+
+	captured := &cappedBuffer{limit: c.maxEntry}
+	if err := c.backend.Put(id, io.TeeReader(data, captured)); err != nil {
+		return err
+	}
+	if captured.overflow {
+		return nil
+	}
+	if info, err := c.backend.Stat(id); err == nil {
+		c.add(id, captured.Bytes(), info.ModTime)
+	}
+	return nil
+}
+
+func (c *CachedStorage) Open(id string) (io.ReadCloser, int64, error) {
+	if !c.cacheable(id) {
+		return c.backend.Open(id)
+	}
+
+	info, err := c.backend.Stat(id)
+	if err != nil {
+		c.invalidate(id)
+		return nil, 0, err
+	}
+	if content, ok := c.get(id, info); ok {
+		return &inMemoryObject{Reader: bytes.NewReader(content)}, info.Size, nil
+	}
+
+	r, size, err := c.backend.Open(id)
+	if err != nil || size > c.maxEntry {
+		return r, size, err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.add(id, content, info.ModTime)
+	return &inMemoryObject{Reader: bytes.NewReader(content)}, size, nil
+}
+
+func (c *CachedStorage) Stat(id string) (*ObjectInfo, error) {
+	return c.backend.Stat(id)
+}
+
+func (c *CachedStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	return c.backend.List(ctx, prefix, fn)
+}
+
+func (c *CachedStorage) Delete(id string) error {
+	c.invalidate(id)
+	return c.backend.Delete(id)
+}
+
+func (c *CachedStorage) StartRepairs(ctx context.Context) {
+	startRepairs(ctx, []Storage{c.backend})
+}
+
+func (c *CachedStorage) Kind() string {
+	return "cache+" + c.backend.Kind()
+}
+
+// get returns the cached content of id, if it is still the one described by
+// info.
+func (c *CachedStorage) get(id string, info *ObjectInfo) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if int64(len(entry.content)) != info.Size || !entry.modTime.Equal(info.ModTime) {
+		c.remove(element)
+		return nil, false
+	}
+	c.recency.MoveToFront(element)
+	return entry.content, true
+}
+
+func (c *CachedStorage) add(id string, content []byte, modTime time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[id]; ok {
+		c.remove(element)
+	}
+	c.entries[id] = c.recency.PushFront(&cacheEntry{id: id, content: content, modTime: modTime})
+	c.used += int64(len(content))
+	for c.used > c.budget {
+		c.remove(c.recency.Back())
+	}
+}
+
+func (c *CachedStorage) invalidate(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[id]; ok {
+		c.remove(element)
+	}
+}
+
+// remove has to be called with lock held
+func (c *CachedStorage) remove(element *list.Element) {
+	entry := c.recency.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.id)
+	c.used -= int64(len(entry.content))
+}
+
+// cappedBuffer stops buffering once more than limit bytes were written,
+// without failing the write.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if int64(c.Len()+len(p)) > c.limit {
+		c.overflow = true
+		c.Reset()
+		return len(p), nil
+	}
+	return c.Buffer.Write(p)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/wilsonehusin/soubise/internal/broker"
+)
+
+func init() {
+	backends["cache+inmemory"] = NewCachedStorage(NewInMemoryStorage(inMemoryBroker), 1<<20)
+}
+
+// countingStorage counts how often content is read from the backend.
+type countingStorage struct {
+	Storage
+	opens int
+}
+
+func (c *countingStorage) Open(id string) (io.ReadCloser, int64, error) {
+	c.opens++
+	return c.Storage.Open(id)
+}
+
+func TestCachedStorage(t *testing.T) {
+	backend := &countingStorage{Storage: NewInMemoryStorage(&broker.InMemoryBroker{})}
+	s := NewCachedStorage(backend, 100)
+
+	ids := map[string][]byte{}
+	for _, size := range []int{20, 20, 20} {
+		id, err := NewId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[id] = bytes.Repeat([]byte("x"), size)
+		if err := s.Put(id, bytes.NewReader(ids[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(id string) error {
+		r, _, err := s.Open(id)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		val, err := io.ReadAll(r)
+		if err == nil && !bytes.Equal(val, ids[id]) {
+			t.Fatalf("expected %q, received %q", ids[id], val)
+		}
+		return err
+	}
+	for id := range ids {
+		if err := read(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.opens != 0 {
+		t.Fatalf("expected written archives to be read from the cache, backend was opened %d times", backend.opens)
+	}
+
+	large, err := NewId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids[large] = bytes.Repeat([]byte("y"), 30)
+	if err := s.Put(large, bytes.NewReader(ids[large])); err != nil {
+		t.Fatal(err)
+	}
+	if err := read(large); err != nil {
+		t.Fatal(err)
+	}
+	if backend.opens != 1 {
+		t.Fatalf("expected archive exceeding a quarter of the budget to be read from the backend, backend was opened %d times", backend.opens)
+	}
+
+	// another replica deleting the archive
+	for id := range ids {
+		if err := backend.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := read(id); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("expected archive deleted from the backend to be gone, received %v", err)
+		}
+	}
+}
+
+func TestCachedStorageEvicts(t *testing.T) {
+	backend := &countingStorage{Storage: NewInMemoryStorage(&broker.InMemoryBroker{})}
+	s := NewCachedStorage(backend, 100).(*CachedStorage)
+
+	var ids []string
+	for i := 0; i < 6; i++ {
+		id, err := NewId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		if err := s.Put(id, bytes.NewReader(bytes.Repeat([]byte("x"), 20))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.used != 100 || len(s.entries) != 5 {
+		t.Fatalf("expected 5 archives within budget, received %d archives of %d bytes", len(s.entries), s.used)
+	}
+	if _, ok := s.entries[ids[0]]; ok {
+		t.Fatal("expected least recently used archive to be evicted")
+	}
+}
+
+func TestCachedStorageKeepsNativeMetadata(t *testing.T) {
+	if _, ok := NewCachedStorage(newTemporarySQLiteStorage(), 100).(MetadataStorage); !ok {
+		t.Fatal("expected cache to store Metadata natively when its backend does")
+	}
+	if _, ok := NewCachedStorage(NewInMemoryStorage(&broker.InMemoryBroker{}), 100).(MetadataStorage); ok {
+		t.Fatal("expected cache to store Metadata as objects when its backend does")
+	}
+}
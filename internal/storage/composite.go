@@ -0,0 +1,183 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// deleteLock is held while deleting objects spanning several backends, so that
+// repairs tell whether a Delete raced with them, across replicas once
+// SetBroker was called
+var deleteLock sync.Locker = &sync.Mutex{}
+
+// repairQueueSize is how many repairs can be pending before further ones are
+// dropped, until the object is read again
+const repairQueueSize = 1024
+
+// Repairer is implemented by storages spanning several backends, which only
+// read from them until StartRepairs was called, so that e.g. a migration does
+// not write to its source.
+type Repairer interface {
+	// StartRepairs repairs objects some backends are missing in the
+	// background until ctx is done
+	StartRepairs(ctx context.Context)
+}
+
+// StartRepairs starts repairing the configured storage, if it spans several
+// backends.
+func StartRepairs(ctx context.Context) {
+	if r, ok := storageProvider.(Repairer); ok {
+		r.StartRepairs(ctx)
+	}
+}
+
+// startRepairs starts repairing backends which span several backends
+// themselves.
+func startRepairs(ctx context.Context, backends []Storage) {
+	for _, backend := range backends {
+		if r, ok := backend.(Repairer); ok {
+			r.StartRepairs(ctx)
+		}
+	}
+}
+
+// repairQueue repairs objects of a storage spanning several backends one at a
+// time in the background, e.g. after replacing a disk.
+type repairQueue struct {
+	name    string
+	repair  func(id string) error
+	ids     chan string
+	pending sync.Map
+	once    sync.Once
+	started int32
+}
+
+func newRepairQueue(name string, repair func(id string) error) *repairQueue {
+	return &repairQueue{
+		name:   name,
+		repair: repair,
+		ids:    make(chan string, repairQueueSize),
+	}
+}
+
+// start checks every object listed by s, then repairs whatever is scheduled
+// until ctx is done.
+func (q *repairQueue) start(ctx context.Context, s Storage) {
+	q.once.Do(func() {
+		atomic.StoreInt32(&q.started, 1)
+		go q.run(ctx)
+		go q.checkAll(ctx, s)
+	})
+}
+
+// schedule queues id for a repair, unless repairs were not started.
+func (q *repairQueue) schedule(id string) {
+	if atomic.LoadInt32(&q.started) == 0 {
+		return
+	}
+	if _, pending := q.pending.LoadOrStore(id, true); pending {
+		return
+	}
+	select {
+	case q.ids <- id:
+	default:
+		q.pending.Delete(id)
+	}
+}
+
+func (q *repairQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-q.ids:
+			if err := q.repair(id); err != nil {
+				log.Error().Err(err).Str("Id", id).Msgf("repairing %s object", q.name)
+			}
+			q.pending.Delete(id)
+		}
+	}
+}
+
+// checkAll repairs every object listed by s.
+func (q *repairQueue) checkAll(ctx context.Context, s Storage) {
+	repaired := 0
+	err := s.List(ctx, "", func(id string) error {
+		if err := q.repair(id); err != nil {
+			log.Error().Err(err).Str("Id", id).Msgf("repairing %s object", q.name)
+		} else {
+			repaired++
+		}
+		return nil
+	})
+	log.Err(err).Int("Objects", repaired).Msgf("checked %s objects", q.name)
+}
+
+// listAll calls fn once for every object stored in any of backends.
+func listAll(ctx context.Context, backends []Storage, prefix string, fn func(id string) error) error {
+	listed := map[string]bool{}
+	var fnErr, firstErr error
+	for _, backend := range backends {
+		err := backend.List(ctx, prefix, func(id string) error {
+			if listed[id] {
+				return nil
+			}
+			listed[id] = true
+			fnErr = fn(id)
+			return fnErr
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		if err != nil && firstErr == nil {
+			// an unavailable backend does not keep others from being listed
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// deleteAll removes id from every one of backends, it fails if any backend
+// could not delete it, since a repair would bring it back.
+func deleteAll(backends []Storage, id string) error {
+	deleted := false
+	var firstErr error
+	for _, backend := range backends {
+		err := backend.Delete(id)
+		if err == nil {
+			deleted = true
+		} else if !errors.As(err, new(*StorageNotFoundError)) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if !deleted {
+		return &StorageNotFoundError{}
+	}
+	return nil
+}
@@ -0,0 +1,563 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// erasureBlockSize is how many bytes of an object each shard holds per
+	// stripe, objects smaller than a stripe use smaller blocks instead
+	erasureBlockSize = 1 << 20
+
+	erasureMagic   = "SBEC"
+	erasureVersion = 2
+	// erasureFooterSize is magic, version, shard index, data and parity shard
+	// counts, block size, object size and generation
+	erasureFooterSize = 4 + 1 + 1 + 1 + 1 + 4 + 8 + 8
+	// every block is followed by its CRC-32, telling apart corrupted shards
+	erasureChecksumSize = 4
+)
+
+// ErasureStorage splits every object into data shards and computes parity
+// shards for them with Reed-Solomon, storing shard i in backend i. Objects are
+// readable as long as no more than parity shards are missing or corrupted, and
+// missing shards are rebuilt in the background once StartRepairs was called.
+//
+// Shards are a sequence of stripes, each block followed by its checksum, and
+// end with a footer describing the object. The footer names the generation of
+// the object, so that shards of different versions are never mixed.
+type ErasureStorage struct {
+	backends []Storage
+	data     int
+	parity   int
+	enc      reedsolomon.Encoder
+	repairs  *repairQueue
+}
+
+type erasureFooter struct {
+	Index     int
+	Data      int
+	Parity    int
+	BlockSize int64
+	Size      int64
+	// Generation is when the object was stored, shards rebuilt by a repair
+	// keep the generation of the shards they were rebuilt from
+	Generation int64
+}
+
+// NewErasureStorage stores objects as data+parity shards, which requires as
+// many backends.
+func NewErasureStorage(data, parity int, backends ...Storage) (Storage, error) {
+	if len(backends) != data+parity {
+		return nil, fmt.Errorf("%d data and %d parity shards require %d backends, received %d", data, parity, data+parity, len(backends))
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	e := &ErasureStorage{
+		backends: backends,
+		data:     data,
+		parity:   parity,
+		enc:      enc,
+	}
+	e.repairs = newRepairQueue("erasure-coded", e.repair)
+	return e, nil
+}
+
+// StartRepairs rebuilds shards which are missing or corrupted, along with the
+// backends' own repairs.
+func (e *ErasureStorage) StartRepairs(ctx context.Context) {
+	startRepairs(ctx, e.backends)
+	e.repairs.start(ctx, e)
+}
+
+// Put succeeds once enough shards to read an archive back were stored,
+// missing ones are rebuilt through a repair. Objects which are overwritten in
+// place, such as Metadata, have to be stored in every shard, as reading
+// shards of the previous version alone would not notice the update.
+func (e *ErasureStorage) Put(id string, data io.Reader) error {
+	targets := make([]int, len(e.backends))
+	for i := range targets {
+		targets[i] = i
+	}
+	errs, err := e.putShards(id, data, targets, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	stored := 0
+	for i, err := range errs {
+		if err == nil {
+			stored++
+		} else {
+			log.Error().Err(err).Str("Id", id).Str("Storage", e.backends[i].Kind()).Msg("storing shard")
+		}
+	}
+	if stored < e.data {
+		for _, err := range errs {
+			if err != nil {
+				return fmt.Errorf("only %d of %d shards stored: %w", stored, len(e.backends), err)
+			}
+		}
+	}
+	if stored < len(e.backends) && mutable(id) {
+		for _, err := range errs {
+			if err != nil {
+				return fmt.Errorf("only %d of %d shards stored: %w", stored, len(e.backends), err)
+			}
+		}
+	}
+	if stored < len(e.backends) {
+		e.repairs.schedule(id)
+	}
+	return nil
+}
+
+// putShards encodes data and stores the shards numbered targets of generation,
+// returning the error of each backend in targets order. Encoding is
+// deterministic, shards stored by an earlier Put of the same content and
+// generation are rebuilt as they were.
+func (e *ErasureStorage) putShards(id string, data io.Reader, targets []int, generation int64) ([]error, error) {
+	writers := make([]*io.PipeWriter, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, shard := range targets {
+		r, w := io.Pipe()
+		writers[i] = w
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			errs[i] = backend.Put(id, r)
+			r.CloseWithError(fmt.Errorf("%s stopped reading", backend.Kind()))
+		}(i, e.backends[shard])
+	}
+
+	readErr := e.encode(data, targets, writers, generation)
+	for _, w := range writers {
+		if readErr != nil {
+			w.CloseWithError(readErr)
+		} else {
+			w.Close()
+		}
+	}
+	wg.Wait()
+	if readErr != nil {
+		return nil, readErr
+	}
+	return errs, nil
+}
+
+// encode writes shards numbered targets of every stripe read from data to the
+// respective writer until writing to it fails, returning only errors from
+// reading data.
+func (e *ErasureStorage) encode(data io.Reader, targets []int, writers []*io.PipeWriter, generation int64) error {
+	live := make([]bool, len(writers))
+	for i := range live {
+		live[i] = true
+	}
+	write := func(i int, p []byte) {
+		if live[i] {
+			if _, err := writers[i].Write(p); err != nil {
+				live[i] = false
+			}
+		}
+	}
+
+	buf := make([]byte, e.data*erasureBlockSize)
+	shards := make([][]byte, e.data+e.parity)
+	checksum := make([]byte, erasureChecksumSize)
+	var blockSize, size int64
+	for stripe := 0; ; stripe++ {
+		n, err := io.ReadFull(data, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if stripe == 0 {
+			blockSize = erasureBlockSize
+			if last {
+				// small objects fit in one stripe of smaller blocks
+				blockSize = (int64(n) + int64(e.data) - 1) / int64(e.data)
+			}
+		}
+		if n > 0 {
+			size += int64(n)
+			stripeSize := int64(e.data) * blockSize
+			for i := int64(n); i < stripeSize; i++ {
+				buf[i] = 0
+			}
+			for i := range shards {
+				if i < e.data {
+					shards[i] = buf[int64(i)*blockSize : int64(i+1)*blockSize]
+				} else if int64(len(shards[i])) != blockSize {
+					shards[i] = make([]byte, blockSize)
+				}
+			}
+			if err := e.enc.Encode(shards); err != nil {
+				return err
+			}
+			for i, shard := range targets {
+				binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(shards[shard]))
+				write(i, shards[shard])
+				write(i, checksum)
+			}
+		}
+		if last {
+			break
+		}
+	}
+
+	for i, shard := range targets {
+		write(i, e.footer(erasureFooter{
+			Index:      shard,
+			Data:       e.data,
+			Parity:     e.parity,
+			BlockSize:  blockSize,
+			Size:       size,
+			Generation: generation,
+		}))
+	}
+	return nil
+}
+
+func (e *ErasureStorage) footer(f erasureFooter) []byte {
+	footer := make([]byte, erasureFooterSize)
+	copy(footer, erasureMagic)
+	footer[4] = erasureVersion
+	footer[5] = byte(f.Index)
+	footer[6] = byte(f.Data)
+	footer[7] = byte(f.Parity)
+	binary.BigEndian.PutUint32(footer[8:], uint32(f.BlockSize))
+	binary.BigEndian.PutUint64(footer[12:], uint64(f.Size))
+	binary.BigEndian.PutUint64(footer[20:], uint64(f.Generation))
+	return footer
+}
+
+// openShard opens shard i of id and reads its footer.
+func (e *ErasureStorage) openShard(id string, i int) (io.ReadSeekCloser, *erasureFooter, error) {
+	r, size, err := e.backends[i].Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	shard, ok := r.(io.ReadSeekCloser)
+	if !ok {
+		r.Close()
+		return nil, nil, fmt.Errorf("%s does not support seeking", e.backends[i].Kind())
+	}
+	f, err := e.readFooter(shard, size)
+	if err == nil && (f.Index != i || f.Data != e.data || f.Parity != e.parity) {
+		err = fmt.Errorf("shard %d of %d+%d stored as shard %d of %d+%d", i, e.data, e.parity, f.Index, f.Data, f.Parity)
+	}
+	if err != nil {
+		shard.Close()
+		return nil, nil, &ErasureShardError{Shard: i, Err: err}
+	}
+	return shard, f, nil
+}
+
+func (e *ErasureStorage) readFooter(shard io.ReadSeeker, size int64) (*erasureFooter, error) {
+	if size < erasureFooterSize {
+		return nil, errors.New("shard is truncated")
+	}
+	footer := make([]byte, erasureFooterSize)
+	if _, err := shard.Seek(size-erasureFooterSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(shard, footer); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[:4], []byte(erasureMagic)) || footer[4] != erasureVersion {
+		return nil, errors.New("shard has no valid footer")
+	}
+	f := &erasureFooter{
+		Index:      int(footer[5]),
+		Data:       int(footer[6]),
+		Parity:     int(footer[7]),
+		BlockSize:  int64(binary.BigEndian.Uint32(footer[8:])),
+		Size:       int64(binary.BigEndian.Uint64(footer[12:])),
+		Generation: int64(binary.BigEndian.Uint64(footer[20:])),
+	}
+	stripes := int64(0)
+	if f.BlockSize > 0 {
+		stripes = (f.Size + int64(f.Data)*f.BlockSize - 1) / (int64(f.Data) * f.BlockSize)
+	}
+	if stripes*(f.BlockSize+erasureChecksumSize)+erasureFooterSize != size {
+		return nil, errors.New("shard size does not match its footer")
+	}
+	return f, nil
+}
+
+func (e *ErasureStorage) Open(id string) (io.ReadCloser, int64, error) {
+	o, missing, err := e.open(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if missing {
+		e.repairs.schedule(id)
+	}
+	return o, o.size, nil
+}
+
+// open reads the footer of every shard, reporting whether any is missing.
+// Shards of the latest generation with enough shards to read the object are
+// used, others are left from an interrupted Put and treated as missing.
+func (e *ErasureStorage) open(id string) (*erasureObject, bool, error) {
+	shards := make([]io.ReadSeekCloser, len(e.backends))
+	footers := make([]*erasureFooter, len(e.backends))
+	generations := map[int64]int{}
+	var lastErr error = &StorageNotFoundError{}
+	available, missing := 0, false
+	for i := range e.backends {
+		shard, f, err := e.openShard(id, i)
+		if err != nil {
+			missing = true
+			if !errors.As(err, new(*StorageNotFoundError)) {
+				log.Error().Err(err).Str("Id", id).Str("Storage", e.backends[i].Kind()).Msg("opening shard")
+				lastErr = err
+			}
+			continue
+		}
+		shards[i], footers[i] = shard, f
+		generations[f.Generation]++
+		available++
+	}
+
+	var footer *erasureFooter
+	for _, f := range footers {
+		if f != nil && generations[f.Generation] >= e.data && (footer == nil || f.Generation > footer.Generation) {
+			footer = f
+		}
+	}
+	o := &erasureObject{
+		e:      e,
+		footer: footer,
+		shards: make([]io.ReadSeekCloser, len(e.backends)),
+	}
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if footer == nil || footers[i].Generation != footer.Generation || footers[i].Size != footer.Size || footers[i].BlockSize != footer.BlockSize {
+			shard.Close()
+			missing = true
+			lastErr = &ErasureShardError{Shard: i, Err: errors.New("shard does not match other shards")}
+			continue
+		}
+		o.shards[i] = shard
+	}
+	if footer == nil {
+		if available == 0 {
+			return nil, missing, lastErr
+		}
+		return nil, missing, fmt.Errorf("fewer than %d of %d shards of one generation available: %w", e.data, len(e.backends), lastErr)
+	}
+	o.size = o.footer.Size
+	o.chunkedObject = newChunkedObject(o.size, int64(e.data)*o.footer.BlockSize, o.readStripe)
+	return o, missing, nil
+}
+
+// erasureObject reads stripes of an object from its shards as needed,
+// reconstructing data shards which are missing or corrupted.
+type erasureObject struct {
+	*chunkedObject
+	e      *ErasureStorage
+	footer *erasureFooter
+	size   int64
+	shards []io.ReadSeekCloser
+}
+
+func (o *erasureObject) readStripe(seq int64) ([]byte, error) {
+	blockSize := o.footer.BlockSize
+	blocks := make([][]byte, len(o.shards))
+	read := 0
+	for i, shard := range o.shards {
+		if read == o.e.data {
+			break
+		}
+		if shard == nil {
+			continue
+		}
+		block, err := o.readBlock(shard, seq)
+		if err != nil {
+			log.Error().Err(&ErasureShardError{Shard: i, Err: err}).Int64("Stripe", seq).Msg("reading shard")
+			shard.Close()
+			o.shards[i] = nil
+			continue
+		}
+		blocks[i] = block
+		read++
+	}
+	if read < o.e.data {
+		return nil, fmt.Errorf("only %d of %d required shards readable", read, o.e.data)
+	}
+	if err := o.e.enc.ReconstructData(blocks); err != nil {
+		return nil, err
+	}
+
+	stripe := make([]byte, 0, int64(o.e.data)*blockSize)
+	for _, block := range blocks[:o.e.data] {
+		stripe = append(stripe, block...)
+	}
+	if remaining := o.size - seq*int64(len(stripe)); remaining < int64(len(stripe)) {
+		stripe = stripe[:remaining]
+	}
+	return stripe, nil
+}
+
+func (o *erasureObject) readBlock(shard io.ReadSeeker, seq int64) ([]byte, error) {
+	block := make([]byte, o.footer.BlockSize+erasureChecksumSize)
+	if _, err := shard.Seek(seq*int64(len(block)), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(shard, block); err != nil {
+		return nil, err
+	}
+	data, checksum := block[:o.footer.BlockSize], block[o.footer.BlockSize:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(checksum) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
+
+func (o *erasureObject) Close() error {
+	for _, shard := range o.shards {
+		if shard != nil {
+			shard.Close()
+		}
+	}
+	return nil
+}
+
+func (e *ErasureStorage) Stat(id string) (*ObjectInfo, error) {
+	o, _, err := e.open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+	for i, shard := range o.shards {
+		if shard == nil {
+			continue
+		}
+		info, err := e.backends[i].Stat(id)
+		if err != nil {
+			return nil, err
+		}
+		return &ObjectInfo{Size: o.size, ModTime: info.ModTime}, nil
+	}
+	return nil, &StorageNotFoundError{}
+}
+
+// List calls fn once for every object with a shard in any backend.
+func (e *ErasureStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	return listAll(ctx, e.backends, prefix, fn)
+}
+
+// Delete removes every shard of the object.
+func (e *ErasureStorage) Delete(id string) error {
+	if _, err := lock(deleteLock); err != nil {
+		return err
+	}
+	defer deleteLock.Unlock()
+	return deleteAll(e.backends, id)
+}
+
+func (e *ErasureStorage) Kind() string {
+	kinds := make([]string, len(e.backends))
+	for i, backend := range e.backends {
+		kinds[i] = backend.Kind()
+	}
+	return fmt.Sprintf("erasure:%d+%d:%s", e.data, e.parity, strings.Join(kinds, ","))
+}
+
+// repair rebuilds shards of id which are missing from their backend, unusable
+// or of another generation. Objects deleted while being repaired are removed
+// again.
+func (e *ErasureStorage) repair(id string) error {
+	o, _, err := e.open(id)
+	if errors.As(err, new(*StorageNotFoundError)) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var missing, sources []int
+	for i, shard := range o.shards {
+		if shard == nil {
+			missing = append(missing, i)
+		} else {
+			sources = append(sources, i)
+		}
+	}
+	if len(missing) == 0 {
+		o.Close()
+		return nil
+	}
+	errs, err := e.putShards(id, o, missing, o.footer.Generation)
+	o.Close()
+	if err != nil {
+		return err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("rebuilding shard %d in %s: %w", missing[i], e.backends[missing[i]].Kind(), err)
+		}
+		log.Info().Str("Id", id).Int("Shard", missing[i]).Str("Storage", e.backends[missing[i]].Kind()).Msg("rebuilt shard")
+	}
+
+	// Delete holds deleteLock throughout, a source found missing here means
+	// the object was deleted and what was rebuilt meanwhile has to go too
+	if _, err := lock(deleteLock); err != nil {
+		return err
+	}
+	defer deleteLock.Unlock()
+	for _, i := range sources {
+		if _, err := e.backends[i].Stat(id); errors.As(err, new(*StorageNotFoundError)) {
+			log.Info().Str("Id", id).Msg("erasure-coded object was deleted while being repaired")
+			return deleteAll(e.backends, id)
+		}
+	}
+	return nil
+}
+
+type ErasureShardError struct {
+	Shard int
+	Err   error
+}
+
+const ErasureShardErrorString = "unusable shard"
+
+func (s *ErasureShardError) Error() string {
+	return fmt.Sprintf("%s %d: %v", ErasureShardErrorString, s.Shard, s.Err)
+}
+
+func (s *ErasureShardError) Unwrap() error {
+	return s.Err
+}
@@ -0,0 +1,256 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/broker"
+)
+
+func init() {
+	s, err := NewErasureStorage(2, 1, NewInMemoryStorage(inMemoryBroker), NewInMemoryStorage(inMemoryBroker), NewInMemoryStorage(inMemoryBroker))
+	if err != nil {
+		panic(err)
+	}
+	backends["erasure"] = s
+}
+
+func newErasureBackends(n int) []Storage {
+	backends := make([]Storage, n)
+	for i := range backends {
+		backends[i] = NewInMemoryStorage(&broker.InMemoryBroker{})
+	}
+	return backends
+}
+
+func TestErasureStorage(t *testing.T) {
+	shards := newErasureBackends(5)
+	s, err := NewErasureStorage(3, 2, shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	s.(Repairer).StartRepairs(ctx)
+	// spans several stripes, the last one partially
+	v := make([]byte, 7*erasureBlockSize+12345)
+	if _, err := rand.Read(v); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		info, err := shard.Stat("thequickbrownfox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size > int64(len(v))/2 {
+			t.Fatalf("expected shard %d to hold a third of the object, received %d bytes", i, info.Size)
+		}
+	}
+
+	// losing as many disks as there are parity shards, including a data shard
+	for _, i := range []int{0, 3} {
+		if err := shards[i].Delete("thequickbrownfox"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, size, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(v)) {
+		t.Fatalf("expected %d bytes, received %d", len(v), size)
+	}
+	if _, err := r.(io.Seeker).Seek(int64(len(v))-20000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := io.ReadAll(r); err != nil || !bytes.Equal(val, v[len(v)-20000:]) {
+		t.Fatalf("expected object to be reconstructed, received %d bytes (%v)", len(val), err)
+	}
+	r.Close()
+	waitForObject(t, shards[0], "thequickbrownfox")
+	waitForObject(t, shards[3], "thequickbrownfox")
+
+	// corrupting a shard, detected by its checksum
+	r, shardSize, err := shards[1].Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted, _ := io.ReadAll(r)
+	corrupted[shardSize/2] ^= 0xff
+	if err := shards[1].Put("thequickbrownfox", bytes.NewReader(corrupted)); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := io.ReadAll(r); err != nil || !bytes.Equal(val, v) {
+		t.Fatalf("expected corrupted shard to be reconstructed, received %d bytes (%v)", len(val), err)
+	}
+
+	for _, i := range []int{0, 1, 2} {
+		if err := shards[i].Delete("thequickbrownfox"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := s.Open("thequickbrownfox"); err == nil {
+		t.Fatal("expected object to be unreadable with more missing shards than parity")
+	}
+}
+
+func TestErasureStorageSmallObjects(t *testing.T) {
+	s, err := NewErasureStorage(4, 2, newErasureBackends(6)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range [][]byte{{}, []byte("a"), []byte("jumpsoverthelazydog")} {
+		if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+			t.Fatal(err)
+		}
+		r, size, err := s.Open("thequickbrownfox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || size != int64(len(v)) || !bytes.Equal(val, v) {
+			t.Fatalf("expected %q, received %q of %d bytes (%v)", v, val, size, err)
+		}
+	}
+}
+
+func TestErasureStorageToleratesFailure(t *testing.T) {
+	shards := newErasureBackends(3)
+	shards[2] = &unavailableStorage{Storage: shards[2]}
+	s, err := NewErasureStorage(2, 1, shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsoverthelazydog"))); err != nil {
+		t.Fatalf("expected Put to succeed with enough shards stored, received %v", err)
+	}
+
+	shards = []Storage{shards[0], &unavailableStorage{Storage: shards[1]}, shards[2]}
+	if s, err = NewErasureStorage(2, 1, shards...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("lazydog", bytes.NewReader([]byte("jumpsoverthelazydog"))); err == nil {
+		t.Fatal("expected Put to fail with fewer shards stored than data shards")
+	}
+
+	if _, err := NewErasureStorage(2, 2, shards...); err == nil {
+		t.Fatal("expected backends not matching shards to be rejected")
+	}
+}
+
+func TestErasureStorageGenerations(t *testing.T) {
+	shards := newErasureBackends(3)
+	s, err := NewErasureStorage(2, 1, shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	s.(Repairer).StartRepairs(ctx)
+	previous, current := []byte(`{"downloads":1}`), []byte(`{"downloads":2}`)
+	if err := s.Put("thequickbrownfox.meta", bytes.NewReader(previous)); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := shards[0].Open("thequickbrownfox.meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := io.ReadAll(r)
+	r.Close()
+	if err := s.Put("thequickbrownfox.meta", bytes.NewReader(current)); err != nil {
+		t.Fatal(err)
+	}
+	// a shard which missed an update of the same size
+	if err := shards[0].Put("thequickbrownfox.meta", bytes.NewReader(stale)); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = s.Open("thequickbrownfox.meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := io.ReadAll(r); err != nil || !bytes.Equal(val, current) {
+		t.Fatalf("expected %q, received %q (%v)", current, val, err)
+	}
+	r.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r, _, err := shards[0].Open("thequickbrownfox.meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rebuilt, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(rebuilt, stale) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected stale shard to be rebuilt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	shards = []Storage{shards[0], &unavailableStorage{Storage: shards[1]}, shards[2]}
+	if s, err = NewErasureStorage(2, 1, shards...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("thequickbrownfox.meta", bytes.NewReader(previous)); err == nil {
+		t.Fatal("expected metadata to require every shard")
+	}
+}
+
+func TestErasureStorageRepairDoesNotResurrect(t *testing.T) {
+	shards := newErasureBackends(3)
+	s, err := NewErasureStorage(2, 1, shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsoverthelazydog"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := shards[0].Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	racing := &ErasureStorage{
+		backends: []Storage{&deletingStorage{Storage: shards[0], source: shards[1]}, shards[1], shards[2]},
+		data:     2,
+		parity:   1,
+		enc:      s.(*ErasureStorage).enc,
+	}
+	if err := racing.repair("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards {
+		if _, err := shard.Stat("thequickbrownfox"); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("expected shard %d deleted during repair to stay deleted, received %v", i, err)
+		}
+	}
+}
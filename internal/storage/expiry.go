@@ -17,11 +17,80 @@ limitations under the License.
 package storage
 
 import (
+	"container/heap"
+	"errors"
+	"sync"
 	"time"
 )
 
+// ExpiryHeap is only kept in memory of each replica, which schedules archives
+// it stored or found when booting. Archives stored by a replica which went
+// away are deleted by the others once they reboot, until then they are
+// refused as expired rather than deleted.
 var ExpiryHeap = &ExpiryTags{}
 
+// expiryLock guards ExpiryHeap, which is pushed to by requests while being
+// swept in the background
+var expiryLock sync.Mutex
+
+// ScheduleExpiry makes id part of the tags returned by PopExpired after expiry.
+func ScheduleExpiry(id string, expiry time.Time) {
+	expiryLock.Lock()
+	heap.Push(ExpiryHeap, ExpiryTag{Id: id, Expiry: expiry})
+	expiryLock.Unlock()
+}
+
+// PopExpired removes every tag which has expired from ExpiryHeap.
+func PopExpired() []ExpiryTag {
+	expiryLock.Lock()
+	defer expiryLock.Unlock()
+
+	var expired []ExpiryTag
+	for ExpiryHeap.Len() > 0 && (*ExpiryHeap)[0].HasExpired() {
+		expired = append(expired, heap.Pop(ExpiryHeap).(ExpiryTag))
+	}
+	return expired
+}
+
+// expiringStorage is implemented by backends which check the expiry in the
+// same transaction as deleting the archive.
+type expiringStorage interface {
+	DeleteExpired(id string) (bool, error)
+}
+
+// DeleteExpired deletes id along with its Metadata unless its expiry was
+// extended since it was scheduled, which is reported as false. Archives
+// without Metadata are deleted.
+func DeleteExpired(id string) (bool, error) {
+	if storageProvider == nil {
+		return false, &UninitializedStorageError{}
+	}
+	if native, ok := storageProvider.(expiringStorage); ok {
+		return native.DeleteExpired(id)
+	}
+	return deleteExpiredFrom(storageProvider, id)
+}
+
+// deleteExpiredFrom re-checks the expiry of id in s under metadataLock, which
+// is held by every update of Metadata stored as a separate object.
+func deleteExpiredFrom(s Storage, id string) (bool, error) {
+	held, err := lock(metadataLock)
+	if err != nil {
+		return false, err
+	}
+	defer metadataLock.Unlock()
+	m, err := GetMetadataFrom(s, id)
+	if err == nil && !m.HasExpired() {
+		return false, nil
+	} else if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+		return false, err
+	}
+	if err := stillHeld(held); err != nil {
+		return false, err
+	}
+	return true, DeleteFrom(s, id)
+}
+
 type ExpiryTag struct {
 	Id     string
 	Expiry time.Time
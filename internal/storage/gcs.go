@@ -0,0 +1,162 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// gcsChunkSize is the size of each request of a resumable upload, an
+// interrupted request is retried from the last chunk GCS acknowledged
+const gcsChunkSize = 16 << 20
+
+type GCSConfig struct {
+	Bucket string
+	// Prefix is prepended to the name of every object
+	Prefix string
+	// CredentialsFile is a service account JSON key, otherwise the
+	// application default credentials are used
+	CredentialsFile string
+	// Endpoint overrides the GCS endpoint. Emulators, which do not
+	// authenticate requests, are configured with STORAGE_EMULATOR_HOST instead
+	Endpoint string
+	// ChunkSize overrides gcsChunkSize
+	ChunkSize int
+}
+
+type GCSStorage struct {
+	config GCSConfig
+	bucket *gcs.BucketHandle
+}
+
+func NewGCSStorage(config GCSConfig) (Storage, error) {
+	var options []option.ClientOption
+	if config.CredentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(config.CredentialsFile))
+	}
+	if config.Endpoint != "" {
+		options = append(options, option.WithEndpoint(config.Endpoint))
+	}
+	client, err := gcs.NewClient(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	return newGCSStorageWithClient(client, config)
+}
+
+func newGCSStorageWithClient(client *gcs.Client, config GCSConfig) (Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("gcs storage requires a bucket")
+	}
+	if config.ChunkSize == 0 {
+		config.ChunkSize = gcsChunkSize
+	}
+	// names are joined with the prefix, while listing appends a separator
+	config.Prefix = strings.TrimSuffix(config.Prefix, "/")
+	return &GCSStorage{
+		config: config,
+		bucket: client.Bucket(config.Bucket),
+	}, nil
+}
+
+func (s *GCSStorage) object(id string) *gcs.ObjectHandle {
+	return s.bucket.Object(path.Join(s.config.Prefix, id))
+}
+
+func (s *GCSStorage) Put(id string, data io.Reader) error {
+	// cancelling the context aborts the upload, so that a partial object is
+	// never stored
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := s.object(id).NewWriter(ctx)
+	w.ChunkSize = s.config.ChunkSize
+	if _, err := io.Copy(w, data); err != nil {
+		// the upload only notices the cancellation eventually, failing it
+		// right away keeps Close from completing it in the meantime
+		_ = w.CloseWithError(err)
+		cancel()
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (s *GCSStorage) Open(id string) (io.ReadCloser, int64, error) {
+	ctx := context.Background()
+	r, err := s.object(id).NewReader(ctx)
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return nil, 0, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, 0, err
+	}
+	size := r.Attrs.Size
+	openAt := func(offset int64) (io.ReadCloser, error) {
+		return s.object(id).NewRangeReader(ctx, offset, -1)
+	}
+	return newRangedObject(r, size, openAt), size, nil
+}
+
+func (s *GCSStorage) Stat(id string) (*ObjectInfo, error) {
+	attrs, err := s.object(id).Attrs(context.Background())
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return nil, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (s *GCSStorage) Delete(id string) error {
+	err := s.object(id).Delete(context.Background())
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return &StorageNotFoundError{}
+	}
+	return err
+}
+
+func (s *GCSStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	namePrefix := ""
+	if s.config.Prefix != "" {
+		namePrefix = s.config.Prefix + "/"
+	}
+	objects := s.bucket.Objects(ctx, &gcs.Query{Prefix: namePrefix + prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(strings.TrimPrefix(attrs.Name, namePrefix)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *GCSStorage) Kind() string {
+	return "gcs"
+}
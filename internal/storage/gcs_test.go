@@ -0,0 +1,94 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func init() {
+	backends["gcs"] = newFakeGCSStorage(0, "archives")
+}
+
+// newFakeGCSStorage serves an in-memory bucket, the server lives as long as
+// the test binary does.
+func newFakeGCSStorage(chunkSize int, prefix string) Storage {
+	server := fakestorage.NewServer(nil)
+	server.CreateBucket("soubise")
+	s, err := newGCSStorageWithClient(server.Client(), GCSConfig{
+		Bucket:    "soubise",
+		Prefix:    prefix,
+		ChunkSize: chunkSize,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestGCSResumableUpload(t *testing.T) {
+	s := newFakeGCSStorage(256<<10, "archives")
+	v := bytes.Repeat([]byte("jumpsoverthelazydog"), 1<<16)
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, size, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if size != int64(len(v)) {
+		t.Fatalf("expected %d bytes, received %d", len(v), size)
+	}
+	seeker := r.(io.ReadSeeker)
+	if _, err := seeker.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if tail, err := io.ReadAll(seeker); err != nil || !bytes.Equal(tail, v[len(v)-10:]) {
+		t.Fatalf("expected %q after seeking, received %q (%v)", v[len(v)-10:], tail, err)
+	}
+
+	if err := s.Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open("thequickbrownfox"); err == nil {
+		t.Fatal("expected object to have been deleted")
+	}
+}
+
+func TestGCSPrefixSeparator(t *testing.T) {
+	s := newFakeGCSStorage(0, "shares/")
+	if err := s.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsover"))); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	if err := s.List(context.Background(), "", func(id string) error {
+		listed = append(listed, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "thequickbrownfox" {
+		t.Fatalf("expected thequickbrownfox to be listed, received %v", listed)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"encoding/base64"
+
+	"github.com/wilsonehusin/soubise/internal/crypto"
+)
+
+// Object identifiers double as capabilities: knowing one is sufficient to
+// retrieve the (encrypted) archive, hence they carry 144 bits of entropy.
+const idByteLength = 18
+
+var idLength = base64.URLEncoding.EncodedLen(idByteLength)
+
+func NewId() (string, error) {
+	id, err := crypto.RandLen(idByteLength)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// IsValidId reports whether id could have been issued by NewId, allowing
+// malformed or forged identifiers to be rejected before reaching storage.
+func IsValidId(id string) bool {
+	if len(id) != idLength {
+		return false
+	}
+	decoded, err := base64.URLEncoding.DecodeString(id)
+	return err == nil && len(decoded) == idByteLength
+}
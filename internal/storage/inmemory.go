@@ -17,42 +17,98 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
 	"github.com/wilsonehusin/soubise/internal/broker"
 )
 
 type InMemoryStorage struct {
-	broker broker.Broker
-	data   map[string][]byte
+	broker   broker.Broker
+	data     map[string][]byte
+	modTimes map[string]time.Time
 }
 
 func NewInMemoryStorage(b broker.Broker) Storage {
 	return &InMemoryStorage{
-		broker: b,
-		data:   map[string][]byte{},
+		broker:   b,
+		data:     map[string][]byte{},
+		modTimes: map[string]time.Time{},
 	}
 }
 
-func (s *InMemoryStorage) Create(id string, value []byte) error {
+func (s *InMemoryStorage) Put(id string, data io.Reader) error {
+	value, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
 	s.broker.Lock()
 	s.data[id] = value
+	s.modTimes[id] = time.Now()
 	s.broker.Unlock()
 	return nil
 }
 
-func (s *InMemoryStorage) Get(id string) ([]byte, error) {
+func (s *InMemoryStorage) Open(id string) (io.ReadCloser, int64, error) {
 	s.broker.RLock()
-	value := s.data[id]
+	value, ok := s.data[id]
 	s.broker.RUnlock()
-	if value == nil {
-		return []byte{}, &StorageNotFoundError{}
+	if !ok {
+		return nil, 0, &StorageNotFoundError{}
+	}
+	return &inMemoryObject{Reader: bytes.NewReader(value)}, int64(len(value)), nil
+}
+
+type inMemoryObject struct {
+	*bytes.Reader
+}
+
+func (o *inMemoryObject) Close() error {
+	return nil
+}
+
+func (s *InMemoryStorage) Stat(id string) (*ObjectInfo, error) {
+	s.broker.RLock()
+	defer s.broker.RUnlock()
+	value, ok := s.data[id]
+	if !ok {
+		return nil, &StorageNotFoundError{}
 	}
-	return value, nil
+	return &ObjectInfo{Size: int64(len(value)), ModTime: s.modTimes[id]}, nil
 }
 
 func (s *InMemoryStorage) Delete(id string) error {
 	s.broker.Lock()
+	defer s.broker.Unlock()
+	if _, ok := s.data[id]; !ok {
+		return &StorageNotFoundError{}
+	}
 	delete(s.data, id)
-	s.broker.Unlock()
+	delete(s.modTimes, id)
+	return nil
+}
+
+func (s *InMemoryStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	s.broker.RLock()
+	var ids []string
+	for id := range s.data {
+		if strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	s.broker.RUnlock()
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
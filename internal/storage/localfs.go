@@ -17,52 +17,140 @@ limitations under the License.
 package storage
 
 import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
 	"github.com/peterbourgon/diskv/v3"
 
 	"github.com/wilsonehusin/soubise/internal/broker"
 )
 
+const localFsTempPrefix = ".upload-"
+
 type LocalFsStorage struct {
-	broker  broker.Broker
-	backend *diskv.Diskv
+	broker   broker.Broker
+	basePath string
+	backend  *diskv.Diskv
 }
 
 func NewLocalFsStorage(b broker.Broker, basePath string) Storage {
 	return &LocalFsStorage{
-		broker: b,
+		broker:   b,
+		basePath: basePath,
 		backend: diskv.New(diskv.Options{
-			BasePath: basePath,
-			Transform: func(s string) []string {
-				top := s[0:2]
-				sub := s[2:4]
-				f := s[4 : len(s)-1]
-				return []string{top, sub, f}
-			},
+			BasePath:  basePath,
+			Transform: localFsTransform,
 		}),
 	}
 }
 
-func (s *LocalFsStorage) Create(id string, data []byte) error { // TODO: use stream?
-	s.broker.Lock()
-	err := s.backend.Write(id, data)
+func localFsTransform(s string) []string {
+	top := s[0:2]
+	sub := s[2:4]
+	f := s[4 : len(s)-1]
+	return []string{top, sub, f}
+}
+
+func (s *LocalFsStorage) filename(id string) string {
+	return filepath.Join(append([]string{s.basePath}, append(localFsTransform(id), id)...)...)
+}
+
+func (s *LocalFsStorage) Put(id string, data io.Reader) error {
+	// stream into a temporary file first, so the broker is only held while the
+	// complete file is moved into place
+	if err := os.MkdirAll(s.basePath, 0777); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.basePath, localFsTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if _, err := lock(s.broker); err != nil {
+		return err
+	}
+	err = s.backend.Import(tmp.Name(), id, true)
 	s.broker.Unlock()
 	return err
 }
-func (s *LocalFsStorage) Get(id string) ([]byte, error) { // TODO: use stream?
-	s.broker.RLock()
-	val, err := s.backend.Read(id)
-	s.broker.RUnlock()
+
+func (s *LocalFsStorage) Open(id string) (io.ReadCloser, int64, error) {
+	if _, err := rlock(s.broker); err != nil {
+		return nil, 0, err
+	}
+	defer s.broker.RUnlock()
+
+	f, err := os.Open(s.filename(id))
+	if os.IsNotExist(err) {
+		return nil, 0, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, 0, err
+	}
+	finfo, err := f.Stat()
 	if err != nil {
-		return []byte{}, err
+		f.Close()
+		return nil, 0, err
+	}
+	return f, finfo.Size(), nil
+}
+
+func (s *LocalFsStorage) Stat(id string) (*ObjectInfo, error) {
+	if _, err := rlock(s.broker); err != nil {
+		return nil, err
+	}
+	defer s.broker.RUnlock()
+
+	finfo, err := os.Stat(s.filename(id))
+	if os.IsNotExist(err) {
+		return nil, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, err
 	}
-	return val, nil
+	return &ObjectInfo{Size: finfo.Size(), ModTime: finfo.ModTime()}, nil
 }
+
 func (s *LocalFsStorage) Delete(id string) error {
-	s.broker.Lock()
+	if _, err := lock(s.broker); err != nil {
+		return err
+	}
 	err := s.backend.Erase(id)
 	s.broker.Unlock()
+	if os.IsNotExist(err) {
+		return &StorageNotFoundError{}
+	}
 	return err
 }
+
+func (s *LocalFsStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	cancel := make(chan struct{})
+	defer close(cancel)
+	for id := range s.backend.Keys(cancel) {
+		// temporary files of uploads in progress are not objects yet
+		if strings.HasPrefix(id, localFsTempPrefix) || !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
 func (s *LocalFsStorage) Kind() string {
 	return "localfs"
 }
@@ -0,0 +1,256 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Metadata is kept by the server next to each archive. Unlike the archive
+// header it can change after upload, and takes precedence over it.
+type Metadata struct {
+	Expiry time.Time `json:"expiry"`
+	// OwnerHash is the SHA-256 of the owner key, which authorizes deleting
+	// and extending the archive
+	OwnerHash []byte `json:"ownerHash,omitempty"`
+	// MaxDownloads limits how often the archive can be downloaded, unless 0
+	MaxDownloads uint32 `json:"maxDownloads,omitempty"`
+	// Downloads counts downloads which completed or are still in progress
+	Downloads uint32 `json:"downloads,omitempty"`
+	// Resumes lists counted downloads which have not completed yet, and can
+	// be resumed without being counted again
+	Resumes []Resume `json:"resumes,omitempty"`
+}
+
+// Resume allows whoever holds the token hashed to TokenHash with SHA-256 to
+// resume their download until Expiry.
+type Resume struct {
+	TokenHash []byte    `json:"tokenHash"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+func (m *Metadata) HasExpired() bool {
+	return m.Expiry.Before(time.Now())
+}
+
+// RemainingDownloads returns how often the archive can still be downloaded,
+// or false if it is not limited.
+func (m *Metadata) RemainingDownloads() (uint32, bool) {
+	if m.MaxDownloads == 0 {
+		return 0, false
+	}
+	if m.Downloads >= m.MaxDownloads {
+		return 0, true
+	}
+	return m.MaxDownloads - m.Downloads, true
+}
+
+// MetadataStorage is implemented by backends which store Metadata natively,
+// otherwise it is stored as a separate object next to the archive.
+type MetadataStorage interface {
+	// PutWithMetadata stores everything read from data under id along with
+	// its Metadata at once, so that no archive is ever stored without it
+	PutWithMetadata(id string, data io.Reader, m *Metadata) error
+	PutMetadata(id string, m *Metadata) error
+	// GetMetadata returns StorageNotFoundError for archives without Metadata
+	GetMetadata(id string) (*Metadata, error)
+	// UpdateMetadata applies update to the Metadata of id atomically, nothing
+	// is stored if update returns an error
+	UpdateMetadata(id string, update func(*Metadata) error) (*Metadata, error)
+}
+
+const metadataSuffix = ".meta"
+
+// metadataLock serializes updates of Metadata stored as separate objects,
+// across replicas once SetBroker was called
+var metadataLock sync.Locker = &sync.Mutex{}
+
+// CreateWithMetadata stores the archive read from data along with its Metadata,
+// returning the id of the archive. Archives are never found without their
+// Metadata, which would make them look like those stored before Metadata
+// existed.
+func CreateWithMetadata(data io.Reader, m *Metadata) (string, error) {
+	if storageProvider == nil {
+		return "", &UninitializedStorageError{}
+	}
+	id, err := NewId()
+	if err != nil {
+		return "", err
+	}
+	if native, ok := storageProvider.(MetadataStorage); ok {
+		if err := native.PutWithMetadata(id, data, m); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	// the archive is stored after its Metadata, a crash in between leaves
+	// Metadata without an archive behind rather than the other way around
+	if err := PutMetadata(id, m); err != nil {
+		return "", err
+	}
+	if err := storageProvider.Put(id, data); err != nil {
+		if _, lockErr := lock(metadataLock); lockErr == nil {
+			_ = storageProvider.Delete(id + metadataSuffix)
+			metadataLock.Unlock()
+		}
+		return "", err
+	}
+	return id, nil
+}
+
+func PutMetadata(id string, m *Metadata) error {
+	if storageProvider == nil {
+		return &UninitializedStorageError{}
+	}
+	if native, ok := storageProvider.(MetadataStorage); ok {
+		return native.PutMetadata(id, m)
+	}
+
+	if _, err := lock(metadataLock); err != nil {
+		return err
+	}
+	defer metadataLock.Unlock()
+	return putMetadataObject(storageProvider, id, m)
+}
+
+func putMetadataObject(s Storage, id string, m *Metadata) error {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding metadata: %w", err)
+	}
+	return s.Put(id+metadataSuffix, bytes.NewReader(encoded))
+}
+
+func GetMetadata(id string) (*Metadata, error) {
+	if storageProvider == nil {
+		return nil, &UninitializedStorageError{}
+	}
+	if native, ok := storageProvider.(MetadataStorage); ok {
+		return native.GetMetadata(id)
+	}
+	return getMetadataObject(storageProvider, id)
+}
+
+func UpdateMetadata(id string, update func(*Metadata) error) (*Metadata, error) {
+	if storageProvider == nil {
+		return nil, &UninitializedStorageError{}
+	}
+	if native, ok := storageProvider.(MetadataStorage); ok {
+		return native.UpdateMetadata(id, update)
+	}
+
+	held, err := lock(metadataLock)
+	if err != nil {
+		return nil, err
+	}
+	defer metadataLock.Unlock()
+	m, err := getMetadataObject(storageProvider, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(m); err != nil {
+		return nil, err
+	}
+	if err := stillHeld(held); err != nil {
+		return nil, err
+	}
+	if err := putMetadataObject(storageProvider, id, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetMetadataFrom reads Metadata of id from s rather than the configured
+// storage, without locking, e.g. for migrating archives between backends.
+func GetMetadataFrom(s Storage, id string) (*Metadata, error) {
+	if native, ok := s.(MetadataStorage); ok {
+		return native.GetMetadata(id)
+	}
+	return getMetadataObject(s, id)
+}
+
+// PutMetadataTo stores Metadata of id in s rather than the configured storage,
+// without locking.
+func PutMetadataTo(s Storage, id string, m *Metadata) error {
+	if native, ok := s.(MetadataStorage); ok {
+		return native.PutMetadata(id, m)
+	}
+	return putMetadataObject(s, id, m)
+}
+
+// PutWithMetadataTo stores data under id in s along with m, without locking.
+func PutWithMetadataTo(s Storage, id string, data io.Reader, m *Metadata) error {
+	if native, ok := s.(MetadataStorage); ok {
+		return native.PutWithMetadata(id, data, m)
+	}
+	if err := putMetadataObject(s, id, m); err != nil {
+		return err
+	}
+	if err := s.Put(id, data); err != nil {
+		_ = s.Delete(id + metadataSuffix)
+		return err
+	}
+	return nil
+}
+
+// DeleteFrom removes id along with its Metadata from s rather than the
+// configured storage, without locking.
+func DeleteFrom(s Storage, id string) error {
+	if err := s.Delete(id); err != nil {
+		return err
+	}
+	return deleteMetadataFrom([]Storage{s}, id)
+}
+
+// deleteMetadataFrom removes Metadata of id stored as a separate object in any
+// of backends, without locking.
+func deleteMetadataFrom(backends []Storage, id string) error {
+	for _, backend := range backends {
+		if _, ok := backend.(MetadataStorage); ok {
+			continue
+		}
+		err := backend.Delete(id + metadataSuffix)
+		if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMetadataObject(s Storage, id string) (*Metadata, error) {
+	r, _, err := s.Open(id + metadataSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(encoded, m); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,376 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MirroredStorage stores every object in all of its backends. Objects are
+// read from the first backend which has them, and copied in the background
+// to backends which are missing them once StartRepairs was called, e.g. after
+// replacing a disk.
+type MirroredStorage struct {
+	backends []Storage
+	repairs  *repairQueue
+}
+
+// NewMirroredStorage mirrors objects across backends, preferring earlier ones
+// for reads. Every object is checked for missing replicas once StartRepairs
+// was called.
+func NewMirroredStorage(backends ...Storage) Storage {
+	m := &MirroredStorage{backends: backends}
+	m.repairs = newRepairQueue("mirrored", m.repair)
+	return m
+}
+
+// StartRepairs copies objects to backends which are missing them, along with
+// the backends' own repairs.
+func (m *MirroredStorage) StartRepairs(ctx context.Context) {
+	startRepairs(ctx, m.backends)
+	m.repairs.start(ctx, m)
+}
+
+// Put succeeds once any backend stored an archive, backends which failed
+// receive it through a repair. Objects which are overwritten in place, such as
+// Metadata, have to be stored by every backend, as a backend which missed an
+// update would otherwise serve the previous version.
+func (m *MirroredStorage) Put(id string, data io.Reader) error {
+	return m.putAll(id, data, mutable(id), func(backend Storage, r io.Reader) error {
+		return backend.Put(id, r)
+	})
+}
+
+// putAll streams data to put for every backend, failing unless every backend
+// stored id if all is set.
+func (m *MirroredStorage) putAll(id string, data io.Reader, all bool, put func(backend Storage, r io.Reader) error) error {
+	writers := make([]*io.PipeWriter, len(m.backends))
+	errs := make([]error, len(m.backends))
+	var wg sync.WaitGroup
+	for i, backend := range m.backends {
+		r, w := io.Pipe()
+		writers[i] = w
+		wg.Add(1)
+		go func(i int, backend Storage) {
+			defer wg.Done()
+			errs[i] = put(backend, r)
+			// unblocks writes if the backend gave up before reading everything
+			r.CloseWithError(fmt.Errorf("%s stopped reading", backend.Kind()))
+		}(i, backend)
+	}
+
+	readErr := copyToLive(writers, data)
+	for _, w := range writers {
+		if readErr != nil {
+			w.CloseWithError(readErr)
+		} else {
+			w.Close()
+		}
+	}
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+
+	var stored int
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			stored++
+			continue
+		}
+		log.Error().Err(err).Str("Id", id).Str("Storage", m.backends[i].Kind()).Msg("mirroring object")
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s did not store the object: %w", m.backends[i].Kind(), err)
+		}
+	}
+	if stored == 0 {
+		return fmt.Errorf("no backend stored the object: %w", errs[0])
+	}
+	if firstErr != nil {
+		if all {
+			return firstErr
+		}
+		m.repairs.schedule(id)
+	}
+	return nil
+}
+
+// mutable reports whether id is overwritten in place, like Metadata or upload
+// sessions, unlike archives and upload chunks which are only written once.
+func mutable(id string) bool {
+	return strings.HasSuffix(id, metadataSuffix) || strings.HasSuffix(id, uploadSuffix)
+}
+
+// copyToLive copies data to every writer until writing to it fails, returning
+// only errors from reading data.
+func copyToLive(writers []*io.PipeWriter, data io.Reader) error {
+	live := make([]bool, len(writers))
+	for i := range live {
+		live[i] = true
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			for i, w := range writers {
+				if live[i] {
+					if _, err := w.Write(buf[:n]); err != nil {
+						live[i] = false
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *MirroredStorage) Open(id string) (io.ReadCloser, int64, error) {
+	r, size, missing, err := m.open(id)
+	if err == nil && missing {
+		m.repairs.schedule(id)
+	}
+	return r, size, err
+}
+
+// open reads id from the first backend which has it, reporting whether an
+// earlier backend was missing it.
+func (m *MirroredStorage) open(id string) (io.ReadCloser, int64, bool, error) {
+	var lastErr error = &StorageNotFoundError{}
+	missing := false
+	for _, backend := range m.backends {
+		r, size, err := backend.Open(id)
+		if err == nil {
+			return r, size, missing, nil
+		}
+		if errors.As(err, new(*StorageNotFoundError)) {
+			missing = true
+		} else {
+			lastErr = err
+		}
+	}
+	return nil, 0, missing, lastErr
+}
+
+func (m *MirroredStorage) Stat(id string) (*ObjectInfo, error) {
+	var lastErr error = &StorageNotFoundError{}
+	for _, backend := range m.backends {
+		info, err := backend.Stat(id)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.As(err, new(*StorageNotFoundError)) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// List calls fn once for every object stored in any backend.
+func (m *MirroredStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	return listAll(ctx, m.backends, prefix, fn)
+}
+
+// Delete removes the object from every backend, along with its Metadata.
+func (m *MirroredStorage) Delete(id string) error {
+	if _, err := lock(deleteLock); err != nil {
+		return err
+	}
+	err := deleteAll(m.backends, id)
+	deleteLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if mutable(id) {
+		return nil
+	}
+	if _, err := lock(metadataLock); err != nil {
+		return err
+	}
+	defer metadataLock.Unlock()
+	return deleteMetadataFrom(m.backends, id)
+}
+
+// DeleteExpired removes the object like Delete, unless its expiry was extended
+// before metadataLock was acquired.
+func (m *MirroredStorage) DeleteExpired(id string) (bool, error) {
+	held, err := lock(metadataLock)
+	if err != nil {
+		return false, err
+	}
+	defer metadataLock.Unlock()
+	metadata, err := m.GetMetadata(id)
+	if err == nil && !metadata.HasExpired() {
+		return false, nil
+	} else if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+		return false, err
+	}
+	if err := stillHeld(held); err != nil {
+		return false, err
+	}
+	if _, err := lock(deleteLock); err != nil {
+		return false, err
+	}
+	err = deleteAll(m.backends, id)
+	deleteLock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return true, deleteMetadataFrom(m.backends, id)
+}
+
+func (m *MirroredStorage) Kind() string {
+	kinds := make([]string, len(m.backends))
+	for i, backend := range m.backends {
+		kinds[i] = backend.Kind()
+	}
+	return "mirror:" + strings.Join(kinds, ",")
+}
+
+// PutWithMetadata stores the archive in every backend along with m, a backend
+// which failed receives both through a repair.
+func (m *MirroredStorage) PutWithMetadata(id string, data io.Reader, metadata *Metadata) error {
+	return m.putAll(id, data, false, func(backend Storage, r io.Reader) error {
+		return PutWithMetadataTo(backend, id, r, metadata)
+	})
+}
+
+// PutMetadata stores metadata in every backend, failing unless all of them
+// stored it.
+func (m *MirroredStorage) PutMetadata(id string, metadata *Metadata) error {
+	if _, err := lock(metadataLock); err != nil {
+		return err
+	}
+	defer metadataLock.Unlock()
+	return m.putMetadata(id, metadata)
+}
+
+func (m *MirroredStorage) putMetadata(id string, metadata *Metadata) error {
+	for _, backend := range m.backends {
+		if err := PutMetadataTo(backend, id, metadata); err != nil {
+			return fmt.Errorf("storing metadata in %s: %w", backend.Kind(), err)
+		}
+	}
+	return nil
+}
+
+// GetMetadata reads Metadata from the first backend which has it, every
+// backend stored the latest version.
+func (m *MirroredStorage) GetMetadata(id string) (*Metadata, error) {
+	var lastErr error = &StorageNotFoundError{}
+	for _, backend := range m.backends {
+		metadata, err := GetMetadataFrom(backend, id)
+		if err == nil {
+			return metadata, nil
+		}
+		if !errors.As(err, new(*StorageNotFoundError)) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+func (m *MirroredStorage) UpdateMetadata(id string, update func(*Metadata) error) (*Metadata, error) {
+	held, err := lock(metadataLock)
+	if err != nil {
+		return nil, err
+	}
+	defer metadataLock.Unlock()
+	metadata, err := m.GetMetadata(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(metadata); err != nil {
+		return nil, err
+	}
+	if err := stillHeld(held); err != nil {
+		return nil, err
+	}
+	if err := m.putMetadata(id, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// repair copies id along with its Metadata to every backend which is missing
+// it. Objects which are overwritten in place are stored by every backend and
+// not repaired. Objects deleted while being repaired are removed again.
+func (m *MirroredStorage) repair(id string) error {
+	if mutable(id) {
+		return nil
+	}
+	var source Storage
+	var missing []Storage
+	for _, backend := range m.backends {
+		if _, err := backend.Stat(id); errors.As(err, new(*StorageNotFoundError)) {
+			missing = append(missing, backend)
+		} else if err != nil {
+			return err
+		} else if source == nil {
+			source = backend
+		}
+	}
+	if len(missing) == 0 || source == nil {
+		return nil
+	}
+	metadata, err := GetMetadataFrom(source, id)
+	if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+		return err
+	}
+	for _, backend := range missing {
+		r, _, err := source.Open(id)
+		if err != nil {
+			return err
+		}
+		if metadata != nil {
+			err = PutWithMetadataTo(backend, id, r, metadata)
+		} else {
+			err = backend.Put(id, r)
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("copying to %s: %w", backend.Kind(), err)
+		}
+		log.Info().Str("Id", id).Str("Storage", backend.Kind()).Msg("repaired mirrored object")
+	}
+
+	// Delete holds deleteLock throughout, a source found missing here means
+	// the object was deleted and what was rebuilt meanwhile has to go too
+	if _, err := lock(deleteLock); err != nil {
+		return err
+	}
+	defer deleteLock.Unlock()
+	if _, err := source.Stat(id); errors.As(err, new(*StorageNotFoundError)) {
+		log.Info().Str("Id", id).Msg("mirrored object was deleted while being repaired")
+		if err := deleteAll(m.backends, id); err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+			return err
+		}
+		return deleteMetadataFrom(m.backends, id)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/broker"
+)
+
+func init() {
+	backends["mirror"] = NewMirroredStorage(NewInMemoryStorage(inMemoryBroker), NewLocalFsStorage(inMemoryBroker, mustTempDir()))
+}
+
+// unavailableStorage fails every Put without reading, like a failed disk
+type unavailableStorage struct {
+	Storage
+}
+
+func (u *unavailableStorage) Put(string, io.Reader) error {
+	return errors.New("disk is gone")
+}
+
+func waitForObject(t *testing.T, s Storage, id string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := s.Stat(id); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to be repaired in %s", id, s.Kind())
+}
+
+func TestMirroredStorage(t *testing.T) {
+	first := NewInMemoryStorage(&broker.InMemoryBroker{})
+	second := NewInMemoryStorage(&broker.InMemoryBroker{})
+	s := NewMirroredStorage(first, second)
+	ctx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	s.(Repairer).StartRepairs(ctx)
+	v := bytes.Repeat([]byte("jumpsoverthelazydog"), 10000)
+
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []Storage{first, second} {
+		if _, err := backend.Stat("thequickbrownfox"); err != nil {
+			t.Fatalf("expected object to be stored in every backend, %v", err)
+		}
+	}
+
+	// losing the first disk
+	if err := first.Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := io.ReadAll(r); err != nil || !bytes.Equal(val, v) {
+		t.Fatalf("expected object to be read from the remaining backend, received %d bytes (%v)", len(val), err)
+	}
+	waitForObject(t, first, "thequickbrownfox")
+
+	listed := 0
+	if err := s.List(context.Background(), "", func(string) error {
+		listed++
+		return nil
+	}); err != nil || listed != 1 {
+		t.Fatalf("expected object to be listed once, received %d (%v)", listed, err)
+	}
+
+	if err := s.Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("thequickbrownfox"); !errors.As(err, new(*StorageNotFoundError)) {
+		t.Fatalf("expected StorageNotFoundError, received %v", err)
+	}
+}
+
+func TestMirroredStorageToleratesFailure(t *testing.T) {
+	healthy := NewInMemoryStorage(&broker.InMemoryBroker{})
+	s := NewMirroredStorage(&unavailableStorage{Storage: NewInMemoryStorage(&broker.InMemoryBroker{})}, healthy)
+	v := bytes.Repeat([]byte("jumpsoverthelazydog"), 10000)
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatalf("expected Put to succeed while a backend is available, received %v", err)
+	}
+	if _, err := healthy.Stat("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewMirroredStorage(&unavailableStorage{Storage: healthy}).Put("lazydog", bytes.NewReader(v)); err == nil {
+		t.Fatal("expected Put to fail without any available backend")
+	}
+}
+
+func TestMirroredStorageRepairsOnStart(t *testing.T) {
+	replaced := NewInMemoryStorage(&broker.InMemoryBroker{})
+	remaining := NewInMemoryStorage(&broker.InMemoryBroker{})
+	if err := remaining.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsoverthelazydog"))); err != nil {
+		t.Fatal(err)
+	}
+	s := NewMirroredStorage(replaced, remaining)
+
+	// until started, e.g. while migrating, nothing is written
+	if _, _, err := s.Open("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := replaced.Stat("thequickbrownfox"); err == nil {
+		t.Fatal("expected no repairs before they were started")
+	}
+
+	ctx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	s.(Repairer).StartRepairs(ctx)
+	waitForObject(t, replaced, "thequickbrownfox")
+}
+
+func TestMirroredStorageMetadata(t *testing.T) {
+	healthy := NewInMemoryStorage(&broker.InMemoryBroker{})
+	s := NewMirroredStorage(&unavailableStorage{Storage: NewInMemoryStorage(&broker.InMemoryBroker{})}, healthy).(*MirroredStorage)
+	expected := &Metadata{Expiry: time.Now().Add(time.Hour).Truncate(time.Second), MaxDownloads: 1}
+	if err := s.PutWithMetadata("thequickbrownfox", bytes.NewReader([]byte("jumpsoverthelazydog")), expected); err != nil {
+		t.Fatalf("expected archive to be stored while a backend is available, received %v", err)
+	}
+	// a backend missing an update would serve the previous version
+	if err := s.PutMetadata("thequickbrownfox", expected); err == nil {
+		t.Fatal("expected metadata to require every backend")
+	}
+	if err := s.Put("lazydog.meta", bytes.NewReader([]byte("{}"))); err == nil {
+		t.Fatal("expected metadata object to require every backend")
+	}
+
+	replaced := NewInMemoryStorage(&broker.InMemoryBroker{})
+	s = NewMirroredStorage(replaced, healthy).(*MirroredStorage)
+	ctx, stopRepairs := context.WithCancel(context.Background())
+	defer stopRepairs()
+	s.StartRepairs(ctx)
+	waitForObject(t, replaced, "thequickbrownfox")
+	if received, err := GetMetadataFrom(replaced, "thequickbrownfox"); err != nil || received.MaxDownloads != 1 {
+		t.Fatalf("expected metadata to be repaired along with the archive, received %v (%v)", received, err)
+	}
+	if _, err := s.UpdateMetadata("thequickbrownfox", func(m *Metadata) error {
+		m.Downloads++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []Storage{replaced, healthy} {
+		if received, err := GetMetadataFrom(backend, "thequickbrownfox"); err != nil || received.Downloads != 1 {
+			t.Fatalf("expected update to be stored in %s, received %v (%v)", backend.Kind(), received, err)
+		}
+	}
+
+	if err := s.Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	for _, backend := range []Storage{replaced, healthy} {
+		if _, err := GetMetadataFrom(backend, "thequickbrownfox"); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("expected metadata to be deleted from %s, received %v", backend.Kind(), err)
+		}
+	}
+}
+
+// deletingStorage deletes id from source whenever it is stored, like a Delete
+// racing with a repair
+type deletingStorage struct {
+	Storage
+	source Storage
+}
+
+func (d *deletingStorage) Put(id string, data io.Reader) error {
+	err := d.Storage.Put(id, data)
+	_ = d.source.Delete(id)
+	return err
+}
+
+func TestMirroredStorageRepairDoesNotResurrect(t *testing.T) {
+	remaining := NewInMemoryStorage(&broker.InMemoryBroker{})
+	replaced := NewInMemoryStorage(&broker.InMemoryBroker{})
+	s := &MirroredStorage{backends: []Storage{&deletingStorage{Storage: replaced, source: remaining}, remaining}}
+	if err := remaining.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsoverthelazydog"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.repair("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replaced.Stat("thequickbrownfox"); !errors.As(err, new(*StorageNotFoundError)) {
+		t.Fatalf("expected object deleted during repair to stay deleted, received %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// rangedObject reads an object sequentially, seeking makes the next read
+// request the object from the new offset. It lets backends which are accessed
+// over the network return seekable content.
+type rangedObject struct {
+	size   int64
+	openAt func(offset int64) (io.ReadCloser, error)
+
+	offset     int64
+	body       io.ReadCloser
+	bodyOffset int64
+}
+
+func newRangedObject(body io.ReadCloser, size int64, openAt func(offset int64) (io.ReadCloser, error)) *rangedObject {
+	return &rangedObject{size: size, openAt: openAt, body: body}
+}
+
+func (o *rangedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body != nil && o.bodyOffset != o.offset {
+		o.body.Close()
+		o.body = nil
+	}
+	if o.body == nil {
+		body, err := o.openAt(o.offset)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+		o.bodyOffset = o.offset
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	o.bodyOffset += int64(n)
+	return n, err
+}
+
+func (o *rangedObject) Seek(offset int64, whence int) (int64, error) {
+	offset, err := seekOffset(o.offset, o.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *rangedObject) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+// chunkedObject reads an object stored as chunks of equal size, except for the
+// last one, which are read as needed.
+type chunkedObject struct {
+	size      int64
+	chunkSize int64
+	readChunk func(seq int64) ([]byte, error)
+	offset    int64
+
+	// chunk is the last chunk read, numbered seq
+	chunk []byte
+	seq   int64
+}
+
+func newChunkedObject(size, chunkSize int64, readChunk func(seq int64) ([]byte, error)) *chunkedObject {
+	return &chunkedObject{size: size, chunkSize: chunkSize, readChunk: readChunk}
+}
+
+func (o *chunkedObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	seq := o.offset / o.chunkSize
+	if o.chunk == nil || o.seq != seq {
+		chunk, err := o.readChunk(seq)
+		if err != nil {
+			return 0, err
+		}
+		o.chunk, o.seq = chunk, seq
+	}
+	within := o.offset - seq*o.chunkSize
+	if within >= int64(len(o.chunk)) {
+		return 0, fmt.Errorf("chunk %d is truncated", seq)
+	}
+	n := copy(p, o.chunk[within:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+func (o *chunkedObject) Seek(offset int64, whence int) (int64, error) {
+	offset, err := seekOffset(o.offset, o.size, offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *chunkedObject) Close() error {
+	return nil
+}
+
+func seekOffset(current, size, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += current
+	case io.SeekEnd:
+		offset += size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	return offset, nil
+}
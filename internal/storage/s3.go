@@ -0,0 +1,210 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3PartSize is the size of each part of a multipart upload, objects smaller
+// than this are uploaded in a single request
+const s3PartSize = 16 << 20
+
+type S3Config struct {
+	Bucket string
+	// Prefix is prepended to the key of every object
+	Prefix string
+	// Endpoint overrides the AWS endpoint, for S3-compatible services
+	Endpoint string
+	Region   string
+	// PathStyle addresses buckets as part of the path instead of the host
+	PathStyle bool
+	// CredentialsFile is a shared credentials file to read Profile from,
+	// otherwise credentials are looked up in the environment, the default
+	// shared credentials file, and the instance role
+	CredentialsFile string
+	Profile         string
+	// PartSize overrides s3PartSize
+	PartSize int64
+}
+
+type S3Storage struct {
+	config   S3Config
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func NewS3Storage(config S3Config) (Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires a bucket")
+	}
+
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(config.PathStyle)
+	if config.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.Endpoint)
+	}
+	if config.Region != "" {
+		awsConfig = awsConfig.WithRegion(config.Region)
+	}
+	if config.CredentialsFile != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewSharedCredentials(config.CredentialsFile, config.Profile))
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           config.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String("us-east-1")
+	}
+
+	// keys are joined with the prefix, while listing appends a separator
+	config.Prefix = strings.TrimSuffix(config.Prefix, "/")
+
+	partSize := int64(s3PartSize)
+	if config.PartSize != 0 {
+		partSize = config.PartSize
+	}
+	return &S3Storage{
+		config: config,
+		client: s3.New(sess),
+		uploader: s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+			u.PartSize = partSize
+		}),
+	}, nil
+}
+
+func (s *S3Storage) key(id string) string {
+	return path.Join(s.config.Prefix, id)
+}
+
+func (s *S3Storage) Put(id string, data io.Reader) error {
+	// the uploader switches to a multipart upload once data exceeds a part,
+	// which is aborted if reading data fails
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.key(id)),
+		Body:   data,
+	})
+	return err
+}
+
+func (s *S3Storage) Open(id string) (io.ReadCloser, int64, error) {
+	output, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if isS3NotFound(err) {
+		return nil, 0, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, 0, err
+	}
+	size := aws.Int64Value(output.ContentLength)
+	openAt := func(offset int64) (io.ReadCloser, error) {
+		output, err := s.client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(s.config.Bucket),
+			Key:    aws.String(s.key(id)),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return output.Body, nil
+	}
+	return newRangedObject(output.Body, size, openAt), size, nil
+}
+
+func (s *S3Storage) Stat(id string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	if isS3NotFound(err) {
+		return nil, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Size:    aws.Int64Value(output.ContentLength),
+		ModTime: aws.TimeValue(output.LastModified),
+	}, nil
+}
+
+func (s *S3Storage) Delete(id string) error {
+	// S3 does not report deleting missing objects, which are looked up first
+	// to behave like other backends
+	if _, err := s.Stat(id); err != nil {
+		return err
+	}
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.config.Bucket),
+		Key:    aws.String(s.key(id)),
+	})
+	return err
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	keyPrefix := ""
+	if s.config.Prefix != "" {
+		keyPrefix = s.config.Prefix + "/"
+	}
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.config.Bucket),
+		Prefix: aws.String(keyPrefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, object := range page.Contents {
+			if fnErr = fn(strings.TrimPrefix(aws.StringValue(object.Key), keyPrefix)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *S3Storage) Kind() string {
+	return "s3"
+}
+
+func isS3NotFound(err error) bool {
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && requestErr.StatusCode() == http.StatusNotFound {
+		return true
+	}
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchKey
+}
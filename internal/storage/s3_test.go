@@ -0,0 +1,122 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func init() {
+	backends["s3"] = newFakeS3Storage(0, "archives")
+}
+
+// newFakeS3Storage serves an in-memory bucket, the server lives as long as
+// the test binary does.
+func newFakeS3Storage(partSize int64, prefix string) Storage {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("soubise"); err != nil {
+		panic(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend).Server())
+	credentialsFile, err := os.CreateTemp("", "soubise-s3-credentials-*")
+	if err != nil {
+		panic(err)
+	}
+	defer credentialsFile.Close()
+	if _, err := credentialsFile.WriteString("[default]\naws_access_key_id = soubise\naws_secret_access_key = soubise\n"); err != nil {
+		panic(err)
+	}
+	s, err := NewS3Storage(S3Config{
+		Bucket:          "soubise",
+		Prefix:          prefix,
+		Endpoint:        server.URL,
+		Region:          "eu-west-1",
+		PathStyle:       true,
+		PartSize:        partSize,
+		CredentialsFile: credentialsFile.Name(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestS3Multipart(t *testing.T) {
+	s := newFakeS3Storage(5<<20, "archives")
+	v := bytes.Repeat([]byte("jumpsoverthelazydog"), 1<<20)
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, size, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if size != int64(len(v)) {
+		t.Fatalf("expected %d bytes, received %d", len(v), size)
+	}
+	seeker := r.(io.ReadSeeker)
+	if _, err := seeker.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(seeker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, v[len(v)-10:]) {
+		t.Fatalf("expected %q after seeking, received %q", v[len(v)-10:], tail)
+	}
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := io.ReadAll(seeker); err != nil || !bytes.Equal(val, v) {
+		t.Fatalf("expected whole object after seeking back, received %d bytes (%v)", len(val), err)
+	}
+
+	if err := s.Delete("thequickbrownfox"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("thequickbrownfox"); err == nil {
+		t.Fatal("expected deleting a missing object to fail")
+	}
+}
+
+func TestS3PrefixSeparator(t *testing.T) {
+	s := newFakeS3Storage(0, "shares/")
+	if err := s.Put("thequickbrownfox", bytes.NewReader([]byte("jumpsover"))); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	if err := s.List(context.Background(), "", func(id string) error {
+		listed = append(listed, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0] != "thequickbrownfox" {
+		t.Fatalf("expected thequickbrownfox to be listed, received %v", listed)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	// registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// sqliteChunkSize is how much content is stored per row, so that objects are
+// streamed instead of held in memory as a whole
+const sqliteChunkSize = 1 << 20
+
+// sqliteStagingPrefix marks chunks of objects which are still being written,
+// they are moved to the object once complete
+const sqliteStagingPrefix = ".staging-"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+	id            TEXT PRIMARY KEY,
+	size          INTEGER NOT NULL,
+	chunk_size    INTEGER NOT NULL,
+	mod_time      INTEGER NOT NULL,
+	-- metadata columns are NULL until PutMetadata
+	expiry        INTEGER,
+	owner_hash    BLOB,
+	max_downloads INTEGER,
+	downloads     INTEGER,
+	-- Metadata.Resumes as JSON
+	resumes       BLOB
+);
+CREATE TABLE IF NOT EXISTS chunks (
+	id   TEXT NOT NULL,
+	seq  INTEGER NOT NULL,
+	data BLOB NOT NULL,
+	PRIMARY KEY (id, seq)
+);`
+
+// SQLiteStorage keeps objects along with their Metadata in a single SQLite
+// database, so that changes to either are atomic.
+type SQLiteStorage struct {
+	db        *sql.DB
+	chunkSize int
+}
+
+func NewSQLiteStorage(path string) (Storage, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes writers, which SQLite would otherwise
+	// refuse with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA synchronous = NORMAL",
+		sqliteSchema,
+		// chunks of writes interrupted by a crash
+		"DELETE FROM chunks WHERE id NOT IN (SELECT id FROM objects)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("initializing sqlite storage: %w", err)
+		}
+	}
+	if err := addSQLiteResumes(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing sqlite storage: %w", err)
+	}
+	return &SQLiteStorage{db: db, chunkSize: sqliteChunkSize}, nil
+}
+
+// addSQLiteResumes adds the resumes column to databases created before it
+// existed.
+func addSQLiteResumes(db *sql.DB) error {
+	var exists bool
+	err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('objects') WHERE name = 'resumes'").Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE objects ADD COLUMN resumes BLOB")
+	return err
+}
+
+func (s *SQLiteStorage) Put(id string, data io.Reader) error {
+	return s.putObject(id, data, nil)
+}
+
+// putObject stores data under id, along with m unless it is nil.
+func (s *SQLiteStorage) putObject(id string, data io.Reader, m *Metadata) error {
+	// chunks are written outside of a transaction so that other writers are
+	// not blocked for the duration of an upload, then moved in place at once
+	staging, err := NewId()
+	if err != nil {
+		return err
+	}
+	staging = sqliteStagingPrefix + staging
+	discard := func() {
+		_, _ = s.db.Exec("DELETE FROM chunks WHERE id = ?", staging)
+	}
+
+	chunk := make([]byte, s.chunkSize)
+	var size int64
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(data, chunk)
+		if n > 0 {
+			if _, err := s.db.Exec("INSERT INTO chunks (id, seq, data) VALUES (?, ?, ?)", staging, seq, chunk[:n]); err != nil {
+				discard()
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			discard()
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		discard()
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM chunks WHERE id = ?", []interface{}{id}},
+		{"UPDATE chunks SET id = ? WHERE id = ?", []interface{}{id, staging}},
+		{`INSERT INTO objects (id, size, chunk_size, mod_time) VALUES (?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET size = excluded.size, chunk_size = excluded.chunk_size, mod_time = excluded.mod_time`,
+			[]interface{}{id, size, s.chunkSize, time.Now().UnixNano()}},
+	} {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			discard()
+			return err
+		}
+	}
+	if m != nil {
+		if err := putSQLiteMetadata(tx, id, m); err != nil {
+			discard()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		discard()
+		return err
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Open(id string) (io.ReadCloser, int64, error) {
+	var size, chunkSize int64
+	err := s.db.QueryRow("SELECT size, chunk_size FROM objects WHERE id = ?", id).Scan(&size, &chunkSize)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, 0, err
+	}
+	readChunk := func(seq int64) ([]byte, error) {
+		var chunk []byte
+		err := s.db.QueryRow("SELECT data FROM chunks WHERE id = ? AND seq = ?", id, seq).Scan(&chunk)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("object %s is missing chunk %d", id, seq)
+		}
+		return chunk, err
+	}
+	return newChunkedObject(size, chunkSize, readChunk), size, nil
+}
+
+func (s *SQLiteStorage) Stat(id string) (*ObjectInfo, error) {
+	var size, modTime int64
+	err := s.db.QueryRow("SELECT size, mod_time FROM objects WHERE id = ?", id).Scan(&size, &modTime)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Size: size, ModTime: time.Unix(0, modTime)}, nil
+}
+
+func (s *SQLiteStorage) List(ctx context.Context, prefix string, fn func(id string) error) error {
+	// ids are collected first, the only connection is busy while iterating
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM objects WHERE substr(id, 1, length(?1)) = ?1", prefix)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := deleteSQLiteObject(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteExpired removes the object like Delete, unless its expiry was extended.
+func (s *SQLiteStorage) DeleteExpired(id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	m, err := getSQLiteMetadata(tx, id)
+	if err == nil && !m.HasExpired() {
+		return false, nil
+	} else if err != nil && !errors.As(err, new(*StorageNotFoundError)) {
+		return false, err
+	}
+	if err := deleteSQLiteObject(tx, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func deleteSQLiteObject(tx *sql.Tx, id string) error {
+	result, err := tx.Exec("DELETE FROM objects WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if deleted == 0 {
+		return &StorageNotFoundError{}
+	}
+	_, err = tx.Exec("DELETE FROM chunks WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLiteStorage) Kind() string {
+	return "sqlite"
+}
+
+func (s *SQLiteStorage) PutMetadata(id string, m *Metadata) error {
+	return putSQLiteMetadata(s.db, id, m)
+}
+
+func (s *SQLiteStorage) PutWithMetadata(id string, data io.Reader, m *Metadata) error {
+	return s.putObject(id, data, m)
+}
+
+func (s *SQLiteStorage) GetMetadata(id string) (*Metadata, error) {
+	return getSQLiteMetadata(s.db, id)
+}
+
+func (s *SQLiteStorage) UpdateMetadata(id string, update func(*Metadata) error) (*Metadata, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	m, err := getSQLiteMetadata(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(m); err != nil {
+		return nil, err
+	}
+	if err := putSQLiteMetadata(tx, id, m); err != nil {
+		return nil, err
+	}
+	return m, tx.Commit()
+}
+
+// sqlExecutor is implemented by both sql.DB and sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func putSQLiteMetadata(db sqlExecutor, id string, m *Metadata) error {
+	var resumes []byte
+	if len(m.Resumes) > 0 {
+		var err error
+		if resumes, err = json.Marshal(m.Resumes); err != nil {
+			return err
+		}
+	}
+	result, err := db.Exec("UPDATE objects SET expiry = ?, owner_hash = ?, max_downloads = ?, downloads = ?, resumes = ? WHERE id = ?",
+		m.Expiry.UnixNano(), m.OwnerHash, m.MaxDownloads, m.Downloads, resumes, id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return &StorageNotFoundError{}
+	}
+	return nil
+}
+
+func getSQLiteMetadata(db sqlExecutor, id string) (*Metadata, error) {
+	var expiry sql.NullInt64
+	var maxDownloads, downloads sql.NullInt64
+	var resumes []byte
+	m := &Metadata{}
+	err := db.QueryRow("SELECT expiry, owner_hash, max_downloads, downloads, resumes FROM objects WHERE id = ?", id).
+		Scan(&expiry, &m.OwnerHash, &maxDownloads, &downloads, &resumes)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !expiry.Valid) {
+		return nil, &StorageNotFoundError{}
+	} else if err != nil {
+		return nil, err
+	}
+	m.Expiry = time.Unix(0, expiry.Int64)
+	m.MaxDownloads = uint32(maxDownloads.Int64)
+	m.Downloads = uint32(downloads.Int64)
+	if len(resumes) > 0 {
+		if err := json.Unmarshal(resumes, &m.Resumes); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	backends["sqlite"] = newTemporarySQLiteStorage()
+}
+
+// newTemporarySQLiteStorage lives as long as the test binary does.
+func newTemporarySQLiteStorage() Storage {
+	dir, err := os.MkdirTemp("", "soubise-sqlite-*")
+	if err != nil {
+		panic(err)
+	}
+	s, err := NewSQLiteStorage(filepath.Join(dir, "soubise.db"))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func TestSQLiteChunks(t *testing.T) {
+	s := newTemporarySQLiteStorage().(*SQLiteStorage)
+	s.chunkSize = 7
+	v := []byte("jumpsoverthelazydog")
+	if err := s.Put("thequickbrownfox", bytes.NewReader(v)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := s.Open("thequickbrownfox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeker := r.(io.ReadSeeker)
+	for _, offset := range []int64{0, 6, 7, 15, 18} {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if val, err := io.ReadAll(seeker); err != nil || !bytes.Equal(val, v[offset:]) {
+			t.Fatalf("expected %q from offset %d, received %q (%v)", v[offset:], offset, val, err)
+		}
+	}
+
+	// objects written with another chunk size remain readable
+	s.chunkSize = 4
+	if err := s.Put("lazydog", bytes.NewReader(v[:10])); err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string][]byte{"thequickbrownfox": v, "lazydog": v[:10]} {
+		r, size, err := s.Open(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, err := io.ReadAll(r); err != nil || !bytes.Equal(val, expected) || size != int64(len(expected)) {
+			t.Fatalf("expected %q, received %q (%v)", expected, val, err)
+		}
+	}
+
+	if err := s.Put("empty", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if r, size, err := s.Open("empty"); err != nil || size != 0 {
+		t.Fatalf("expected empty object, received %d bytes (%v)", size, err)
+	} else if val, err := io.ReadAll(r); err != nil || len(val) != 0 {
+		t.Fatalf("expected empty object, received %q (%v)", val, err)
+	}
+}
@@ -17,18 +17,39 @@ limitations under the License.
 package storage
 
 import (
-	"github.com/wilsonehusin/soubise/internal/crypto"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wilsonehusin/soubise/internal/broker"
 )
 
 var storageProvider Storage
 
 type Storage interface {
-	Create(id string, data []byte) error
-	Get(id string) ([]byte, error)
+	// Put stores everything read from data under id, until data returns io.EOF
+	Put(id string, data io.Reader) error
+	// Open returns the content stored under id along with its size in bytes,
+	// the caller is responsible for closing it. Backends should return an
+	// io.ReadSeekCloser where possible, which allows ranged downloads
+	Open(id string) (io.ReadCloser, int64, error)
+	// Stat returns information about the object stored under id without
+	// reading its content
+	Stat(id string) (*ObjectInfo, error)
+	// List calls fn with the id of every object starting with prefix, in no
+	// particular order, until fn returns an error
+	List(ctx context.Context, prefix string, fn func(id string) error) error
 	Delete(id string) error
 	Kind() string
 }
 
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
 func SetStorage(s Storage) error {
 	if storageProvider != nil {
 		return &InitializedStorageError{}
@@ -37,29 +58,100 @@ func SetStorage(s Storage) error {
 	return nil
 }
 
-func Create(data []byte) (string, error) {
+// SetBroker makes b coordinate changes which span several objects, such as
+// updating Metadata stored next to the archive or upload sessions.
+func SetBroker(b broker.Broker) {
+	metadataLock = b.Mutex("metadata")
+	uploadLock = b.Mutex("upload")
+	deleteLock = b.Mutex("delete")
+}
+
+// lockTimeout is how long to wait for a lock, e.g. while the broker is
+// unreachable, before giving up on the operation
+const lockTimeout = 30 * time.Second
+
+// lock acquires l, the returned context is cancelled once l is lost to
+// another replica, after which nothing guarded by l may be written.
+func lock(l sync.Locker) (context.Context, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return broker.LockContext(ctx, l)
+}
+
+// rlock acquires the read lock of b like lock does.
+func rlock(b broker.Broker) (context.Context, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return broker.RLockContext(ctx, b)
+}
+
+// stillHeld returns an error once the lock which returned held was lost.
+func stillHeld(held context.Context) error {
+	if held.Err() != nil {
+		return &LockLostError{}
+	}
+	return nil
+}
+
+func Create(data io.Reader) (string, error) {
 	if storageProvider == nil {
 		return "", &UninitializedStorageError{}
 	}
-	id := crypto.RandLen(18).String()
-	if err := storageProvider.Create(id, data); err != nil {
+	id, err := NewId()
+	if err != nil {
+		return "", err
+	}
+	if err := storageProvider.Put(id, data); err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
-func Get(id string) ([]byte, error) {
+func Open(id string) (io.ReadCloser, int64, error) {
 	if storageProvider == nil {
-		return []byte{}, &UninitializedStorageError{}
+		return nil, 0, &UninitializedStorageError{}
 	}
-	return storageProvider.Get(id)
+	return storageProvider.Open(id)
 }
 
+func Stat(id string) (*ObjectInfo, error) {
+	if storageProvider == nil {
+		return nil, &UninitializedStorageError{}
+	}
+	return storageProvider.Stat(id)
+}
+
+// List calls fn with the id of every object starting with prefix. Besides
+// archives, these include Metadata and chunks of uploads in progress, which
+// IsValidId tells apart.
+func List(ctx context.Context, prefix string, fn func(id string) error) error {
+	if storageProvider == nil {
+		return &UninitializedStorageError{}
+	}
+	return storageProvider.List(ctx, prefix, fn)
+}
+
+// Delete removes the archive stored under id along with its Metadata.
 func Delete(id string) error {
 	if storageProvider == nil {
 		return &UninitializedStorageError{}
 	}
-	return storageProvider.Delete(id)
+	if err := storageProvider.Delete(id); err != nil {
+		return err
+	}
+	if _, ok := storageProvider.(MetadataStorage); ok {
+		return nil
+	}
+	if _, err := lock(metadataLock); err != nil {
+		return err
+	}
+	err := storageProvider.Delete(id + metadataSuffix)
+	metadataLock.Unlock()
+	if errors.As(err, new(*StorageNotFoundError)) {
+		// archives uploaded before Metadata existed
+		return nil
+	}
+	return err
 }
 
 func Kind() string {
@@ -92,3 +184,11 @@ const StorageNotFoundErrorString = "unable to find archive with such key"
 func (u *StorageNotFoundError) Error() string {
 	return StorageNotFoundErrorString
 }
+
+type LockLostError struct{}
+
+const LockLostErrorString = "lock was lost to another replica before writing"
+
+func (l *LockLostError) Error() string {
+	return LockLostErrorString
+}
@@ -18,8 +18,13 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/wilsonehusin/soubise/internal/broker"
 )
@@ -36,25 +41,329 @@ func TestStorageBackends(t *testing.T) {
 	v := []byte("jumpsoverthelazydog")
 
 	for _, s := range backends {
-		if err := s.Create(k, v); err != nil {
+		if err := s.Put(k, bytes.NewReader(v)); err != nil {
 			t.Fatal(err)
 		}
 
-		val, err := s.Get(k)
+		r, size, err := s.Open(k)
 		if err != nil {
 			t.Fatal(err)
 		}
-		if !bytes.Equal(val, v) {
-			t.Fatal(fmt.Errorf("expected %v, received %v", v, val))
+		if _, ok := r.(io.ReadSeeker); !ok {
+			t.Fatal(fmt.Errorf("expected %s to return seekable content", s.Kind()))
+		}
+		val, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(val, v) || size != int64(len(v)) {
+			t.Fatal(fmt.Errorf("expected %v (%d bytes), received %v (%d bytes)", v, len(v), val, size))
+		}
+
+		info, err := s.Stat(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != int64(len(v)) || time.Since(info.ModTime) > time.Minute {
+			t.Fatal(fmt.Errorf("expected %s to report %d bytes modified just now, received %d bytes modified %v", s.Kind(), len(v), info.Size, info.ModTime))
 		}
 
 		if err := s.Delete(k); err != nil {
 			t.Fatal(err)
 		}
 
-		val, err = s.Get(k)
-		if err == nil || len(val) != 0 {
-			t.Fatal(fmt.Errorf("expected key-value pair to have been deleted, but found value (%v) or no error thrown", val))
+		_, _, err = s.Open(k)
+		if err == nil {
+			t.Fatal(fmt.Errorf("expected key-value pair to have been deleted, but no error thrown"))
+		}
+		if _, err := s.Stat(k); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatal(fmt.Errorf("expected %s to report deleted object as not found, received %v", s.Kind(), err))
+		}
+		if err := s.Delete(k); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatal(fmt.Errorf("expected %s to report deleting a missing object as not found, received %v", s.Kind(), err))
+		}
+	}
+}
+
+func TestIds(t *testing.T) {
+	id, err := NewId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidId(id) {
+		t.Fatalf("expected generated id %q to be valid", id)
+	}
+
+	for _, forged := range []string{"", "thequickbrownfox", "../../../../etc/passwd", id[1:], id + "A", "!" + id[1:]} {
+		if IsValidId(forged) {
+			t.Fatalf("expected %q to be rejected", forged)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	for kind, s := range backends {
+		storageProvider = s
+		id, err := Create(bytes.NewReader([]byte("jumpsoverthelazydog")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := GetMetadata(id); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("%s: expected StorageNotFoundError before metadata is stored, received %v", kind, err)
+		}
+		expected := &Metadata{Expiry: time.Now().Add(time.Hour).Truncate(time.Second), OwnerHash: []byte("hash")}
+		if err := PutMetadata(id, expected); err != nil {
+			t.Fatal(err)
+		}
+		received, err := GetMetadata(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !received.Expiry.Equal(expected.Expiry) || !bytes.Equal(received.OwnerHash, expected.OwnerHash) {
+			t.Fatalf("%s: expected %v, received %v", kind, expected, received)
+		}
+
+		refused := errors.New("refused")
+		if _, err := UpdateMetadata(id, func(m *Metadata) error {
+			m.Downloads = 42
+			return refused
+		}); err != refused {
+			t.Fatalf("%s: expected update error to be returned, received %v", kind, err)
+		}
+		updated, err := UpdateMetadata(id, func(m *Metadata) error {
+			m.Downloads++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if received, err := GetMetadata(id); err != nil || received.Downloads != 1 || updated.Downloads != 1 {
+			t.Fatalf("%s: expected exactly one download to be counted, received %v (%v)", kind, received, err)
+		}
+
+		if err := Delete(id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetMetadata(id); err == nil {
+			t.Fatalf("%s: expected metadata to have been deleted along with the archive", kind)
+		}
+	}
+	storageProvider = nil
+}
+
+func TestCreateWithMetadata(t *testing.T) {
+	for kind, s := range backends {
+		storageProvider = s
+		expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+		expected := &Metadata{Expiry: expiry, OwnerHash: []byte("hash"), MaxDownloads: 3, Resumes: []Resume{{TokenHash: []byte("token"), Expiry: expiry}}}
+		id, err := CreateWithMetadata(bytes.NewReader([]byte("jumpsoverthelazydog")), expected)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		received, err := GetMetadata(id)
+		if err != nil || !received.Expiry.Equal(expected.Expiry) || received.MaxDownloads != expected.MaxDownloads ||
+			len(received.Resumes) != 1 || !received.Resumes[0].Expiry.Equal(expiry) || string(received.Resumes[0].TokenHash) != "token" {
+			t.Fatalf("%s: expected %v, received %v (%v)", kind, expected, received, err)
+		}
+		if r, _, err := Open(id); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		} else if v, err := io.ReadAll(r); err != nil || string(v) != "jumpsoverthelazydog" {
+			t.Fatalf("%s: expected archive to be stored, received %q (%v)", kind, v, err)
+		} else {
+			r.Close()
+		}
+		if err := Delete(id); err != nil {
+			t.Fatal(err)
+		}
+
+		// a failed upload leaves neither archive nor Metadata behind
+		before := 0
+		if err := List(context.Background(), "", func(string) error { before++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		failing := io.MultiReader(bytes.NewReader([]byte("jumpsover")), iotest.ErrReader(errors.New("interrupted")))
+		if _, err := CreateWithMetadata(failing, expected); err == nil {
+			t.Fatalf("%s: expected interrupted upload to fail", kind)
+		}
+		after := 0
+		if err := List(context.Background(), "", func(string) error { after++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if before != after {
+			t.Fatalf("%s: expected nothing to be left of a failed upload, found %d objects instead of %d", kind, after, before)
+		}
+	}
+	storageProvider = nil
+}
+
+func TestPopExpired(t *testing.T) {
+	ScheduleExpiry("later", time.Now().Add(time.Hour))
+	ScheduleExpiry("second", time.Now().Add(-time.Minute))
+	ScheduleExpiry("first", time.Now().Add(-time.Hour))
+
+	expired := PopExpired()
+	if len(expired) != 2 || expired[0].Id != "first" || expired[1].Id != "second" {
+		t.Fatalf("expected first and second to have expired, received %v", expired)
+	}
+	if expired := PopExpired(); len(expired) != 0 {
+		t.Fatalf("expected nothing else to have expired, received %v", expired)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	for kind, s := range backends {
+		storageProvider = s
+		id, err := CreateWithMetadata(bytes.NewReader([]byte("jumpsoverthelazydog")), &Metadata{Expiry: time.Now().Add(-time.Minute)})
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		// extended after being scheduled
+		if _, err := UpdateMetadata(id, func(m *Metadata) error {
+			m.Expiry = time.Now().Add(time.Hour)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if deleted, err := DeleteExpired(id); err != nil || deleted {
+			t.Fatalf("%s: expected extended archive to be kept, received %v (%v)", kind, deleted, err)
+		}
+		if _, err := Stat(id); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+
+		if _, err := UpdateMetadata(id, func(m *Metadata) error {
+			m.Expiry = time.Now().Add(-time.Minute)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if deleted, err := DeleteExpired(id); err != nil || !deleted {
+			t.Fatalf("%s: expected expired archive to be deleted, received %v (%v)", kind, deleted, err)
+		}
+		if _, err := GetMetadata(id); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("%s: expected metadata to have been deleted along with the archive, received %v", kind, err)
+		}
+		if _, err := DeleteExpired(id); !errors.As(err, new(*StorageNotFoundError)) {
+			t.Fatalf("%s: expected deleted archive to be reported as not found, received %v", kind, err)
+		}
+	}
+	storageProvider = nil
+}
+
+func TestUploadSessions(t *testing.T) {
+	for kind, s := range backends {
+		storageProvider = s
+		session, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index, chunk := range []string{"jumpsover", "the", "lazydog"} {
+			if err := PutChunk(session, index, bytes.NewReader([]byte(chunk))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := PutChunk(session, 1, bytes.NewReader([]byte("resent"))); err != nil {
+			t.Fatalf("%s: expected acknowledged chunk to be accepted again, received %v", kind, err)
+		}
+		if err := PutChunk(session, 4, bytes.NewReader([]byte("skipped"))); !errors.As(err, new(*ChunkOrderError)) {
+			t.Fatalf("%s: expected ChunkOrderError, received %v", kind, err)
+		}
+		if chunks, size, err := UploadStatus(session); err != nil || chunks != 3 || size != 19 {
+			t.Fatalf("%s: expected 3 chunks of 19 bytes, received %d chunks of %d bytes (%v)", kind, chunks, size, err)
+		}
+
+		content, err := CompleteUpload(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := io.ReadAll(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(val) != "jumpsoverthelazydog" {
+			t.Fatalf("%s: expected chunks to be concatenated, received %q", kind, val)
+		}
+		if err := PutChunk(session, 3, bytes.NewReader([]byte("late"))); !errors.Is(err, ErrUploadBusy) {
+			t.Fatalf("%s: expected completed upload to refuse chunks, received %v", kind, err)
+		}
+		if err := DiscardUpload(session); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.Open(chunkKey(session, 0)); err == nil {
+			t.Fatalf("%s: expected chunks to have been deleted", kind)
+		}
+
+		abandoned, err := NewUpload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := PutChunk(abandoned, 0, bytes.NewReader([]byte("jumpsover"))); err != nil {
+			t.Fatal(err)
+		}
+		// the session is stored, any replica or a restarted server continues it
+		if _, err := s.Stat(abandoned + uploadSuffix); err != nil {
+			t.Fatalf("%s: expected upload session to be stored, received %v", kind, err)
+		}
+		orphan, err := NewId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(chunkKey(orphan, 0), bytes.NewReader([]byte("jumpsover"))); err != nil {
+			t.Fatal(err)
+		}
+
+		if collected, err := CollectAbandonedUploads(context.Background(), time.Hour); err != nil || len(collected) != 0 {
+			t.Fatalf("%s: expected active upload to be kept, received %v (%v)", kind, collected, err)
+		}
+		if _, err := s.Stat(chunkKey(orphan, 0)); err != nil {
+			t.Fatalf("%s: expected recent chunk to be kept, received %v", kind, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if collected, err := CollectAbandonedUploads(context.Background(), time.Millisecond); err != nil || len(collected) != 1 || collected[0] != abandoned {
+			t.Fatalf("%s: expected %s to be collected, received %v (%v)", kind, abandoned, collected, err)
+		}
+		if _, _, err := UploadStatus(abandoned); !errors.Is(err, ErrUploadNotFound) {
+			t.Fatalf("%s: expected collected upload to be gone, received %v", kind, err)
+		}
+		for _, key := range []string{chunkKey(abandoned, 0), chunkKey(orphan, 0)} {
+			if _, err := s.Stat(key); !errors.As(err, new(*StorageNotFoundError)) {
+				t.Fatalf("%s: expected chunk %s to be collected, received %v", kind, key, err)
+			}
+		}
+	}
+	storageProvider = nil
+}
+
+func TestList(t *testing.T) {
+	for kind, s := range backends {
+		for _, k := range []string{"listquickbrownfox", "listquickbrownfox.meta", "listlazydog"} {
+			if err := s.Put(k, bytes.NewReader([]byte("jumpsover"))); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Delete(k)
+		}
+
+		listed := map[string]bool{}
+		if err := s.List(context.Background(), "listquick", func(id string) error {
+			listed[id] = true
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(listed) != 2 || !listed["listquickbrownfox"] || !listed["listquickbrownfox.meta"] {
+			t.Fatalf("%s: expected objects starting with prefix, received %v", kind, listed)
+		}
+
+		stop := errors.New("stop")
+		calls := 0
+		if err := s.List(context.Background(), "list", func(string) error {
+			calls++
+			return stop
+		}); err != stop || calls != 1 {
+			t.Fatalf("%s: expected listing to stop at the first error, received %v after %d calls", kind, err, calls)
 		}
 	}
 }
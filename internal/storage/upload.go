@@ -0,0 +1,381 @@
+/*
+Copyright © 2021 Wilson Husin <wilsonehusin@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upload sessions store an archive in chunks, so that clients can resume an
+// interrupted upload. The state of a session is stored as a separate object
+// next to its chunks, so that sessions survive restarts and can be continued
+// through any replica, until the upload is completed or discarded.
+
+const uploadSuffix = ".upload"
+
+// uploadBusyTimeout is how long a session stays busy with a request, unless
+// the request finishes earlier. It only expires when the replica serving the
+// request went away.
+const uploadBusyTimeout = 10 * time.Minute
+
+type uploadSession struct {
+	Chunks       int       `json:"chunks"`
+	Size         int64     `json:"size"`
+	BusySince    time.Time `json:"busySince,omitempty"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+func (s *uploadSession) busy() bool {
+	return !s.BusySince.IsZero() && time.Since(s.BusySince) < uploadBusyTimeout
+}
+
+// uploadLock serializes updates of upload sessions, across replicas once
+// SetBroker was called
+var uploadLock sync.Locker = &sync.Mutex{}
+
+var (
+	ErrUploadNotFound = errors.New("upload session does not exist")
+	ErrUploadBusy     = errors.New("upload session is busy with another request")
+
+	// errChunkAcknowledged leaves a session unchanged for a chunk which was
+	// stored before
+	errChunkAcknowledged = errors.New("chunk was already acknowledged")
+)
+
+type ChunkOrderError struct {
+	Expected int
+}
+
+func (c *ChunkOrderError) Error() string {
+	return fmt.Sprintf("chunks have to be uploaded in order, expected chunk %d", c.Expected)
+}
+
+func chunkKey(session string, index int) string {
+	return session + "." + strconv.Itoa(index)
+}
+
+func NewUpload() (string, error) {
+	if storageProvider == nil {
+		return "", &UninitializedStorageError{}
+	}
+	session, err := NewId()
+	if err != nil {
+		return "", err
+	}
+	if _, err := lock(uploadLock); err != nil {
+		return "", err
+	}
+	defer uploadLock.Unlock()
+	if err := putUploadSession(session, &uploadSession{LastActivity: time.Now()}); err != nil {
+		return "", err
+	}
+	return session, nil
+}
+
+func getUploadSession(session string) (*uploadSession, error) {
+	r, _, err := storageProvider.Open(session + uploadSuffix)
+	if errors.As(err, new(*StorageNotFoundError)) {
+		return nil, ErrUploadNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	s := &uploadSession{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, fmt.Errorf("decoding upload session: %w", err)
+	}
+	return s, nil
+}
+
+func putUploadSession(session string, s *uploadSession) error {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding upload session: %w", err)
+	}
+	return storageProvider.Put(session+uploadSuffix, bytes.NewReader(encoded))
+}
+
+// updateUploadSession applies update to the state of session, nothing is
+// stored if update returns an error.
+func updateUploadSession(session string, update func(*uploadSession) error) (*uploadSession, error) {
+	held, err := lock(uploadLock)
+	if err != nil {
+		return nil, err
+	}
+	defer uploadLock.Unlock()
+	s, err := getUploadSession(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(s); err != nil {
+		return nil, err
+	}
+	if err := stillHeld(held); err != nil {
+		return nil, err
+	}
+	if err := putUploadSession(session, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// releaseUpload ends a request marked busy, adding a chunk of size bytes
+// unless stored is false.
+func releaseUpload(session string, stored bool, size int64) error {
+	_, err := updateUploadSession(session, func(s *uploadSession) error {
+		s.BusySince = time.Time{}
+		s.LastActivity = time.Now()
+		if stored {
+			s.Chunks++
+			s.Size += size
+		}
+		return nil
+	})
+	return err
+}
+
+// PutChunk stores chunk index of session. Chunks are acknowledged in order,
+// putting a chunk which was already acknowledged does nothing.
+func PutChunk(session string, index int, data io.Reader) error {
+	if storageProvider == nil {
+		return &UninitializedStorageError{}
+	}
+	_, err := updateUploadSession(session, func(s *uploadSession) error {
+		// marking the session busy keeps chunks from being written by
+		// concurrent requests
+		if s.busy() {
+			return ErrUploadBusy
+		}
+		if index < s.Chunks {
+			return errChunkAcknowledged
+		}
+		if index > s.Chunks {
+			return &ChunkOrderError{Expected: s.Chunks}
+		}
+		s.BusySince = time.Now()
+		return nil
+	})
+	if errors.Is(err, errChunkAcknowledged) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	counter := &countingReader{source: data}
+	putErr := storageProvider.Put(chunkKey(session, index), counter)
+	if err := releaseUpload(session, putErr == nil, counter.count); err != nil {
+		return err
+	}
+	return putErr
+}
+
+// UploadStatus returns how many chunks of session were acknowledged, along
+// with their total size.
+func UploadStatus(session string) (int, int64, error) {
+	if storageProvider == nil {
+		return 0, 0, &UninitializedStorageError{}
+	}
+	s, err := getUploadSession(session)
+	if err != nil {
+		return 0, 0, err
+	}
+	return s.Chunks, s.Size, nil
+}
+
+// CompleteUpload returns the concatenation of all chunks of session. The
+// session accepts no further chunks, DiscardUpload has to be called once the
+// content was consumed.
+func CompleteUpload(session string) (io.Reader, error) {
+	if storageProvider == nil {
+		return nil, &UninitializedStorageError{}
+	}
+	s, err := updateUploadSession(session, func(s *uploadSession) error {
+		if s.busy() {
+			return ErrUploadBusy
+		}
+		s.BusySince = time.Now()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{session: session, chunks: s.Chunks}, nil
+}
+
+// DiscardUpload removes session along with its chunks.
+func DiscardUpload(session string) error {
+	if storageProvider == nil {
+		return &UninitializedStorageError{}
+	}
+	if _, err := lock(uploadLock); err != nil {
+		return err
+	}
+	s, err := getUploadSession(session)
+	uploadLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return discardUpload(session, s.Chunks)
+}
+
+// discardUpload deletes chunks before the session, so that a failure leaves
+// the session to be collected later.
+func discardUpload(session string, chunks int) error {
+	if err := deleteChunks(session, chunks); err != nil {
+		return err
+	}
+	if _, err := lock(uploadLock); err != nil {
+		return err
+	}
+	defer uploadLock.Unlock()
+	return storageProvider.Delete(session + uploadSuffix)
+}
+
+// CollectAbandonedUploads discards sessions which have been idle for longer
+// than maxIdle, as well as chunks older than that which belong to no session,
+// returning the identifiers of sessions discarded.
+func CollectAbandonedUploads(ctx context.Context, maxIdle time.Duration) ([]string, error) {
+	if storageProvider == nil {
+		return nil, &UninitializedStorageError{}
+	}
+	sessions := map[string]bool{}
+	chunks := map[string][]int{}
+	err := storageProvider.List(ctx, "", func(id string) error {
+		dot := strings.LastIndexByte(id, '.')
+		if dot < 0 || !IsValidId(id[:dot]) {
+			return nil
+		}
+		if id[dot:] == uploadSuffix {
+			sessions[id[:dot]] = true
+		} else if index, err := strconv.Atoi(id[dot+1:]); err == nil {
+			chunks[id[:dot]] = append(chunks[id[:dot]], index)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []string
+	var firstErr error
+	for session := range sessions {
+		s, err := getUploadSession(session)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		} else if err != nil {
+			firstErr = err
+			continue
+		}
+		if s.busy() || time.Since(s.LastActivity) <= maxIdle {
+			continue
+		}
+		// chunks beyond the acknowledged ones may have been stored by a
+		// request which never finished
+		highest := s.Chunks
+		for _, index := range chunks[session] {
+			if index >= highest {
+				highest = index + 1
+			}
+		}
+		if err := discardUpload(session, highest); err != nil {
+			firstErr = err
+			continue
+		}
+		collected = append(collected, session)
+	}
+
+	for session, indexes := range chunks {
+		if sessions[session] {
+			continue
+		}
+		for _, index := range indexes {
+			info, err := storageProvider.Stat(chunkKey(session, index))
+			if err != nil || time.Since(info.ModTime) <= maxIdle {
+				continue
+			}
+			if err := storageProvider.Delete(chunkKey(session, index)); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return collected, firstErr
+}
+
+func deleteChunks(session string, chunks int) error {
+	var firstErr error
+	for index := 0; index < chunks; index++ {
+		err := storageProvider.Delete(chunkKey(session, index))
+		if err != nil && !errors.As(err, new(*StorageNotFoundError)) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type countingReader struct {
+	source io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.source.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// chunkReader opens the chunks of a session one after another.
+type chunkReader struct {
+	session string
+	chunks  int
+	next    int
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if c.next == c.chunks {
+				return 0, io.EOF
+			}
+			r, _, err := storageProvider.Open(chunkKey(c.session, c.next))
+			if err != nil {
+				return 0, fmt.Errorf("opening chunk %d: %w", c.next, err)
+			}
+			c.current = r
+			c.next++
+		}
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}